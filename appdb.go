@@ -11,14 +11,17 @@ THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLI
 package appdb
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-
-	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
+	"sync"
+	"time"
 )
 
 type SchemaVersionError struct {
@@ -30,6 +33,16 @@ func (e *SchemaVersionError) Error() string {
 	return fmt.Sprintf("Incorrect Schema Version: Got %d - Expected %d", e.Version, e.ExpectedVersion)
 }
 
+type SchemaVersionRangeError struct {
+	Version    uint8
+	MinVersion uint8
+	MaxVersion uint8
+}
+
+func (e *SchemaVersionRangeError) Error() string {
+	return fmt.Sprintf("Unsupported Schema Version: Got %d - Expected %d to %d", e.Version, e.MinVersion, e.MaxVersion)
+}
+
 type AppIdError struct {
 	Id         uint32
 	ExpectedId uint32
@@ -48,98 +61,540 @@ func (e *SchemaError) Error() string {
 	return fmt.Sprintf("Error %s creating schema on statement %s", e.Err, e.Statement)
 }
 
+// AppDB is an open application database. It embeds the underlying connection pool so the
+// usual database/sql methods are available, and keeps the identity the database was opened with.
+type AppDB struct {
+	*sql.DB
+	path          string
+	dsn           string
+	appName       string
+	schemaVersion uint8
+	logger        Logger
+	cfg           *config
+	stmts         *stmtCache
+	stats         *queryStats
+
+	stop       context.CancelFunc
+	background sync.WaitGroup
+}
+
+// newAppDB wraps an opened and validated connection pool.
+func newAppDB(db *sql.DB, dbPath string, appName string, schemaVersion uint8, cfg *config) *AppDB {
+	a := &AppDB{DB: db, path: filePath(dbPath), dsn: dbPath, appName: appName, schemaVersion: schemaVersion, logger: cfg.logger, cfg: cfg}
+	if cfg.stmtCacheSize > 0 {
+		a.stmts = newStmtCache(cfg.stmtCacheSize)
+	}
+	if cfg.queryStats {
+		a.stats = newQueryStats()
+	}
+	return a
+}
+
+// Close stops any background tasks, such as automatic backups, runs PRAGMA optimize if
+// WithOptimize was given, and closes the database. CloseContext also waits for statements in
+// progress and checkpoints the write-ahead log.
+func (a *AppDB) Close() error {
+	a.stopBackground()
+	if a.cfg.optimize {
+		// Failing to optimize doesn't stop the database closing; Optimize logs the error.
+		a.Optimize(context.Background())
+	}
+	a.stmts.close()
+	a.cfg.extensions.hooks.close()
+	// Closing the connections detaches the attached databases.
+	a.cfg.extensions.attachments.clear()
+	return a.DB.Close()
+}
+
+// CloseContext closes the database gracefully, leaving the file compact and self-contained. It
+// stops any background tasks, waits for statements in progress to finish, runs PRAGMA optimize
+// and a truncating WAL checkpoint, then closes the database. If ctx ends before the statements
+// finish, or the optimize or checkpoint fail, the database is closed anyway and the error
+// returned.
+// ctx -- context bounding how long to wait
+func (a *AppDB) CloseContext(ctx context.Context) error {
+	start := time.Now()
+	a.stopBackground()
+	err := a.waitIdle(ctx)
+	readOnly := false
+	if err == nil {
+		readOnly, err = a.readOnly(ctx)
+	}
+	if err == nil && !readOnly {
+		err = optimize(ctx, a.DB)
+		if err == nil {
+			_, err = checkpoint(ctx, a.DB, CheckpointTruncate)
+		}
+	}
+	a.stmts.close()
+	a.cfg.extensions.hooks.close()
+	// Closing the connections detaches the attached databases.
+	a.cfg.extensions.attachments.clear()
+	if cerr := a.DB.Close(); err == nil {
+		err = cerr
+	}
+	a.logOp("close", start, err)
+	return err
+}
+
+// stopBackground stops the background tasks and waits for them to return.
+func (a *AppDB) stopBackground() {
+	if a.stop != nil {
+		a.stop()
+		a.background.Wait()
+	}
+}
+
+// startBackground starts the configured background tasks, which run until Close.
+func (a *AppDB) startBackground() *AppDB {
+	var tasks []func(context.Context)
+	if a.cfg.autoBackupInterval > 0 {
+		tasks = append(tasks, a.autoBackup)
+	}
+	if a.cfg.walHook != nil && !isMemoryPath(a.dsn) {
+		tasks = append(tasks, a.replicateWAL)
+	}
+	if a.cfg.optimize && a.cfg.optimizeInterval > 0 {
+		tasks = append(tasks, func(ctx context.Context) {
+			a.maintain(ctx, "optimize", a.cfg.optimizeInterval, optimize)
+		})
+	}
+	if a.cfg.analyzeInterval > 0 {
+		tasks = append(tasks, func(ctx context.Context) {
+			a.maintain(ctx, "analyze", a.cfg.analyzeInterval, analyze)
+		})
+	}
+	if len(tasks) == 0 {
+		return a
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stop = cancel
+	for _, task := range tasks {
+		a.background.Add(1)
+		go func() {
+			defer a.background.Done()
+			task(ctx)
+		}()
+	}
+	return a
+}
+
+// Path returns the filesystem location of the database file.
+func (a *AppDB) Path() string {
+	return a.path
+}
+
+// AppName returns the application name the database was opened with.
+func (a *AppDB) AppName() string {
+	return a.appName
+}
+
+// ForeignKeys reports whether foreign key enforcement is enabled on the database's connections.
+func (a *AppDB) ForeignKeys() bool {
+	return a.cfg.foreignKeys
+}
+
+// SchemaVersion returns the schema version the database was opened with.
+func (a *AppDB) SchemaVersion() uint8 {
+	return a.schemaVersion
+}
+
+// ExecStatement prepares and executes one simple SQL statement and discards the result.
+func (a *AppDB) ExecStatement(sql string) error {
+	return a.ExecStatementContext(context.Background(), sql)
+}
+
+// ExecStatementContext is ExecStatement with a context.
+func (a *AppDB) ExecStatementContext(ctx context.Context, sql string) error {
+	ctx, end := a.trace(ctx, "exec", sql)
+	start := time.Now()
+	err := execStatement(ctx, a.DB, a.stmts, sql, a.cfg.retry, a.observe)
+	a.logOp("exec", start, err)
+	end(err)
+	return err
+}
+
+// BulkExec prepares one SQL statement and executes it once for each set of values provided.
+func (a *AppDB) BulkExec(sql string, values []string) error {
+	return a.BulkExecContext(context.Background(), sql, values)
+}
+
+// BulkExecContext is BulkExec with a context.
+func (a *AppDB) BulkExecContext(ctx context.Context, sql string, values []string) error {
+	ctx, end := a.trace(ctx, "bulkexec", sql)
+	start := time.Now()
+	err := execBulk(ctx, a.DB, a.stmts, sql, values, a.cfg.retry, a.observe)
+	a.logOp("bulkexec", start, err, slog.Int("rows", len(values)))
+	end(err)
+	return err
+}
+
+// BulkExecArgs prepares one SQL statement and executes it once for each row of arguments.
+func (a *AppDB) BulkExecArgs(sql string, rows [][]any) error {
+	return a.BulkExecArgsContext(context.Background(), sql, rows)
+}
+
+// BulkExecArgsContext is BulkExecArgs with a context.
+func (a *AppDB) BulkExecArgsContext(ctx context.Context, sql string, rows [][]any) error {
+	ctx, end := a.trace(ctx, "bulkexec", sql)
+	start := time.Now()
+	err := execBulkArgs(ctx, a.DB, a.stmts, sql, rows, a.cfg.retry, a.observe)
+	a.logOp("bulkexec", start, err, slog.Int("rows", len(rows)))
+	end(err)
+	return err
+}
+
+// Validate checks that the database still carries the app name and schema version it was opened with.
+func (a *AppDB) Validate() error {
+	return a.ValidateContext(context.Background())
+}
+
+// ValidateContext is Validate with a context.
+func (a *AppDB) ValidateContext(ctx context.Context) error {
+	start := time.Now()
+	err := validateDB(ctx, a.DB, a.appName, a.schemaVersion, a.cfg.applicationID)
+	a.logOp("validate", start, err)
+	return err
+}
+
 // InitAppDB initialises a sqlite3 database at the given path, opening if it exists, creating file & path if not.
+// dbPath may also be a SQLite URI filename ("file:app.db?cache=shared"), whose query parameters are passed to
+// the driver. In-memory databases (":memory:" or "file::memory:?cache=shared") are always created fresh.
 // dbPath -- the filesystem location of the database file
 // appName -- name of application (arbitrary string, used to validate database)
 // schemaVersion -- version of schema in use (8-bit integer, used to validate database)
 // schema -- SQL statements to initialise database schema.
-func InitAppDB(dbPath string, appName string, schemaVersion uint8, schema []string) (*sql.DB, error) {
-	_, err := os.Stat(dbPath)
-	var db *sql.DB
-	if os.IsNotExist(err) {
-		if err := os.MkdirAll(filepath.Dir(dbPath), os.ModeDir|0700); err != nil {
-			return nil, err
-		}
+// opts -- options configuring the database connection.
+func InitAppDB(dbPath string, appName string, schemaVersion uint8, schema []string, opts ...Option) (*AppDB, error) {
+	return InitAppDBContext(context.Background(), dbPath, appName, schemaVersion, schema, opts...)
+}
 
-		fh, err := os.Create(dbPath) // Create SQLite file
-		if err != nil {
-			return nil, err
+// InitAppDBContext is InitAppDB with a context, which is used for all statements run while
+// opening the database and creating the schema.
+func InitAppDBContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, schema []string, opts ...Option) (_ *AppDB, err error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	ctx, end := cfg.tracer.Start(ctx, Operation{Name: "init", Path: dbPath, AppName: appName})
+	defer func() { end(err) }()
+	if cfg.schemaLint {
+		logLint(ctx, cfg, dbPath, appName, schema)
+	}
+	if !isMemoryPath(dbPath) {
+		_, err := os.Stat(filePath(dbPath))
+		if !os.IsNotExist(err) {
+			return OpenContext(ctx, dbPath, appName, schemaVersion, opts...)
 		}
-		fh.Close()
-		db, err = openAppDBNoValidate(dbPath)
-		if err != nil {
+	}
+	db, err := createAppDB(ctx, dbPath, appName, schemaVersion, schema, cfg)
+	logEvent(cfg.logger, "init", dbPath, appName, schemaVersion, start, err, cfg.logFields()...)
+	if err != nil {
+		return nil, err
+	}
+	return newAppDB(db, dbPath, appName, schemaVersion, cfg).startBackground(), nil
+}
+
+// createAppDB creates a new database at dbPath, which must not already exist unless it is in
+// memory, creates the schema, checks the required tables and seeds it. Background tasks are left
+// to the caller to start.
+func createAppDB(ctx context.Context, dbPath string, appName string, schemaVersion uint8, schema []string, cfg *config) (*sql.DB, error) {
+	if !isMemoryPath(dbPath) {
+		if err := createDBFile(filePath(dbPath), cfg); err != nil {
 			return nil, err
 		}
-		initSchema(db, appName, schemaVersion, schema)
-	} else {
-		db, err = Open(dbPath, appName, schemaVersion)
-		if err != nil {
-			return nil, err
+	}
+	db, err := openAppDBNoValidate(ctx, dbPath, cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	err = initSchema(ctx, db, appName, schemaVersion, schema, cfg.applicationID)
+	if err == nil {
+		err = verifyCreatePragmas(ctx, db, cfg)
+	}
+	if err == nil && cfg.schemaChecksum {
+		err = storeSchemaChecksum(ctx, db)
+	}
+	if err == nil {
+		err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+	}
+	if err == nil {
+		err = seedDB(ctx, db, cfg)
+	}
+	if err != nil {
+		// A half-made database would make every later attempt fail, so it is removed.
+		db.Close()
+		if !isMemoryPath(dbPath) {
+			removeDBFiles(filePath(dbPath))
 		}
+		return nil, err
 	}
-
 	return db, nil
 }
 
-// openAppDBNoValidate opens the database file without validation
-func openAppDBNoValidate(dbPath string) (*sql.DB, error) {
-	var db *sql.DB
-	filestat, err := os.Stat(dbPath)
+// removeDBFiles removes a database file and any journal, write-ahead log or shared memory file
+// beside it.
+func removeDBFiles(path string) {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// createDBFile creates an empty database file, and its directory if needed, with the configured
+// permissions. The modes are applied explicitly so the process umask doesn't loosen or tighten them.
+func createDBFile(path string, cfg *config) error {
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, os.ModeDir|cfg.dirMode); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, cfg.dirMode); err != nil {
+			return err
+		}
+	}
+
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, cfg.fileMode) // Create SQLite file
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if filestat.Mode().IsRegular() {
-		db, err = sql.Open("sqlite3", dbPath)
+	fh.Close()
+	return os.Chmod(path, cfg.fileMode)
+}
+
+// openAppDBNoValidate opens the database file without validation and applies the configured pragmas
+// create is set when the database is new, so settings that only take effect before the schema is created are applied
+func openAppDBNoValidate(ctx context.Context, dbPath string, cfg *config, create bool) (*sql.DB, error) {
+	if !isMemoryPath(dbPath) {
+		filestat, err := os.Stat(filePath(dbPath))
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		return nil, os.ErrInvalid
+		if !filestat.Mode().IsRegular() {
+			return nil, os.ErrInvalid
+		}
+	}
+	lock, err := acquireLock(dbPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var closer io.Closer
+	if lock != nil {
+		closer = lock
+	}
+	db, err := openDriver(cfg.driver, dbPath, &cfg.extensions, cfg.connStatements(create), closer)
+	if err != nil {
+		if lock != nil {
+			lock.Close()
+		}
+		return nil, err
+	}
+	if isMemoryPath(dbPath) {
+		// Each connection to a private in-memory database sees a different database, and the
+		// database is lost when its connection closes, so keep to a single connection.
+		if uriQuery(dbPath).Get("cache") != "shared" {
+			db.SetMaxOpenConns(1)
+		}
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+	if err := applyPragmas(ctx, db, cfg); err != nil {
+		return nil, corruptionFrom(err)
 	}
 	return db, nil
 }
 
+// applyPragmas checks that the database can be read with any configured encryption key and that
+// the configured pragmas, run on each connection, took effect, closing the database if anything
+// fails.
+func applyPragmas(ctx context.Context, db *sql.DB, cfg *config) error {
+	if cfg.encryptionKey != nil {
+		if err := verifyDecryption(ctx, db); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if err := verifyPragmas(ctx, db, cfg); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// isMemoryPath reports whether dbPath names an in-memory database rather than a file.
+func isMemoryPath(dbPath string) bool {
+	return dbPath == ":memory:" || filePath(dbPath) == ":memory:" || uriQuery(dbPath).Get("mode") == "memory"
+}
+
+// InitMemoryDB initialises an in-memory database with the given schema. The database lasts until
+// the returned AppDB is closed. It is intended for tests and short-lived tools.
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema in use (8-bit integer, used to validate database)
+// schema -- SQL statements to initialise database schema.
+// opts -- options configuring the database connection.
+func InitMemoryDB(appName string, schemaVersion uint8, schema []string, opts ...Option) (*AppDB, error) {
+	return InitMemoryDBContext(context.Background(), appName, schemaVersion, schema, opts...)
+}
+
+// InitMemoryDBContext is InitMemoryDB with a context.
+func InitMemoryDBContext(ctx context.Context, appName string, schemaVersion uint8, schema []string, opts ...Option) (*AppDB, error) {
+	return InitAppDBContext(ctx, ":memory:", appName, schemaVersion, schema, opts...)
+}
+
 // Open opens and validates the database
 // dbPath -- the filesystem location of the database file
 // appName -- name of application (arbitrary string, used to validate database)
 // schemaVersion -- version of schema in use (8-bit integer, used to validate database)
-func Open(dbPath string, appName string, schemaVersion uint8) (*sql.DB, error) {
-	db, err := openAppDBNoValidate(dbPath)
+// opts -- options configuring the database connection.
+func Open(dbPath string, appName string, schemaVersion uint8, opts ...Option) (*AppDB, error) {
+	return OpenContext(context.Background(), dbPath, appName, schemaVersion, opts...)
+}
+
+// OpenContext is Open with a context.
+func OpenContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, opts ...Option) (_ *AppDB, err error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	ctx, end := cfg.tracer.Start(ctx, Operation{Name: "open", Path: dbPath, AppName: appName})
+	defer func() { end(err) }()
+	db, err := openAppDBNoValidate(ctx, dbPath, cfg, false)
 	if err != nil {
+		logEvent(cfg.logger, "open", dbPath, appName, schemaVersion, start, err, cfg.logFields()...)
 		return nil, err
 	}
-	err = validateDB(db, appName, schemaVersion)
+	err = validateDB(ctx, db, appName, schemaVersion, cfg.applicationID)
+	if err == nil && cfg.schemaChecksum {
+		err = verifySchemaChecksum(ctx, db)
+	}
+	if err == nil {
+		err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+	}
+	logEvent(cfg.logger, "open", dbPath, appName, schemaVersion, start, err, cfg.logFields()...)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
-	return db, nil
+	return newAppDB(db, dbPath, appName, schemaVersion, cfg).startBackground(), nil
+}
+
+// OpenCompat opens and validates a database whose schema version may be anywhere in a range the
+// application can work with. The detected version is available from the returned AppDB's
+// SchemaVersion method, so the application can enable or disable features to match.
+// dbPath -- the filesystem location of the database file
+// appName -- name of application (arbitrary string, used to validate database)
+// minVersion -- oldest schema version the application supports
+// maxVersion -- newest schema version the application supports
+// opts -- options configuring the database connection.
+func OpenCompat(dbPath string, appName string, minVersion uint8, maxVersion uint8, opts ...Option) (*AppDB, error) {
+	return OpenCompatContext(context.Background(), dbPath, appName, minVersion, maxVersion, opts...)
+}
+
+// OpenCompatContext is OpenCompat with a context.
+func OpenCompatContext(ctx context.Context, dbPath string, appName string, minVersion uint8, maxVersion uint8, opts ...Option) (_ *AppDB, err error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	ctx, end := cfg.tracer.Start(ctx, Operation{Name: "open", Path: dbPath, AppName: appName})
+	defer func() { end(err) }()
+	db, err := openAppDBNoValidate(ctx, dbPath, cfg, false)
+	if err != nil {
+		logEvent(cfg.logger, "open", dbPath, appName, maxVersion, start, err, cfg.logFields()...)
+		return nil, err
+	}
+	version, err := currentSchemaVersion(ctx, db, appName, cfg.applicationID)
+	if err == nil && (version < minVersion || version > maxVersion) {
+		err = &SchemaVersionRangeError{version, minVersion, maxVersion}
+	}
+	if err == nil && cfg.schemaChecksum {
+		err = verifySchemaChecksum(ctx, db)
+	}
+	if err == nil {
+		err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+	}
+	logEvent(cfg.logger, "open", dbPath, appName, version, start, err, cfg.logFields()...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newAppDB(db, dbPath, appName, version, cfg).startBackground(), nil
 }
 
 // ExecSqlStatement prepares and executes one simple SQL statement and discards the result.
 func ExecSqlStatement(db *sql.DB, sql string) error {
-	stmt, err := db.Prepare(sql)
+	return ExecSqlStatementContext(context.Background(), db, sql)
+}
+
+// ExecSqlStatementContext is ExecSqlStatement with a context.
+func ExecSqlStatementContext(ctx context.Context, db *sql.DB, sql string) error {
+	return execStatement(ctx, db, nil, sql, RetryPolicy{}, nil)
+}
+
+// execStatement runs one statement, prepared through stmts, retrying it according to policy.
+// Each attempt is reported to obs if it is not nil.
+func execStatement(ctx context.Context, db *sql.DB, stmts *stmtCache, sql string, policy RetryPolicy, obs observer) error {
+	stmt, release, err := stmts.prepare(ctx, db, sql)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec()
-	if err != nil {
+	defer release()
+	return policy.do(ctx, func() error {
+		start := time.Now()
+		res, err := stmt.ExecContext(ctx)
+		if obs != nil {
+			obs(sql, nil, start, res, err)
+		}
 		return err
-	}
-	return nil
+	})
 }
 
 // ExecBulkSql prepares one SQL statement and executes it once for each set of values provides.
 func ExecBulkSql(db *sql.DB, sql string, values []string) error {
-	stmt, err := db.Prepare(sql)
+	return ExecBulkSqlContext(context.Background(), db, sql, values)
+}
+
+// ExecBulkSqlContext is ExecBulkSql with a context. The context is checked between rows,
+// so a cancelled bulk load stops at the next row.
+func ExecBulkSqlContext(ctx context.Context, db *sql.DB, sql string, values []string) error {
+	return execBulk(ctx, db, nil, sql, values, RetryPolicy{}, nil)
+}
+
+// ExecBulkSqlArgs prepares one SQL statement and executes it once for each row of arguments,
+// so statements may have several placeholders and take values of any type the driver accepts.
+func ExecBulkSqlArgs(db *sql.DB, sql string, rows [][]any) error {
+	return ExecBulkSqlArgsContext(context.Background(), db, sql, rows)
+}
+
+// ExecBulkSqlArgsContext is ExecBulkSqlArgs with a context. The context is checked between rows.
+func ExecBulkSqlArgsContext(ctx context.Context, db *sql.DB, sql string, rows [][]any) error {
+	return execBulkArgs(ctx, db, nil, sql, rows, RetryPolicy{}, nil)
+}
+
+// execBulk runs one statement for each value.
+func execBulk(ctx context.Context, db *sql.DB, stmts *stmtCache, sql string, values []string, policy RetryPolicy, obs observer) error {
+	rows := make([][]any, len(values))
+	for v := range values {
+		rows[v] = []any{values[v]}
+	}
+	return execBulkArgs(ctx, db, stmts, sql, rows, policy, obs)
+}
+
+// execBulkArgs runs one statement for each row of arguments, retrying each row according to
+// policy so that rows already inserted aren't repeated. Each execution is reported to obs if it
+// is not nil.
+func execBulkArgs(ctx context.Context, db *sql.DB, stmts *stmtCache, sql string, rows [][]any, policy RetryPolicy, obs observer) error {
+	stmt, release, err := stmts.prepare(ctx, db, sql)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer release()
 
-	for v := range values {
-		_, err = stmt.Exec(values[v])
+	for r := range rows {
+		err = policy.do(ctx, func() error {
+			start := time.Now()
+			res, err := stmt.ExecContext(ctx, rows[r]...)
+			if obs != nil {
+				obs(sql, rows[r], start, res, err)
+			}
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -157,14 +612,13 @@ func getUserVersion(appName string, schemaVersion uint8) uint32 {
 	return uv
 }
 
-// initSchema initializes the schema, setting the user_version pragma and foreign_key pragma
-func initSchema(db *sql.DB, appName string, schemaVersion uint8, schema []string) error {
+// initSchema initializes the schema, setting the user_version pragma (and application_id pragma if asked)
+func initSchema(ctx context.Context, db *sql.DB, appName string, schemaVersion uint8, schema []string, applicationID bool) error {
 	var s []string
-	s = append(s, fmt.Sprintf("PRAGMA user_version = %d ;", getUserVersion(appName, schemaVersion)),
-		`PRAGMA foreign_keys = ON;`)
+	s = append(s, versionStatements(appName, schemaVersion, applicationID)...)
 	s = append(s, schema...)
 	for v := range s {
-		err := ExecSqlStatement(db, s[v])
+		err := ExecSqlStatementContext(ctx, db, s[v])
 		if err != nil {
 			return &SchemaError{s[v], err}
 		}
@@ -172,16 +626,41 @@ func initSchema(db *sql.DB, appName string, schemaVersion uint8, schema []string
 	return nil
 }
 
+// querier is the part of *sql.DB, *sql.Conn and *sql.Tx used to run statements.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// tableExists reports whether the database has a table with the given name.
+func tableExists(ctx context.Context, db querier, name string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // validateDB checks that the user_version pragma value matches that expected by the application
-// We avoid using the application_id pragma as this chosing values for this and avoiding collisions
-// with officially registered applications isn't well specified.
-func validateDB(db *sql.DB, appName string, schemaVersion uint8) error {
-	r := db.QueryRow("PRAGMA user_version")
+// By default we avoid using the application_id pragma as this chosing values for this and avoiding collisions
+// with officially registered applications isn't well specified. WithApplicationID opts in to it.
+func validateDB(ctx context.Context, db *sql.DB, appName string, schemaVersion uint8, applicationID bool) error {
+	if applicationID {
+		version, err := currentSchemaVersion(ctx, db, appName, true)
+		if err != nil {
+			return err
+		}
+		if version != schemaVersion {
+			return &SchemaVersionError{version, schemaVersion}
+		}
+		return nil
+	}
 	uv := getUserVersion(appName, schemaVersion)
 
-	var user_version uint32
-
-	if err := r.Scan(&user_version); err != nil {
+	user_version, err := readPragmaUint32(ctx, db, "user_version")
+	if err != nil {
 		return err
 	}
 	if uv != user_version {
@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB returns a database in a temporary directory initialised with schema, closed when the
+// test ends.
+func newTestDB(t *testing.T, schema []string, opts ...Option) *AppDB {
+	t.Helper()
+	db, err := InitAppDB(filepath.Join(t.TempDir(), "test.db"), "test", 1, schema, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestInitAppDBFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := InitAppDB(path, "test", 1, []string{"CREATE TABLE broken ("}); err == nil {
+		t.Fatal("InitAppDB with an invalid schema succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("database left behind after a failed initialisation: %v", err)
+	}
+	db, err := InitAppDB(path, "test", 1, []string{"CREATE TABLE fixed (id INTEGER PRIMARY KEY);"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestSchemaChecksumOptional(t *testing.T) {
+	ctx := context.Background()
+	schema := []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, attrs TEXT);"}
+	for _, checksum := range []bool{false, true} {
+		var opts []Option
+		if checksum {
+			opts = append(opts, WithSchemaChecksum())
+		}
+		db := newTestDB(t, schema, opts...)
+		if err := CreateJSONIndex(ctx, db, "items_colour", "items", "attrs", "$.colour"); err != nil {
+			t.Fatal(err)
+		}
+		exists, err := tableExists(ctx, db, metaTable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != checksum {
+			t.Errorf("WithSchemaChecksum %v: %s exists = %v", checksum, metaTable, exists)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package appdbtest helps test code that uses appdb: it creates databases that are cleaned up when
+// the test ends, checks schemas against golden files and provides a fake appdb.DB.
+package appdbtest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+// New creates a database with the given schema in a fresh file under t.TempDir, failing the test
+// if it can't. The database is closed when the test and its subtests finish, and the directory
+// then removed.
+// t -- test the database is for
+// appName -- name of application, as for InitAppDB
+// schemaVersion -- version of schema in use, as for InitAppDB
+// schema -- SQL statements to initialise database schema
+// opts -- options configuring the database connection
+func New(t testing.TB, appName string, schemaVersion uint8, schema []string, opts ...appdb.Option) *appdb.AppDB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := appdb.InitAppDB(path, appName, schemaVersion, schema, opts...)
+	if err != nil {
+		t.Fatalf("appdbtest: creating database: %v", err)
+	}
+	closeOnCleanup(t, db)
+	return db
+}
+
+// NewMemory is New with an in-memory database, which is faster but can't be reopened and uses a
+// single connection.
+// t -- test the database is for
+// appName -- name of application, as for InitAppDB
+// schemaVersion -- version of schema in use, as for InitAppDB
+// schema -- SQL statements to initialise database schema
+// opts -- options configuring the database connection
+func NewMemory(t testing.TB, appName string, schemaVersion uint8, schema []string, opts ...appdb.Option) *appdb.AppDB {
+	t.Helper()
+	db, err := appdb.InitMemoryDB(appName, schemaVersion, schema, opts...)
+	if err != nil {
+		t.Fatalf("appdbtest: creating database: %v", err)
+	}
+	closeOnCleanup(t, db)
+	return db
+}
+
+// closeOnCleanup closes db when the test finishes, failing the test if that fails.
+func closeOnCleanup(t testing.TB, db *appdb.AppDB) {
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("appdbtest: closing database: %v", err)
+		}
+	})
+}
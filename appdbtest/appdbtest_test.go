@@ -0,0 +1,42 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdbtest
+
+import (
+	"testing"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+func TestNew(t *testing.T) {
+	schema := []string{"CREATE TABLE items (id INTEGER PRIMARY KEY);"}
+	var file, memory *appdb.AppDB
+	ok := t.Run("databases", func(t *testing.T) {
+		file = New(t, "test", 1, schema)
+		memory = NewMemory(t, "test", 1, schema)
+		for _, db := range []*appdb.AppDB{file, memory} {
+			if err := db.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec("INSERT INTO items (id) VALUES (1)"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if !ok {
+		return
+	}
+	for _, db := range []*appdb.AppDB{file, memory} {
+		if err := db.Ping(); err == nil {
+			t.Error("database still open after the subtest finished")
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+package appdbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+// Call is one call recorded by a Fake.
+type Call struct {
+	// Method is "exec", "query", "begin", "commit", "rollback" or "validate".
+	Method string
+	// Query is the SQL of an exec or query, and empty otherwise.
+	Query string
+	Args  []any
+	// InTx is true for statements run inside a transaction.
+	InTx bool
+}
+
+// Fake is an appdb.DB that runs no SQL, recording each call and answering with the results set
+// for each query, so that code using the database can be unit tested without SQLite. Queries are
+// matched ignoring differences in whitespace; an exec with no result set affects no rows, and a
+// query with none returns no rows. A Fake is safe for concurrent use.
+type Fake struct {
+	// ValidateErr is returned by ValidateContext.
+	ValidateErr error
+
+	mu      sync.Mutex
+	calls   []Call
+	execs   map[string]fakeExec
+	queries map[string]fakeQuery
+	db      *sql.DB
+}
+
+var _ appdb.DB = (*Fake)(nil)
+
+type fakeExec struct {
+	lastInsertID int64
+	rowsAffected int64
+	err          error
+}
+
+type fakeQuery struct {
+	columns []string
+	rows    [][]any
+	err     error
+}
+
+// NewFake returns a Fake with no results set.
+func NewFake() *Fake {
+	f := &Fake{execs: map[string]fakeExec{}, queries: map[string]fakeQuery{}}
+	f.db = sql.OpenDB(fakeConnector{f})
+	return f
+}
+
+// OnExec sets the result of exec calls of query.
+// query -- SQL of the statement
+// lastInsertID -- value for the result's LastInsertId
+// rowsAffected -- value for the result's RowsAffected
+func (f *Fake) OnExec(query string, lastInsertID int64, rowsAffected int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.execs[normalize(query)] = fakeExec{lastInsertID: lastInsertID, rowsAffected: rowsAffected}
+}
+
+// OnQuery sets the rows returned by query calls of query.
+// query -- SQL of the query
+// columns -- names of the result columns
+// rows -- values of each row, one per column
+func (f *Fake) OnQuery(query string, columns []string, rows ...[]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries[normalize(query)] = fakeQuery{columns: columns, rows: rows}
+}
+
+// OnError makes exec and query calls of query fail with err.
+// query -- SQL of the statement or query
+// err -- error to return
+func (f *Fake) OnError(query string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.execs[normalize(query)] = fakeExec{err: err}
+	f.queries[normalize(query)] = fakeQuery{err: err}
+}
+
+// Calls returns the calls made so far, in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Reset forgets the calls made so far, keeping the results set.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// ExecContext records the statement and returns the result set for it.
+func (f *Fake) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return f.db.ExecContext(ctx, query, args...)
+}
+
+// QueryContext records the query and returns the rows set for it.
+func (f *Fake) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return f.db.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext records the query and returns the first row set for it.
+func (f *Fake) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return f.db.QueryRowContext(ctx, query, args...)
+}
+
+// WithTx runs fn in a fake transaction, recording its beginning and its commit or rollback.
+func (f *Fake) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ValidateContext records the call and returns ValidateErr.
+func (f *Fake) ValidateContext(ctx context.Context) error {
+	f.record(Call{Method: "validate"})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ValidateErr
+}
+
+func (f *Fake) record(c Call) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, c)
+}
+
+// normalize collapses whitespace so that queries match however they are laid out.
+func normalize(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// fakeConnector and the types below are a database/sql driver answering from a Fake.
+type fakeConnector struct {
+	f *Fake
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{f: c.f}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return fakeDriver{c.f}
+}
+
+type fakeDriver struct {
+	f *Fake
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{f: d.f}, nil
+}
+
+type fakeConn struct {
+	f    *Fake
+	inTx bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("appdbtest: Fake does not support prepared statements")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.f.record(Call{Method: "begin"})
+	c.inTx = true
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.inTx = false
+	c.f.record(Call{Method: "commit"})
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.inTx = false
+	c.f.record(Call{Method: "rollback"})
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.f.record(Call{Method: "exec", Query: query, Args: values(args), InTx: c.inTx})
+	c.f.mu.Lock()
+	e := c.f.execs[normalize(query)]
+	c.f.mu.Unlock()
+	if e.err != nil {
+		return nil, e.err
+	}
+	return fakeResult(e), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.f.record(Call{Method: "query", Query: query, Args: values(args), InTx: c.inTx})
+	c.f.mu.Lock()
+	q := c.f.queries[normalize(query)]
+	c.f.mu.Unlock()
+	if q.err != nil {
+		return nil, q.err
+	}
+	return &fakeRows{columns: q.columns, rows: q.rows}, nil
+}
+
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error {
+	// Accept any argument, so the Fake records it as given.
+	return nil
+}
+
+func values(args []driver.NamedValue) []any {
+	v := make([]any, len(args))
+	for i, a := range args {
+		v[i] = a.Value
+	}
+	return v
+}
+
+type fakeResult fakeExec
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]any
+	next    int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.next]
+	r.next++
+	for i := range dest {
+		if i >= len(row) {
+			dest[i] = nil
+			continue
+		}
+		v, err := driver.DefaultParameterConverter.ConvertValue(row[i])
+		if err != nil {
+			return err
+		}
+		dest[i] = v
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdbtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake()
+	f.OnExec("INSERT INTO items (name) VALUES (?)", 7, 1)
+	f.OnQuery("SELECT name FROM items WHERE id = ?", []string{"name"}, []any{"apple"})
+	broken := errors.New("broken")
+	f.OnError("DELETE FROM items", broken)
+
+	res, err := f.ExecContext(ctx, "INSERT INTO items\n\t(name) VALUES (?)", "apple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 7 {
+		t.Errorf("LastInsertId = %d, want 7", id)
+	}
+	var name string
+	if err := f.QueryRowContext(ctx, "SELECT name FROM items WHERE id = ?", 7).Scan(&name); err != nil || name != "apple" {
+		t.Errorf("name = %q, %v, want apple", name, err)
+	}
+	if err := f.QueryRowContext(ctx, "SELECT name FROM other").Scan(&name); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unset query error = %v, want sql.ErrNoRows", err)
+	}
+	err = f.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM items")
+		return err
+	})
+	if !errors.Is(err, broken) {
+		t.Errorf("WithTx error = %v, want %v", err, broken)
+	}
+
+	f.ValidateErr = broken
+	if err := f.ValidateContext(ctx); err != broken {
+		t.Errorf("ValidateContext = %v, want %v", err, broken)
+	}
+
+	var methods []string
+	for _, c := range f.Calls() {
+		methods = append(methods, c.Method)
+	}
+	want := []string{"exec", "query", "query", "begin", "exec", "rollback", "validate"}
+	if len(methods) != len(want) {
+		t.Fatalf("calls = %v, want %v", methods, want)
+	}
+	for i := range want {
+		if methods[i] != want[i] {
+			t.Fatalf("calls = %v, want %v", methods, want)
+		}
+	}
+	if calls := f.Calls(); calls[0].InTx || !calls[4].InTx || calls[0].Args[0] != "apple" {
+		t.Errorf("calls = %+v", calls)
+	}
+	f.Reset()
+	if len(f.Calls()) != 0 {
+		t.Error("Reset kept the calls")
+	}
+}
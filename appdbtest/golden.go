@@ -0,0 +1,101 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+package appdbtest
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+// update is set by running the tests with -appdbtest.update, to rewrite golden schema files.
+var update = flag.Bool("appdbtest.update", false, "rewrite appdbtest golden schema files")
+
+// CheckSchema compares the database's schema, in the canonical text form of
+// appdb.SchemaInfo.String, with the golden file at path, failing the test and listing the
+// differing lines if they don't match. Keep the golden file under version control, so that a
+// migration that changes the schema unintentionally fails the build.
+// Run the tests with -appdbtest.update to write the golden file from the current schema instead,
+// after a deliberate change.
+// t -- test to fail on a mismatch
+// db -- database whose schema to check
+// path -- golden file, such as "testdata/schema.golden"
+func CheckSchema(t testing.TB, db *appdb.AppDB, path string) {
+	t.Helper()
+	s, err := db.SchemaContext(context.Background())
+	if err != nil {
+		t.Fatalf("appdbtest: reading schema: %v", err)
+	}
+	got := s.String()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("appdbtest: writing golden schema: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("appdbtest: writing golden schema: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("appdbtest: golden schema %s does not exist; run the tests with -appdbtest.update to create it", path)
+	}
+	if err != nil {
+		t.Fatalf("appdbtest: reading golden schema: %v", err)
+	}
+	if string(want) != got {
+		t.Errorf("appdbtest: schema differs from %s (run the tests with -appdbtest.update to accept it):\n%s", path, lineDiff(string(want), got))
+	}
+}
+
+// lineDiff lists the lines only in want, prefixed "-", and only in got, prefixed "+", in order,
+// from a longest common subsequence of the lines.
+func lineDiff(want string, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of w[i:] and g[j:].
+	lcs := make([][]int, len(w)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(g)+1)
+	}
+	for i := len(w) - 1; i >= 0; i-- {
+		for j := len(g) - 1; j >= 0; j-- {
+			if w[i] == g[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var b strings.Builder
+	i, j := 0, 0
+	for i < len(w) || j < len(g) {
+		switch {
+		case i < len(w) && j < len(g) && w[i] == g[j]:
+			i++
+			j++
+		case j < len(g) && (i == len(w) || lcs[i][j+1] >= lcs[i+1][j]):
+			b.WriteString("+" + g[j] + "\n")
+			j++
+		default:
+			b.WriteString("-" + w[i] + "\n")
+			i++
+		}
+	}
+	return b.String()
+}
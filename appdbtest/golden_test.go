@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdbtest
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errorRecorder is a test that records its errors instead of failing.
+type errorRecorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *errorRecorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCheckSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdata", "schema.golden")
+	db := New(t, "test", 1, []string{"CREATE TABLE items (id INTEGER PRIMARY KEY);"})
+	*update = true
+	t.Cleanup(func() { *update = false })
+	CheckSchema(t, db, path)
+	*update = false
+	CheckSchema(t, db, path)
+
+	if _, err := db.Exec("CREATE TABLE tags (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	r := &errorRecorder{TB: t}
+	CheckSchema(r, db, path)
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "+table tags") {
+		t.Errorf("errors = %q, want one listing the added table", r.errors)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	got := lineDiff("a\nb\nc\nd", "a\nc\nx\nd")
+	want := "-b\n+x\n"
+	if got != want {
+		t.Errorf("lineDiff = %q, want %q", got, want)
+	}
+}
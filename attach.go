@@ -0,0 +1,232 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// attachments are the databases attached with Attach, which are attached to every new connection.
+type attachments struct {
+	mu      sync.Mutex
+	aliases []string
+	paths   map[string]string
+}
+
+// statements returns the statements attaching the databases to a connection.
+func (t *attachments) statements() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var statements []string
+	for _, alias := range t.aliases {
+		statements = append(statements, attachStatement(t.paths[alias], alias))
+	}
+	return statements
+}
+
+// empty reports whether no databases are attached.
+func (t *attachments) empty() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.aliases) == 0
+}
+
+// add records an attached database, reporting false if alias is already in use.
+func (t *attachments) add(alias, path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.paths[alias]; ok {
+		return false
+	}
+	if t.paths == nil {
+		t.paths = map[string]string{}
+	}
+	t.aliases = append(t.aliases, alias)
+	t.paths[alias] = path
+	return true
+}
+
+// remove forgets an attached database, reporting false if there was none with alias.
+func (t *attachments) remove(alias string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.paths[alias]; !ok {
+		return false
+	}
+	delete(t.paths, alias)
+	for i, a := range t.aliases {
+		if a == alias {
+			t.aliases = append(t.aliases[:i], t.aliases[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// clear forgets every attached database.
+func (t *attachments) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.aliases = nil
+	t.paths = nil
+}
+
+// attachStatement returns the statement attaching the database at path as alias.
+func attachStatement(path, alias string) string {
+	return fmt.Sprintf("ATTACH DATABASE '%s' AS %s", strings.ReplaceAll(path, "'", "''"), quoteIdent(alias))
+}
+
+// Attach attaches another application database to every connection, so that its tables can be
+// used in statements as alias.table. The database is validated as Open validates one: it must
+// belong to appName and have the given schema version. Connections in use elsewhere are attached
+// as they are returned to the pool, so Attach waits for them. The database stays attached until
+// Detach or Close.
+// ctx -- context for the statements
+// path -- the filesystem location of the database file
+// alias -- name to use for the database in statements
+// appName -- name of the application the database belongs to
+// schemaVersion -- version of schema expected in the database
+func (a *AppDB) Attach(ctx context.Context, path, alias, appName string, schemaVersion uint8) error {
+	start := time.Now()
+	err := a.attach(ctx, path, alias, appName, schemaVersion)
+	a.logOp("attach", start, err, slog.String("attached", path), slog.String("alias", alias),
+		slog.String("attached_app", appName), slog.Int("attached_version", int(schemaVersion)))
+	return err
+}
+
+func (a *AppDB) attach(ctx context.Context, path, alias, appName string, schemaVersion uint8) error {
+	// ATTACH creates a missing file, so check it exists first, as Open does.
+	filestat, err := os.Stat(filePath(path))
+	if err != nil {
+		return err
+	}
+	if !filestat.Mode().IsRegular() {
+		return os.ErrInvalid
+	}
+	if err := a.validateAttachment(ctx, path, alias, appName, schemaVersion); err != nil {
+		return err
+	}
+	err = a.eachConn(ctx, func(c *sql.Conn) error {
+		attached, err := isAttached(ctx, c, alias)
+		if err != nil || attached {
+			return err
+		}
+		_, err = c.ExecContext(ctx, attachStatement(path, alias))
+		return err
+	})
+	if err != nil {
+		a.detach(ctx, alias)
+	}
+	return err
+}
+
+// validateAttachment attaches the database at path to a connection and validates it, recording
+// it as attached if it is valid and detaching it otherwise.
+func (a *AppDB) validateAttachment(ctx context.Context, path, alias, appName string, schemaVersion uint8) error {
+	conn, err := a.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, attachStatement(path, alias)); err != nil {
+		return err
+	}
+	version, _, err := readSchemaVersion(ctx, conn, alias, appName, a.cfg.applicationID)
+	if err == nil && version != schemaVersion {
+		err = &SchemaVersionError{version, schemaVersion}
+	}
+	if err == nil && !a.cfg.extensions.attachments.add(alias, path) {
+		err = fmt.Errorf("a database is already attached as %s", alias)
+	}
+	if err != nil {
+		conn.ExecContext(ctx, "DETACH DATABASE "+quoteIdent(alias))
+	}
+	return err
+}
+
+// Detach detaches the database attached as alias from every connection, waiting for connections
+// in use elsewhere to be returned to the pool.
+// ctx -- context for the statements
+// alias -- name the database was attached as
+func (a *AppDB) Detach(ctx context.Context, alias string) error {
+	start := time.Now()
+	err := a.detach(ctx, alias)
+	a.logOp("detach", start, err, slog.String("alias", alias))
+	return err
+}
+
+func (a *AppDB) detach(ctx context.Context, alias string) error {
+	if !a.cfg.extensions.attachments.remove(alias) {
+		return fmt.Errorf("no database is attached as %s", alias)
+	}
+	return a.eachConn(ctx, func(c *sql.Conn) error {
+		attached, err := isAttached(ctx, c, alias)
+		if err != nil || !attached {
+			return err
+		}
+		_, err = c.ExecContext(ctx, "DETACH DATABASE "+quoteIdent(alias))
+		return err
+	})
+}
+
+// isAttached reports whether a database is attached to conn as alias.
+func isAttached(ctx context.Context, conn *sql.Conn, alias string) (bool, error) {
+	var n int
+	err := conn.QueryRowContext(ctx, "SELECT count(*) FROM pragma_database_list WHERE name = ?", alias).Scan(&n)
+	return n > 0, err
+}
+
+// eachConn calls fn with every connection of the pool, taking each from the pool in turn and
+// waiting for those in use elsewhere to be returned.
+func (a *AppDB) eachConn(ctx context.Context, fn func(c *sql.Conn) error) error {
+	var conns []*sql.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for {
+		stats := a.DB.Stats()
+		if stats.Idle == 0 {
+			// Holding every connection taken so far, the rest are in use elsewhere.
+			if stats.InUse <= len(conns) {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(idlePoll):
+			}
+			continue
+		}
+		c, err := a.DB.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// auditContextTable holds the actor of the transaction in progress, visible to the audit triggers.
+const auditContextTable = "appdb_audit_context"
+
+// AuditRecord is one change to a row recorded by the audit triggers.
+type AuditRecord struct {
+	ID    int64
+	Op    ChangeOp
+	RowID int64
+	// Actor is the actor given to AuditTx, or empty for changes made outside it.
+	Actor string
+	At    time.Time
+	// Old and New hold every column of the row before and after the change, with BLOB values as
+	// []byte. Old is nil for an insert and New for a delete.
+	Old map[string]any
+	New map[string]any
+}
+
+// historySuffix ends the name of the history table of an audited table.
+const historySuffix = "_history"
+
+// historyColumns are the columns of a history table.
+var historyColumns = []string{"history_id", "op", "row_id", "actor", "changed_at", "old", "new"}
+
+// isHistoryTable reports whether t is the history table of an audited table, which belongs to
+// appdb rather than the application's schema.
+func isHistoryTable(t *TableInfo) bool {
+	if !strings.HasSuffix(t.Name, historySuffix) || len(t.Columns) != len(historyColumns) {
+		return false
+	}
+	for i, c := range t.Columns {
+		if c.Name != historyColumns[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// EnableAudit records every change to tables in a history table named after each with a
+// "_history" suffix, created if needed, using triggers. Each record holds the row's old and new
+// values, the actor given to AuditTx and the time. Enabling audit again replaces the triggers,
+// which is needed after columns are added to a table. The tables must have a rowid, so can't be
+// WITHOUT ROWID. History tables aren't reported as extra tables by ValidateSchema, and the
+// stored schema checksum is updated to include them and the triggers.
+// ctx -- context for the statements
+// tables -- names of the tables to audit
+func (a *AppDB) EnableAudit(ctx context.Context, tables ...string) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+auditContextTable+" (id INTEGER PRIMARY KEY CHECK (id = 1), actor TEXT)")
+			if err != nil {
+				return err
+			}
+			for _, table := range tables {
+				if err := enableAudit(ctx, tx, table); err != nil {
+					return err
+				}
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("enable_audit", start, err, slog.String("tables", strings.Join(tables, ",")))
+	return err
+}
+
+func enableAudit(ctx context.Context, tx *sql.Tx, table string) error {
+	columns, err := tableColumns(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("no such table: %s", table)
+	}
+	history := quoteIdent(table + historySuffix)
+	_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+history+` (
+		history_id INTEGER PRIMARY KEY,
+		op TEXT NOT NULL,
+		row_id INTEGER NOT NULL,
+		actor TEXT,
+		changed_at TEXT NOT NULL,
+		old TEXT,
+		new TEXT)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (row_id)", quoteIdent(table+"_history_row_id"), history))
+	if err != nil {
+		return err
+	}
+	// JSON can't hold BLOBs, so they are stored as an object holding their hex.
+	row := func(side string) string {
+		pairs := make([]string, len(columns))
+		for i, c := range columns {
+			v := side + "." + quoteIdent(c)
+			pairs[i] = fmt.Sprintf("'%s', CASE WHEN typeof(%s) = 'blob' THEN json_object('hex', hex(%s)) ELSE %s END",
+				strings.ReplaceAll(c, "'", "''"), v, v, v)
+		}
+		return "json_object(" + strings.Join(pairs, ", ") + ")"
+	}
+	record := func(op ChangeOp, rowID, before, after string) []string {
+		return []string{fmt.Sprintf("INSERT INTO %s (op, row_id, actor, changed_at, old, new) VALUES "+
+			"('%s', %s, (SELECT actor FROM %s), strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', 'now'), %s, %s)",
+			history, op, rowID, auditContextTable, before, after)}
+	}
+	triggers := []Trigger{
+		{Name: table + "_audit_ai", Table: table, Timing: TriggerAfter, Event: TriggerInsert,
+			Body: record(ChangeInsert, "new.rowid", "NULL", row("new"))},
+		{Name: table + "_audit_au", Table: table, Timing: TriggerAfter, Event: TriggerUpdate,
+			Body: record(ChangeUpdate, "new.rowid", row("old"), row("new"))},
+		{Name: table + "_audit_ad", Table: table, Timing: TriggerAfter, Event: TriggerDelete,
+			Body: record(ChangeDelete, "old.rowid", row("old"), "NULL")},
+	}
+	for _, stmt := range replaceTriggers(triggers) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableAudit stops recording changes to tables, keeping their history tables.
+// ctx -- context for the statements
+// tables -- names of the tables to stop auditing
+func (a *AppDB) DisableAudit(ctx context.Context, tables ...string) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			for _, table := range tables {
+				for _, suffix := range []string{"_audit_ai", "_audit_au", "_audit_ad"} {
+					if _, err := tx.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+quoteIdent(table+suffix)); err != nil {
+						return err
+					}
+				}
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("disable_audit", start, err, slog.String("tables", strings.Join(tables, ",")))
+	return err
+}
+
+// AuditTx runs fn in a transaction, as WithTx does, recording actor as the actor of the changes
+// it makes to audited tables.
+// ctx -- context for the transaction
+// actor -- who is making the changes, such as a user name
+// fn -- function making the changes
+func (a *AppDB) AuditTx(ctx context.Context, actor string, fn func(tx *sql.Tx) error) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			// The row is only ever seen by this transaction, as it is removed before commit.
+			if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO "+auditContextTable+" (id, actor) VALUES (1, ?)", actor); err != nil {
+				return err
+			}
+			if err := fn(tx); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "DELETE FROM "+auditContextTable)
+			return err
+		})
+	})
+	a.logOp("audit_tx", start, err, slog.String("actor", actor))
+	return err
+}
+
+// History returns the recorded changes to the row of table with the given rowid, oldest first.
+// ctx -- context for the query
+// table -- name of the audited table
+// rowID -- rowid of the row
+func (a *AppDB) History(ctx context.Context, table string, rowID int64) ([]AuditRecord, error) {
+	start := time.Now()
+	records, err := history(ctx, a, table, rowID)
+	a.logOp("history", start, err, slog.String("table", table), slog.Int("records", len(records)))
+	return records, err
+}
+
+func history(ctx context.Context, q Querier, table string, rowID int64) ([]AuditRecord, error) {
+	rows, err := q.QueryContext(ctx, "SELECT history_id, op, row_id, actor, changed_at, old, new FROM "+
+		quoteIdent(table+historySuffix)+" WHERE row_id = ? ORDER BY history_id", rowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []AuditRecord
+	for rows.Next() {
+		var r AuditRecord
+		var actor, before, after sql.NullString
+		var at string
+		if err := rows.Scan(&r.ID, &r.Op, &r.RowID, &actor, &at, &before, &after); err != nil {
+			return nil, err
+		}
+		r.Actor = actor.String
+		if r.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+			return nil, err
+		}
+		if r.Old, err = auditRow(before); err != nil {
+			return nil, err
+		}
+		if r.New, err = auditRow(after); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// auditRow decodes the JSON values of a row recorded by the audit triggers.
+func auditRow(s sql.NullString) (map[string]any, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	var raw map[string]any
+	dec := json.NewDecoder(strings.NewReader(s.String))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(raw))
+	for col, v := range raw {
+		if m, ok := v.(map[string]any); ok {
+			if h, ok := m["hex"].(string); ok && len(m) == 1 {
+				b, err := hex.DecodeString(h)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", col, err)
+				}
+				row[col] = b
+				continue
+			}
+		}
+		value, err := jsonColumnValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col, err)
+		}
+		row[col] = value
+	}
+	return row, nil
+}
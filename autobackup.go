@@ -0,0 +1,93 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat names automatic backups so that they sort by age.
+const backupTimeFormat = "20060102T150405"
+
+// WithAutoBackup takes a snapshot of the database every interval while it is open, writing it to
+// dir, which is created if needed. Only the newest keep snapshots are retained; keep of zero or
+// less retains them all. Snapshots are named after the database file with a timestamp, such as
+// "app-20240102T150405.db". Failures are logged and retried at the next interval.
+// interval -- time between snapshots
+// dir -- directory to write snapshots to
+// keep -- number of snapshots to retain
+func WithAutoBackup(interval time.Duration, dir string, keep int) Option {
+	return func(c *config) {
+		c.autoBackupInterval = interval
+		c.autoBackupDir = dir
+		c.autoBackupSink = nil
+		c.autoBackupKeep = keep
+	}
+}
+
+// WithAutoBackupSink is WithAutoBackup storing the snapshots in sink rather than a directory.
+// interval -- time between snapshots
+// sink -- where to store snapshots
+// keep -- number of snapshots to retain
+func WithAutoBackupSink(interval time.Duration, sink BackupSink, keep int) Option {
+	return func(c *config) {
+		c.autoBackupInterval = interval
+		c.autoBackupSink = sink
+		c.autoBackupKeep = keep
+	}
+}
+
+// autoBackup takes a snapshot every interval until ctx is cancelled.
+func (a *AppDB) autoBackup(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.autoBackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := a.autoBackupOnce(ctx, now)
+			a.logOp("auto_backup", now, err)
+		}
+	}
+}
+
+// autoBackupOnce writes one snapshot and prunes the oldest beyond the number to keep.
+func (a *AppDB) autoBackupOnce(ctx context.Context, now time.Time) error {
+	sink := a.cfg.autoBackupSink
+	if sink == nil {
+		sink = &DirSink{a.cfg.autoBackupDir, a.cfg.dirMode, a.cfg.fileMode}
+	}
+	prefix, ext := a.backupName()
+	if err := a.BackupToSink(ctx, sink, prefix+now.Format(backupTimeFormat)+ext); err != nil {
+		return err
+	}
+	if a.cfg.autoBackupKeep <= 0 {
+		return nil
+	}
+	return sink.Prune(ctx, prefix, ext, a.cfg.autoBackupKeep)
+}
+
+// backupName returns the prefix and extension of automatic backup file names.
+func (a *AppDB) backupName() (prefix string, ext string) {
+	base := a.appName
+	ext = ".db"
+	if !isMemoryPath(a.dsn) {
+		base = filepath.Base(a.path)
+		if e := filepath.Ext(base); e != "" {
+			base, ext = strings.TrimSuffix(base, e), e
+		}
+	}
+	return base + "-", ext
+}
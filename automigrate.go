@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DestructiveChangeError lists the differences AutoMigrate found between the models and the
+// database that can't be made by adding tables, columns and indexes.
+type DestructiveChangeError struct {
+	Differences []SchemaDifference
+}
+
+func (e *DestructiveChangeError) Error() string {
+	return fmt.Sprintf("Models need %d changes that are not additive, first: %s", len(e.Differences), e.Differences[0])
+}
+
+// AutoMigration describes the changes AutoMigrate made.
+type AutoMigration struct {
+	// Statements are the statements run, which add tables, columns and indexes.
+	Statements []string
+	// Skipped are the differences left in place because they can't be made additively, such as a
+	// changed column type or a column in the database the models don't have.
+	Skipped []SchemaDifference
+}
+
+// AutoMigrate brings the database's tables into line with the models, as described by
+// SchemaFromStructs, making only additive changes: creating missing tables and indexes, and adding
+// missing columns where ALTER TABLE ADD COLUMN can. The changes are made in one transaction and
+// the schema version is not changed. Tables that aren't among the models are left alone.
+// Other differences, which would need data to be dropped or tables rebuilt, are never made. If
+// strict is set and there are any, AutoMigrate returns a DestructiveChangeError listing them and
+// changes nothing; otherwise they are left in place and returned in the Skipped list.
+// AutoMigrate suits small applications and development; versioned migrations give more control.
+// ctx -- context for the changes
+// strict -- refuse to change anything if the models can't be matched additively
+// models -- structs describing the tables
+func (a *AppDB) AutoMigrate(ctx context.Context, strict bool, models ...any) (*AutoMigration, error) {
+	start := time.Now()
+	m, err := a.autoMigrate(ctx, strict, models)
+	var attrs []any
+	if m != nil {
+		attrs = append(attrs, slog.Int("statements", len(m.Statements)), slog.Int("skipped", len(m.Skipped)))
+	}
+	a.logOp("auto_migrate", start, err, attrs...)
+	return m, err
+}
+
+func (a *AppDB) autoMigrate(ctx context.Context, strict bool, models []any) (*AutoMigration, error) {
+	statements, err := SchemaFromStructs(models...)
+	if err != nil {
+		return nil, err
+	}
+	want, err := schemaOf(ctx, a.cfg, statements)
+	if err != nil {
+		return nil, err
+	}
+	m := &AutoMigration{}
+	err = runTx(ctx, a.DB, func(tx *sql.Tx) error {
+		got, err := inspectSchema(ctx, tx)
+		if err != nil {
+			return err
+		}
+		m.Statements, m.Skipped = additiveChanges(want, got)
+		if strict && len(m.Skipped) > 0 {
+			return &DestructiveChangeError{m.Skipped}
+		}
+		if len(m.Statements) == 0 {
+			return nil
+		}
+		for _, stmt := range m.Statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return &SchemaError{stmt, err}
+			}
+		}
+		return updateSchemaChecksum(ctx, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// additiveChanges returns the statements adding the tables, columns and indexes of want missing
+// from got, and the differences in want's tables that can't be made that way.
+func additiveChanges(want *SchemaInfo, got *SchemaInfo) ([]string, []SchemaDifference) {
+	var statements []string
+	var skipped []SchemaDifference
+	for i := range want.Tables {
+		wt := &want.Tables[i]
+		gt := got.Table(wt.Name)
+		if gt == nil {
+			statements = append(statements, wt.SQL+";")
+			for _, stmt := range createIndexes(wt.Indexes) {
+				statements = append(statements, stmt+";")
+			}
+			continue
+		}
+		var columns map[string]string
+		if d, ok := parseTableDefinition(wt.SQL); ok {
+			columns, _ = d.columnItems()
+		}
+		added := make(map[string]bool)
+		for _, diff := range compareTables(wt, gt) {
+			switch diff.Kind {
+			case MissingColumn:
+				def := columns[strings.ToLower(diff.Name)]
+				if canAddColumn(*wt.Column(diff.Name), def) {
+					statements = append(statements, "ALTER TABLE "+quoteIdent(wt.Name)+" ADD COLUMN "+def+";")
+					added[strings.ToLower(diff.Name)] = true
+					continue
+				}
+			case ChangedForeignKey:
+				// Foreign keys declared on the columns just added come with them.
+				if foreignKeys(withoutAddedKeys(wt.ForeignKeys, added)) == foreignKeys(gt.ForeignKeys) {
+					continue
+				}
+			case MissingIndex:
+				if ix := indexNamed(wt.Indexes, diff.Name); ix != nil && ix.Origin == "c" {
+					statements = append(statements, ix.SQL+";")
+					continue
+				}
+			}
+			skipped = append(skipped, diff)
+		}
+	}
+	return statements, skipped
+}
+
+// withoutAddedKeys returns the foreign keys that aren't wholly on the added columns, whose names
+// are lower case.
+func withoutAddedKeys(keys []ForeignKeyInfo, added map[string]bool) []ForeignKeyInfo {
+	var kept []ForeignKeyInfo
+	for _, k := range keys {
+		if !slices.ContainsFunc(k.Columns, func(c string) bool { return !added[strings.ToLower(c)] }) {
+			continue
+		}
+		kept = append(kept, k)
+	}
+	return kept
+}
+
+// indexNamed returns the index with the given name, or nil if there is none.
+func indexNamed(indexes []IndexInfo, name string) *IndexInfo {
+	for i := range indexes {
+		if indexes[i].Name == name {
+			return &indexes[i]
+		}
+	}
+	return nil
+}
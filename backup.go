@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// backupPages is how many pages an online backup copies per step. Between steps other
+// connections can use the database.
+const backupPages = 256
+
+// waitStep pauses before retrying a backup step that found the database locked.
+func waitStep(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(10 * time.Millisecond):
+		return nil
+	}
+}
+
+// errBackupUnsupported is returned by backupConn when the driver has no online backup API.
+var errBackupUnsupported = errors.New("driver does not support online backup")
+
+// BackupTo writes a consistent copy of the database to destPath while it remains in use, using
+// SQLite's online backup API. The copy is written beside destPath and renamed into place when
+// complete, so an existing file at destPath is only replaced by a finished backup. Drivers
+// without the backup API fall back to VACUUM INTO.
+// ctx -- context for the backup, checked between steps
+// destPath -- the filesystem location of the backup file
+func (a *AppDB) BackupTo(ctx context.Context, destPath string) error {
+	start := time.Now()
+	err := a.backupTo(ctx, destPath)
+	a.logOp("backup", start, err, slog.String("dest", destPath))
+	return err
+}
+
+func (a *AppDB) backupTo(ctx context.Context, destPath string) error {
+	tmp := destPath + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := createDBFile(tmp, a.cfg); err != nil {
+		return err
+	}
+	conn, err := a.DB.Conn(ctx)
+	if err == nil {
+		err = conn.Raw(func(dc any) error {
+			return backupConn(ctx, dc, tmp, a.cfg)
+		})
+		if err == errBackupUnsupported {
+			err = vacuumInto(ctx, conn, tmp)
+		}
+		conn.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, destPath)
+}
+
+// Snapshot writes a compacted copy of the database to destPath with VACUUM INTO. Unlike
+// BackupTo the copy has no free pages and is rebuilt table by table, which suits "export my
+// data" features. As with BackupTo, an existing file at destPath is only replaced once the
+// snapshot is complete.
+// destPath -- the filesystem location of the snapshot file
+func (a *AppDB) Snapshot(destPath string) error {
+	return a.SnapshotContext(context.Background(), destPath)
+}
+
+// SnapshotContext is Snapshot with a context.
+func (a *AppDB) SnapshotContext(ctx context.Context, destPath string) error {
+	start := time.Now()
+	tmp := destPath + ".tmp"
+	err := os.Remove(tmp)
+	if err == nil || os.IsNotExist(err) {
+		err = createDBFile(tmp, a.cfg)
+	}
+	if err == nil {
+		err = vacuumInto(ctx, a.DB, tmp)
+		if err == nil {
+			err = os.Rename(tmp, destPath)
+		} else {
+			os.Remove(tmp)
+		}
+	}
+	a.logOp("snapshot", start, err, slog.String("dest", destPath))
+	return err
+}
+
+// vacuumInto writes a compacted copy of the main database to path, which must not exist or be
+// empty.
+func vacuumInto(ctx context.Context, q querier, path string) error {
+	_, err := q.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
@@ -0,0 +1,91 @@
+//go:build cgo && !appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupConn copies the database open on driver connection dc to the file at destPath with the
+// go-sqlite3 backup API.
+func backupConn(ctx context.Context, dc any, destPath string, cfg *config) error {
+	src, ok := sqliteConn(dc)
+	if !ok {
+		return errBackupUnsupported
+	}
+	dest, err := openSQLiteConn(ctx, destPath, cfg)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return copyDatabase(ctx, dest, src)
+}
+
+// restoreConn replaces the database open on driver connection dc with the one in the file at
+// srcPath with the go-sqlite3 backup API.
+func restoreConn(ctx context.Context, dc any, srcPath string, cfg *config) error {
+	dest, ok := sqliteConn(dc)
+	if !ok {
+		return errBackupUnsupported
+	}
+	src, err := openSQLiteConn(ctx, srcPath, cfg)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyDatabase(ctx, dest, src)
+}
+
+// openSQLiteConn opens a single go-sqlite3 connection to path, keyed if the database is encrypted.
+func openSQLiteConn(ctx context.Context, path string, cfg *config) (*sqlite3.SQLiteConn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.encryptionKey != nil {
+		if err := execConn(ctx, conn, keyStatement(cfg.encryptionKey)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn.(*sqlite3.SQLiteConn), nil
+}
+
+// copyDatabase copies the main database of src over that of dest a step at a time.
+func copyDatabase(ctx context.Context, dest *sqlite3.SQLiteConn, src *sqlite3.SQLiteConn) error {
+	b, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	for {
+		// Step returns without progress, and without an error, when a database is busy or
+		// locked, so the remaining page count tells whether to pause before trying again.
+		remaining := b.Remaining()
+		done, err := b.Step(backupPages)
+		if err == nil && !done && b.Remaining() == remaining {
+			err = waitStep(ctx)
+		}
+		if err != nil || done {
+			if ferr := b.Finish(); err == nil {
+				err = ferr
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			b.Finish()
+			return err
+		}
+	}
+}
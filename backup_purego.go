@@ -0,0 +1,72 @@
+//go:build !cgo || appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+
+	"modernc.org/sqlite"
+)
+
+// backupConn copies the database open on driver connection dc to the file at destPath with the
+// modernc.org/sqlite backup API.
+func backupConn(ctx context.Context, dc any, destPath string, cfg *config) error {
+	src, ok := dc.(interface {
+		NewBackup(dstUri string) (*sqlite.Backup, error)
+	})
+	if !ok {
+		return errBackupUnsupported
+	}
+	b, err := src.NewBackup(destPath)
+	if err != nil {
+		return err
+	}
+	return stepBackup(ctx, b)
+}
+
+// restoreConn replaces the database open on driver connection dc with the one in the file at
+// srcPath with the modernc.org/sqlite backup API.
+func restoreConn(ctx context.Context, dc any, srcPath string, cfg *config) error {
+	dest, ok := dc.(interface {
+		NewRestore(srcUri string) (*sqlite.Backup, error)
+	})
+	if !ok {
+		return errBackupUnsupported
+	}
+	b, err := dest.NewRestore(srcPath)
+	if err != nil {
+		return err
+	}
+	return stepBackup(ctx, b)
+}
+
+// stepBackup runs a backup or restore a step at a time until it completes.
+func stepBackup(ctx context.Context, b *sqlite.Backup) error {
+	for {
+		more, err := b.Step(backupPages)
+		if isBusy(err) {
+			err = waitStep(ctx)
+			more = err == nil
+		}
+		if err != nil || !more {
+			if ferr := b.Finish(); err == nil {
+				err = ferr
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			b.Finish()
+			return err
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// Blob reads and writes a BLOB value a piece at a time, so that large values can be streamed
+// without holding them whole in memory. Neither driver exposes SQLite's incremental BLOB handles,
+// so each read or write is a statement on a slice of the value: SQLite still reads the whole value
+// for each, and it is best to read and write in large pieces, with bufio if needed. As with
+// SQLite's own handles, writes cannot change the size of the value; reserve space for it first
+// with ReserveBlob.
+type Blob struct {
+	db       *AppDB
+	ctx      context.Context
+	table    string
+	column   string
+	rowID    int64
+	size     int64
+	offset   int64
+	writable bool
+	closed   bool
+}
+
+// OpenBlob opens the BLOB in column of the row of table with the given rowid for reading, and for
+// writing if writable. ctx applies to every read and write through the Blob.
+// ctx -- context for the statements
+// table -- name of the table
+// column -- name of the BLOB column
+// rowID -- rowid of the row
+// writable -- whether the Blob can be written
+func (a *AppDB) OpenBlob(ctx context.Context, table, column string, rowID int64, writable bool) (*Blob, error) {
+	start := time.Now()
+	b, err := a.openBlob(ctx, table, column, rowID, writable)
+	a.logOp("open_blob", start, err, slog.String("table", table), slog.String("column", column), slog.Int64("rowid", rowID))
+	return b, err
+}
+
+func (a *AppDB) openBlob(ctx context.Context, table, column string, rowID int64, writable bool) (*Blob, error) {
+	var kind string
+	var size int64
+	err := a.QueryRowContext(ctx, fmt.Sprintf("SELECT typeof(%[1]s), coalesce(length(%[1]s), 0) FROM %[2]s WHERE rowid = ?",
+		quoteIdent(column), quoteIdent(table)), rowID).Scan(&kind, &size)
+	if err == sql.ErrNoRows {
+		return nil, noBlobRow(table, rowID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kind != "blob" {
+		return nil, fmt.Errorf("column %s of row %d of %s is %s, not a BLOB", column, rowID, table, kind)
+	}
+	return &Blob{db: a, ctx: ctx, table: table, column: column, rowID: rowID, size: size, writable: writable}, nil
+}
+
+// ReserveBlob sets column of the row of table with the given rowid to size zero bytes, ready to be
+// written through OpenBlob. The bytes are made by SQLite's zeroblob, so no buffer of size bytes is
+// needed in memory, but they are written out in full to the database file.
+// ctx -- context for the statement
+// table -- name of the table
+// column -- name of the BLOB column
+// rowID -- rowid of the row
+// size -- size of the BLOB in bytes
+func (a *AppDB) ReserveBlob(ctx context.Context, table, column string, rowID int64, size int64) error {
+	start := time.Now()
+	err := a.reserveBlob(ctx, table, column, rowID, size)
+	a.logOp("reserve_blob", start, err, slog.String("table", table), slog.String("column", column), slog.Int64("rowid", rowID),
+		slog.Int64("size", size))
+	return err
+}
+
+func (a *AppDB) reserveBlob(ctx context.Context, table, column string, rowID int64, size int64) error {
+	res, err := a.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = zeroblob(?) WHERE rowid = ?", quoteIdent(table), quoteIdent(column)),
+		size, rowID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = noBlobRow(table, rowID)
+	}
+	return err
+}
+
+// noBlobRow returns the error for a BLOB's row that doesn't exist.
+func noBlobRow(table string, rowID int64) error {
+	return fmt.Errorf("row %d of %s: %w", rowID, table, sql.ErrNoRows)
+}
+
+// Size returns the size of the BLOB in bytes.
+func (b *Blob) Size() int64 {
+	return b.size
+}
+
+// Read reads from the BLOB at the current offset, returning io.EOF at its end.
+func (b *Blob) Read(p []byte) (int, error) {
+	n, err := b.ReadAt(p, b.offset)
+	b.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the BLOB starting at off, returning io.EOF if it ends first.
+func (b *Blob) ReadAt(p []byte, off int64) (int, error) {
+	if b.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative BLOB offset")
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), b.size-off)
+	var piece []byte
+	err := b.db.QueryRowContext(b.ctx, fmt.Sprintf("SELECT substr(%s, ?, ?) FROM %s WHERE rowid = ?", quoteIdent(b.column), quoteIdent(b.table)),
+		off+1, n, b.rowID).Scan(&piece)
+	if err == sql.ErrNoRows {
+		err = noBlobRow(b.table, b.rowID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	copied := copy(p, piece)
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+// Write writes to the BLOB at the current offset.
+func (b *Blob) Write(p []byte) (int, error) {
+	n, err := b.WriteAt(p, b.offset)
+	b.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes p to the BLOB starting at off, which must leave it within the size of the BLOB.
+func (b *Blob) WriteAt(p []byte, off int64) (int, error) {
+	if b.closed {
+		return 0, fs.ErrClosed
+	}
+	if !b.writable {
+		return 0, fmt.Errorf("BLOB in column %s of row %d of %s is open read-only", b.column, b.rowID, b.table)
+	}
+	if off < 0 {
+		return 0, errors.New("negative BLOB offset")
+	}
+	if off+int64(len(p)) > b.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is past the end of BLOB of %d bytes", len(p), off, b.size)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Concatenation gives text, so the result is cast back to a BLOB.
+	col := quoteIdent(b.column)
+	res, err := b.db.ExecContext(b.ctx, fmt.Sprintf("UPDATE %s SET %s = CAST(substr(%s, 1, ?) || ? || substr(%s, ?) AS BLOB) WHERE rowid = ?",
+		quoteIdent(b.table), col, col, col), off, p, off+int64(len(p))+1, b.rowID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, noBlobRow(b.table, b.rowID)
+	}
+	return len(p), nil
+}
+
+// Seek sets the offset of the next Read or Write.
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative BLOB offset")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+// Close closes the Blob, after which it can't be read or written.
+func (b *Blob) Close() error {
+	if b.closed {
+		return fs.ErrClosed
+	}
+	b.closed = true
+	return nil
+}
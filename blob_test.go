@@ -0,0 +1,60 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE files (id INTEGER PRIMARY KEY, data BLOB);", "INSERT INTO files VALUES (1, x'');"})
+	if err := db.ReserveBlob(ctx, "files", "data", 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.OpenBlob(ctx, "files", "data", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("world"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("!")); err == nil {
+		t.Error("write past the end of the blob succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.OpenBlob(ctx, "files", "data", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("helloworld")) || r.Size() != 10 {
+		t.Errorf("blob = %q, size %d", got, r.Size())
+	}
+	if err := db.ReserveBlob(ctx, "files", "data", 2, 10); err == nil {
+		t.Error("ReserveBlob of a missing row succeeded")
+	}
+}
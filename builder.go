@@ -0,0 +1,365 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Execer runs statements. *AppDB, *sql.DB, *sql.Tx and *sql.Conn all satisfy it.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// where collects the conditions of a WHERE clause, which are ANDed together.
+type where struct {
+	conds []string
+	args  []any
+}
+
+func (w *where) add(cond string, args []any) {
+	w.conds = append(w.conds, "("+cond+")")
+	w.args = append(w.args, args...)
+}
+
+func (w *where) build(b *strings.Builder) []any {
+	if len(w.conds) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(w.conds, " AND "))
+	}
+	return w.args
+}
+
+// placeholders returns n comma-separated placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// quoteIdents quotes each of names.
+func quoteIdents(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return quoted
+}
+
+// InsertBuilder builds an INSERT statement. Create one with Insert.
+type InsertBuilder struct {
+	table    string
+	verb     string
+	columns  []string
+	rows     [][]any
+	conflict []string
+	update   []string
+	returned []string
+}
+
+// Insert starts an INSERT statement into table.
+// table -- name of the table to insert into
+func Insert(table string) *InsertBuilder {
+	return &InsertBuilder{table: table, verb: "INSERT"}
+}
+
+// OrReplace makes the statement INSERT OR REPLACE.
+func (b *InsertBuilder) OrReplace() *InsertBuilder {
+	b.verb = "INSERT OR REPLACE"
+	return b
+}
+
+// OrIgnore makes the statement INSERT OR IGNORE.
+func (b *InsertBuilder) OrIgnore() *InsertBuilder {
+	b.verb = "INSERT OR IGNORE"
+	return b
+}
+
+// Columns sets the columns to insert into.
+func (b *InsertBuilder) Columns(columns ...string) *InsertBuilder {
+	b.columns = columns
+	return b
+}
+
+// Values adds a row of values, one for each column. Call it again to insert several rows.
+func (b *InsertBuilder) Values(values ...any) *InsertBuilder {
+	b.rows = append(b.rows, values)
+	return b
+}
+
+// OnConflictUpdate adds an upsert clause: when a row conflicts with an existing one on the
+// conflict columns, which must have a unique index, the update columns of the existing row are
+// set to the new values instead. With no update columns the new row is ignored.
+func (b *InsertBuilder) OnConflictUpdate(conflict []string, update []string) *InsertBuilder {
+	b.conflict = conflict
+	b.update = update
+	return b
+}
+
+// Returning adds a RETURNING clause with the given expressions.
+func (b *InsertBuilder) Returning(exprs ...string) *InsertBuilder {
+	b.returned = exprs
+	return b
+}
+
+// Build returns the statement and its arguments.
+func (b *InsertBuilder) Build() (string, []any, error) {
+	if len(b.columns) == 0 || len(b.rows) == 0 {
+		return "", nil, fmt.Errorf("insert into %s needs columns and values", b.table)
+	}
+	var s strings.Builder
+	fmt.Fprintf(&s, "%s INTO %s (%s) VALUES ", b.verb, quoteIdent(b.table), strings.Join(quoteIdents(b.columns), ", "))
+	var args []any
+	for i, row := range b.rows {
+		if len(row) != len(b.columns) {
+			return "", nil, fmt.Errorf("insert into %s row %d has %d values for %d columns", b.table, i+1, len(row), len(b.columns))
+		}
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString("(" + placeholders(len(row)) + ")")
+		args = append(args, row...)
+	}
+	if len(b.conflict) > 0 {
+		fmt.Fprintf(&s, " ON CONFLICT (%s) DO ", strings.Join(quoteIdents(b.conflict), ", "))
+		if len(b.update) == 0 {
+			s.WriteString("NOTHING")
+		} else {
+			sets := make([]string, len(b.update))
+			for i, c := range b.update {
+				sets[i] = quoteIdent(c) + " = excluded." + quoteIdent(c)
+			}
+			s.WriteString("UPDATE SET " + strings.Join(sets, ", "))
+		}
+	}
+	if len(b.returned) > 0 {
+		s.WriteString(" RETURNING " + strings.Join(b.returned, ", "))
+	}
+	return s.String(), args, nil
+}
+
+// Exec builds and executes the statement.
+func (b *InsertBuilder) Exec(ctx context.Context, db Execer) (sql.Result, error) {
+	return execBuilt(ctx, db, b.Build)
+}
+
+// UpdateBuilder builds an UPDATE statement. Create one with Update.
+type UpdateBuilder struct {
+	table   string
+	columns []string
+	values  []any
+	where   where
+}
+
+// Update starts an UPDATE statement of table.
+// table -- name of the table to update
+func Update(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+// Set sets column to value.
+func (b *UpdateBuilder) Set(column string, value any) *UpdateBuilder {
+	b.columns = append(b.columns, column)
+	b.values = append(b.values, value)
+	return b
+}
+
+// Where adds a condition, such as "id = ?", with arguments for its placeholders. Conditions from
+// several calls must all hold.
+func (b *UpdateBuilder) Where(cond string, args ...any) *UpdateBuilder {
+	b.where.add(cond, args)
+	return b
+}
+
+// Build returns the statement and its arguments.
+func (b *UpdateBuilder) Build() (string, []any, error) {
+	if len(b.columns) == 0 {
+		return "", nil, fmt.Errorf("update of %s sets no columns", b.table)
+	}
+	var s strings.Builder
+	sets := make([]string, len(b.columns))
+	for i, c := range b.columns {
+		sets[i] = quoteIdent(c) + " = ?"
+	}
+	fmt.Fprintf(&s, "UPDATE %s SET %s", quoteIdent(b.table), strings.Join(sets, ", "))
+	args := append(append([]any(nil), b.values...), b.where.build(&s)...)
+	return s.String(), args, nil
+}
+
+// Exec builds and executes the statement.
+func (b *UpdateBuilder) Exec(ctx context.Context, db Execer) (sql.Result, error) {
+	return execBuilt(ctx, db, b.Build)
+}
+
+// DeleteBuilder builds a DELETE statement. Create one with Delete.
+type DeleteBuilder struct {
+	table string
+	where where
+}
+
+// Delete starts a DELETE statement from table. Without a Where condition every row is deleted.
+// table -- name of the table to delete from
+func Delete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+// Where adds a condition, such as "id = ?", with arguments for its placeholders. Conditions from
+// several calls must all hold.
+func (b *DeleteBuilder) Where(cond string, args ...any) *DeleteBuilder {
+	b.where.add(cond, args)
+	return b
+}
+
+// Build returns the statement and its arguments.
+func (b *DeleteBuilder) Build() (string, []any, error) {
+	var s strings.Builder
+	s.WriteString("DELETE FROM " + quoteIdent(b.table))
+	args := b.where.build(&s)
+	return s.String(), args, nil
+}
+
+// Exec builds and executes the statement.
+func (b *DeleteBuilder) Exec(ctx context.Context, db Execer) (sql.Result, error) {
+	return execBuilt(ctx, db, b.Build)
+}
+
+// SelectBuilder builds a SELECT query. Create one with Select.
+type SelectBuilder struct {
+	exprs       []string
+	table       string
+	where       where
+	orderBy     []string
+	limit       int
+	offset      int
+	withDeleted bool
+}
+
+// Select starts a SELECT query of the given result expressions, such as column names or
+// "count(*)". With no expressions it selects *. Expressions are used as given, not quoted.
+func Select(exprs ...string) *SelectBuilder {
+	return &SelectBuilder{exprs: exprs, limit: -1}
+}
+
+// From sets the table to select from.
+func (b *SelectBuilder) From(table string) *SelectBuilder {
+	b.table = table
+	return b
+}
+
+// Where adds a condition, such as "id = ?", with arguments for its placeholders. Conditions from
+// several calls must all hold.
+func (b *SelectBuilder) Where(cond string, args ...any) *SelectBuilder {
+	b.where.add(cond, args)
+	return b
+}
+
+// OrderBy adds ordering terms, such as "name" or "created DESC".
+func (b *SelectBuilder) OrderBy(terms ...string) *SelectBuilder {
+	b.orderBy = append(b.orderBy, terms...)
+	return b
+}
+
+// Limit limits the number of rows returned.
+func (b *SelectBuilder) Limit(n int) *SelectBuilder {
+	b.limit = n
+	return b
+}
+
+// Offset skips the first n rows.
+func (b *SelectBuilder) Offset(n int) *SelectBuilder {
+	b.offset = n
+	return b
+}
+
+// WithDeleted includes rows marked deleted in a table with soft delete, which Query and
+// QuerySelect otherwise leave out.
+func (b *SelectBuilder) WithDeleted() *SelectBuilder {
+	b.withDeleted = true
+	return b
+}
+
+// Build returns the query and its arguments. The query includes rows marked deleted, as Build
+// can't tell whether the table has soft delete.
+func (b *SelectBuilder) Build() (string, []any, error) {
+	if b.table == "" {
+		return "", nil, fmt.Errorf("select has no table")
+	}
+	exprs := "*"
+	if len(b.exprs) > 0 {
+		exprs = strings.Join(b.exprs, ", ")
+	}
+	var s strings.Builder
+	fmt.Fprintf(&s, "SELECT %s FROM %s", exprs, quoteIdent(b.table))
+	args := b.where.build(&s)
+	if len(b.orderBy) > 0 {
+		s.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+	}
+	if b.limit >= 0 || b.offset > 0 {
+		fmt.Fprintf(&s, " LIMIT %d", b.limit)
+	}
+	if b.offset > 0 {
+		fmt.Fprintf(&s, " OFFSET %d", b.offset)
+	}
+	return s.String(), args, nil
+}
+
+// Query builds and runs the query, leaving out rows marked deleted if the table has soft delete
+// (see EnableSoftDelete) unless WithDeleted was called.
+func (b *SelectBuilder) Query(ctx context.Context, db Querier) (*sql.Rows, error) {
+	query, args, err := b.buildFor(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return db.QueryContext(ctx, query, args...)
+}
+
+// QuerySelect runs the query built by b and returns its rows as values of type T, matched to the
+// columns as for Select. Like SelectBuilder.Query it leaves out rows marked deleted.
+// ctx -- context for the query
+// db -- database or transaction to query
+// b -- query to run
+func QuerySelect[T any](ctx context.Context, db Querier, b *SelectBuilder) ([]T, error) {
+	query, args, err := b.buildFor(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return Query[T](ctx, db, query, args...)
+}
+
+// buildFor builds the query to run on db, adding the condition leaving out rows marked deleted
+// if the table has soft delete.
+func (b *SelectBuilder) buildFor(ctx context.Context, db Querier) (string, []any, error) {
+	if b.withDeleted || b.table == "" {
+		return b.Build()
+	}
+	soft, err := hasSoftDelete(ctx, db, b.table)
+	if err != nil {
+		return "", nil, err
+	}
+	if !soft {
+		return b.Build()
+	}
+	live := *b
+	live.where = where{conds: slices.Clip(b.where.conds), args: b.where.args}
+	live.where.add(SoftDeleteColumn+" IS NULL", nil)
+	return live.Build()
+}
+
+// execBuilt builds a statement and executes it.
+func execBuilt(ctx context.Context, db Execer, build func() (string, []any, error)) (sql.Result, error) {
+	query, args, err := build()
+	if err != nil {
+		return nil, err
+	}
+	return db.ExecContext(ctx, query, args...)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// DefaultChunkSize is the number of rows committed per transaction by a chunked bulk load
+// unless ChunkOptions says otherwise.
+const DefaultChunkSize = 1000
+
+// ChunkOptions configures a chunked bulk load. The zero value commits every DefaultChunkSize rows.
+type ChunkOptions struct {
+	// ChunkSize is the number of rows inserted per transaction.
+	ChunkSize int
+	// Progress, if set, is called after each chunk is committed with the number of rows loaded
+	// so far and the total.
+	Progress func(done int, total int)
+}
+
+// ExecBulkSqlChunked prepares one SQL statement and executes it for each row of arguments,
+// committing a transaction every opts.ChunkSize rows. This is far faster than ExecBulkSqlArgs,
+// where each row is its own transaction. It returns the number of rows committed, which on error
+// is the number loaded by the chunks before the one that failed.
+// ctx -- context for the load, checked between rows
+// db -- database to load into
+// sql -- statement to execute for each row
+// rows -- arguments for each execution
+// opts -- chunk size and progress callback, may be nil
+func ExecBulkSqlChunked(ctx context.Context, db *sql.DB, sql string, rows [][]any, opts *ChunkOptions) (int, error) {
+	return execChunked(ctx, db, sql, rows, opts, RetryPolicy{})
+}
+
+// BulkLoad is ExecBulkSqlChunked on the database. With WithRetry, a chunk that fails because the
+// database is locked is retried as a whole.
+func (a *AppDB) BulkLoad(ctx context.Context, sql string, rows [][]any, opts *ChunkOptions) (int, error) {
+	ctx, end := a.trace(ctx, "bulkload", sql)
+	start := time.Now()
+	n, err := execChunked(ctx, a.DB, sql, rows, opts, a.cfg.retry)
+	a.logOp("bulkload", start, err, slog.Int("rows", n))
+	end(err)
+	return n, err
+}
+
+func execChunked(ctx context.Context, db *sql.DB, query string, rows [][]any, opts *ChunkOptions, policy RetryPolicy) (int, error) {
+	if opts == nil {
+		opts = &ChunkOptions{}
+	}
+	size := opts.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	done := 0
+	for done < len(rows) {
+		chunk := rows[done:min(done+size, len(rows))]
+		err := policy.do(ctx, func() error {
+			return runTx(ctx, db, func(tx *sql.Tx) error {
+				stmt, err := tx.PrepareContext(ctx, query)
+				if err != nil {
+					return err
+				}
+				defer stmt.Close()
+				for _, row := range chunk {
+					if _, err := stmt.ExecContext(ctx, row...); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return done, err
+		}
+		done += len(chunk)
+		if opts.Progress != nil {
+			opts.Progress(done, len(rows))
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,261 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"slices"
+	"sync"
+)
+
+// DefaultBusLimit is the number of changed rows of a table a ChangeBus subscriber holds by default.
+const DefaultBusLimit = 1024
+
+// ChangeBus passes committed row changes to any number of subscribers, each watching its own
+// tables. Unlike Subscribe it never loses track of a change: while a subscriber is busy the
+// changes to each row are coalesced into one, and once it holds more than its limit of rows for a
+// table it notes only that the table changed. The events come from the update hook, so the
+// limitations of Subscribe apply.
+type ChangeBus struct {
+	hooks *connHooks
+	limit int
+
+	mu          sync.Mutex
+	subscribers map[*BusSubscriber]bool
+	closed      bool
+}
+
+// ChangeBatch is the changes to a subscriber's tables since it last received.
+type ChangeBatch struct {
+	// Events has one event for each changed row, in the order the rows first changed. An insert
+	// followed by an update is an insert, an update followed by a delete a delete, and a delete
+	// followed by an insert an update; a row inserted and deleted again is left out.
+	Events []ChangeEvent
+	// Overflow lists the tables with more changed rows than the subscriber's limit. Their events
+	// are left out, so the subscriber must reread them.
+	Overflow []string
+}
+
+// BusSubscriber receives batches of changes from a ChangeBus on C.
+type BusSubscriber struct {
+	// C receives a batch whenever there are changes the subscriber hasn't received. It is closed
+	// when the subscriber or bus is closed.
+	C <-chan ChangeBatch
+
+	bus    *ChangeBus
+	tables map[string]bool // nil for all tables
+	out    chan ChangeBatch
+	notify chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	pending  map[changeKey]ChangeOp
+	order    []changeKey
+	counts   map[string]int
+	overflow []string
+}
+
+// changeKey identifies a row.
+type changeKey struct {
+	database string
+	table    string
+	rowID    int64
+}
+
+// NewChangeBus returns a bus passing on the changes committed to the database until it, or the
+// database, is closed.
+// limit -- most changed rows of a table a subscriber holds, or zero for DefaultBusLimit
+func (a *AppDB) NewChangeBus(limit int) *ChangeBus {
+	if limit <= 0 {
+		limit = DefaultBusLimit
+	}
+	h := a.cfg.extensions.hooks
+	b := &ChangeBus{hooks: h, limit: limit, subscribers: map[*BusSubscriber]bool{}}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		b.closed = true
+		return b
+	}
+	h.buses[b] = true
+	h.updateActive()
+	return b
+}
+
+// Subscribe returns a subscriber receiving the changes to tables, or to every table if none are
+// given.
+// tables -- names of the tables to watch
+func (b *ChangeBus) Subscribe(tables ...string) *BusSubscriber {
+	out := make(chan ChangeBatch)
+	s := &BusSubscriber{
+		C:       out,
+		bus:     b,
+		out:     out,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		pending: map[changeKey]ChangeOp{},
+		counts:  map[string]int{},
+	}
+	if len(tables) > 0 {
+		s.tables = map[string]bool{}
+		for _, t := range tables {
+			s.tables[t] = true
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(out)
+		return s
+	}
+	b.subscribers[s] = true
+	go s.run()
+	return s
+}
+
+// Close stops the bus and closes its subscribers.
+func (b *ChangeBus) Close() {
+	b.hooks.mu.Lock()
+	delete(b.hooks.buses, b)
+	b.hooks.updateActive()
+	b.hooks.mu.Unlock()
+	b.closeSubscribers()
+}
+
+// closeSubscribers closes every subscriber and stops new ones being added.
+func (b *ChangeBus) closeSubscribers() {
+	b.mu.Lock()
+	subscribers := b.subscribers
+	b.subscribers = nil
+	b.closed = true
+	b.mu.Unlock()
+	for s := range subscribers {
+		s.stop()
+	}
+}
+
+// publish adds the changes committed by a transaction to the subscribers watching their tables.
+func (b *ChangeBus) publish(events []ChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		s.add(events, b.limit)
+	}
+}
+
+// Close stops the subscriber and closes C.
+func (s *BusSubscriber) Close() {
+	s.bus.mu.Lock()
+	delete(s.bus.subscribers, s)
+	s.bus.mu.Unlock()
+	s.stop()
+}
+
+func (s *BusSubscriber) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// add coalesces events into the changes waiting to be received.
+func (s *BusSubscriber) add(events []ChangeEvent, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := false
+	for _, e := range events {
+		if s.tables != nil && !s.tables[e.Table] {
+			continue
+		}
+		added = true
+		count, seen := s.counts[e.Table]
+		if seen && count < 0 {
+			continue // overflowed
+		}
+		key := changeKey{e.Database, e.Table, e.RowID}
+		prev, ok := s.pending[key]
+		if !ok {
+			if count >= limit {
+				s.overflowTable(e.Table)
+				continue
+			}
+			s.pending[key] = e.Op
+			s.order = append(s.order, key)
+			s.counts[e.Table] = count + 1
+			continue
+		}
+		switch {
+		case prev == ChangeInsert && e.Op == ChangeDelete:
+			// The row is left out, so it no longer counts towards the limit.
+			delete(s.pending, key)
+			s.order = slices.DeleteFunc(s.order, func(k changeKey) bool { return k == key })
+			s.counts[e.Table] = count - 1
+		case prev == ChangeInsert:
+		case prev == ChangeDelete && e.Op == ChangeInsert:
+			s.pending[key] = ChangeUpdate
+		default:
+			s.pending[key] = e.Op
+		}
+	}
+	if added {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// overflowTable drops the pending changes to table, noting only that it changed.
+func (s *BusSubscriber) overflowTable(table string) {
+	s.overflow = append(s.overflow, table)
+	s.counts[table] = -1
+	for k := range s.pending {
+		if k.table == table {
+			delete(s.pending, k)
+		}
+	}
+}
+
+// take returns the changes waiting to be received and clears them.
+func (s *BusSubscriber) take() ChangeBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var batch ChangeBatch
+	for _, k := range s.order {
+		if op, ok := s.pending[k]; ok {
+			batch.Events = append(batch.Events, ChangeEvent{op, k.database, k.table, k.rowID})
+		}
+	}
+	batch.Overflow = s.overflow
+	s.pending = map[changeKey]ChangeOp{}
+	s.order = nil
+	s.counts = map[string]int{}
+	s.overflow = nil
+	return batch
+}
+
+// run sends the waiting changes on C whenever there are any, until the subscriber is stopped.
+func (s *BusSubscriber) run() {
+	defer close(s.out)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		}
+		batch := s.take()
+		if len(batch.Events) == 0 && len(batch.Overflow) == 0 {
+			continue
+		}
+		select {
+		case s.out <- batch:
+		case <-s.done:
+			return
+		}
+	}
+}
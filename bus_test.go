@@ -0,0 +1,50 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import "testing"
+
+func TestBusSubscriberCoalesce(t *testing.T) {
+	s := &BusSubscriber{
+		notify:  make(chan struct{}, 1),
+		pending: map[changeKey]ChangeOp{},
+		counts:  map[string]int{},
+	}
+	// Rows inserted and deleted again don't count towards the limit.
+	for i := 0; i < 3; i++ {
+		s.add([]ChangeEvent{{ChangeInsert, "main", "items", 1}, {ChangeDelete, "main", "items", 1}}, 2)
+	}
+	s.add([]ChangeEvent{
+		{ChangeInsert, "main", "items", 2},
+		{ChangeUpdate, "main", "items", 2},
+		{ChangeDelete, "main", "items", 3},
+		{ChangeInsert, "main", "items", 3},
+	}, 2)
+	batch := s.take()
+	if len(batch.Overflow) != 0 {
+		t.Fatalf("overflow = %v, want none", batch.Overflow)
+	}
+	want := []ChangeEvent{{ChangeInsert, "main", "items", 2}, {ChangeUpdate, "main", "items", 3}}
+	if len(batch.Events) != len(want) {
+		t.Fatalf("events = %v, want %v", batch.Events, want)
+	}
+	for i := range want {
+		if batch.Events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", batch.Events, want)
+		}
+	}
+
+	s.add([]ChangeEvent{{ChangeInsert, "main", "items", 1}, {ChangeInsert, "main", "items", 2}, {ChangeInsert, "main", "items", 3}}, 2)
+	batch = s.take()
+	if len(batch.Events) != 0 || len(batch.Overflow) != 1 || batch.Overflow[0] != "items" {
+		t.Errorf("batch over the limit = %+v, want only items overflowed", batch)
+	}
+}
@@ -0,0 +1,406 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeOp is the kind of change made to a row.
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "INSERT"
+	ChangeUpdate ChangeOp = "UPDATE"
+	ChangeDelete ChangeOp = "DELETE"
+)
+
+// Change is a change made to one row.
+type Change struct {
+	Table string
+	Op    ChangeOp
+	// Old holds every column of the row before an update or delete.
+	Old map[string]any
+	// New holds every column of the row after an insert or update.
+	New map[string]any
+}
+
+// Changeset is the changes made to a database by a unit of work, in the order they were made,
+// in the spirit of SQLite's session extension. Applying it to another database with the same
+// tables makes the same changes there; its inverse undoes them. It marshals to JSON keeping the
+// storage class of each value, as ExportJSON does, so it can be stored or sent elsewhere.
+type Changeset struct {
+	Changes []Change `json:"changes"`
+}
+
+type ChangeConflictError struct {
+	Change Change
+	Err    error
+}
+
+func (e *ChangeConflictError) Error() string {
+	return fmt.Sprintf("Error applying %s on table %s: %s", e.Change.Op, e.Change.Table, e.Err)
+}
+
+func (e *ChangeConflictError) Unwrap() error {
+	return e.Err
+}
+
+// errRowChanged is the conflict when the row to update or delete is missing or differs.
+var errRowChanged = errors.New("row is missing or has changed")
+
+// RecordChanges runs fn in a transaction, as WithTx does, and returns the changes it made to
+// tables. SQLite's session extension isn't built into either driver, so the changes are recorded
+// by temporary triggers, which only see changes made through tx. Tables should have a primary key
+// so that changes identify a single row when applied.
+// ctx -- context for the transaction
+// tables -- names of the tables to record changes to
+// fn -- function making the changes
+func (a *AppDB) RecordChanges(ctx context.Context, tables []string, fn func(tx *sql.Tx) error) (*Changeset, error) {
+	start := time.Now()
+	var cs *Changeset
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			var err error
+			cs, err = recordChanges(ctx, tx, tables, fn)
+			return err
+		})
+	})
+	if err != nil {
+		cs = nil
+	}
+	a.logOp("record_changes", start, err, slog.Int("changes", len(cs.changes())))
+	return cs, err
+}
+
+// changes returns the changes in the changeset, if there is one.
+func (c *Changeset) changes() []Change {
+	if c == nil {
+		return nil
+	}
+	return c.Changes
+}
+
+func recordChanges(ctx context.Context, tx *sql.Tx, tables []string, fn func(tx *sql.Tx) error) (*Changeset, error) {
+	columns := make([][]string, len(tables))
+	statements := []string{"CREATE TEMP TABLE appdb_changes (seq INTEGER PRIMARY KEY, tbl INTEGER, op TEXT)"}
+	for i, table := range tables {
+		cols, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			return nil, err
+		}
+		if len(cols) == 0 {
+			return nil, fmt.Errorf("no such table: %s", table)
+		}
+		columns[i] = cols
+		statements = append(statements, recordStatements(i, table, cols)...)
+	}
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+	if err := fn(tx); err != nil {
+		return nil, err
+	}
+	cs, err := readChanges(ctx, tx, tables, columns)
+	if err != nil {
+		return nil, err
+	}
+	drop := []string{"DROP TABLE temp.appdb_changes"}
+	for i := range tables {
+		shadow := fmt.Sprintf("appdb_changes_%d", i)
+		for _, op := range []string{"ai", "ad", "au"} {
+			drop = append(drop, fmt.Sprintf("DROP TRIGGER temp.%s_%s", shadow, op))
+		}
+		drop = append(drop, "DROP TABLE temp."+shadow)
+	}
+	for _, s := range drop {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// recordStatements returns the statements creating the temporary table holding the rows changed
+// in the ith table and the triggers filling it.
+func recordStatements(i int, table string, columns []string) []string {
+	shadow := fmt.Sprintf("appdb_changes_%d", i)
+	values := func(side string) string {
+		v := make([]string, len(columns))
+		for j, c := range columns {
+			v[j] = side + "." + quoteIdent(c)
+		}
+		return fmt.Sprintf("INSERT INTO %s VALUES ((SELECT max(seq) FROM appdb_changes), '%s', %s);", shadow, side, strings.Join(v, ", "))
+	}
+	logChange := func(op ChangeOp) string {
+		return fmt.Sprintf("INSERT INTO appdb_changes (tbl, op) VALUES (%d, '%s');", i, op)
+	}
+	// The shadow table's columns have no declared type, so values keep their storage class. The
+	// change is found by its seq rather than last_insert_rowid(), which the trigger's own inserts
+	// change. Statements in temporary triggers find temporary tables first without qualified names.
+	src := "main." + quoteIdent(table)
+	return []string{
+		fmt.Sprintf("CREATE TEMP TABLE %s (seq INTEGER, side TEXT, %s)", shadow, strings.Join(quoteIdents(columns), ", ")),
+		fmt.Sprintf("CREATE TEMP TRIGGER %s_ai AFTER INSERT ON %s BEGIN %s %s END", shadow, src, logChange(ChangeInsert), values("new")),
+		fmt.Sprintf("CREATE TEMP TRIGGER %s_ad AFTER DELETE ON %s BEGIN %s %s END", shadow, src, logChange(ChangeDelete), values("old")),
+		fmt.Sprintf("CREATE TEMP TRIGGER %s_au AFTER UPDATE ON %s BEGIN %s %s %s END", shadow, src, logChange(ChangeUpdate), values("old"), values("new")),
+	}
+}
+
+// readChanges reads the changes recorded by the triggers in order.
+func readChanges(ctx context.Context, tx *sql.Tx, tables []string, columns [][]string) (*Changeset, error) {
+	cs := &Changeset{}
+	seqs := map[int64]int{}
+	rows, err := tx.QueryContext(ctx, "SELECT seq, tbl, op FROM temp.appdb_changes ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var seq int64
+		var tbl int
+		var op ChangeOp
+		if err := rows.Scan(&seq, &tbl, &op); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		seqs[seq] = len(cs.Changes)
+		cs.Changes = append(cs.Changes, Change{Table: tables[tbl], Op: op})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, cols := range columns {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM temp.appdb_changes_%d", i))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var seq int64
+			var side string
+			values := make([]any, len(cols))
+			ptrs := []any{&seq, &side}
+			for j := range values {
+				ptrs = append(ptrs, &values[j])
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			row := map[string]any{}
+			for j, c := range cols {
+				row[c] = values[j]
+			}
+			c := &cs.Changes[seqs[seq]]
+			if side == "old" {
+				c.Old = row
+			} else {
+				c.New = row
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// Invert returns the changeset undoing c: its changes reversed in order, with inserts and deletes
+// swapped and the old and new values of updates exchanged.
+func (c *Changeset) Invert() *Changeset {
+	inverse := &Changeset{Changes: make([]Change, len(c.Changes))}
+	for i, ch := range c.Changes {
+		inv := Change{Table: ch.Table, Op: ch.Op, Old: ch.New, New: ch.Old}
+		switch ch.Op {
+		case ChangeInsert:
+			inv.Op = ChangeDelete
+		case ChangeDelete:
+			inv.Op = ChangeInsert
+		}
+		inverse.Changes[len(c.Changes)-1-i] = inv
+	}
+	return inverse
+}
+
+// ApplyChangeset makes the changes in cs in a single transaction. A row to update or delete must
+// still have the values it had when the change was recorded; if it doesn't, or an insert
+// conflicts with an existing row, a ChangeConflictError is returned and nothing is changed.
+// ctx -- context for the transaction
+// cs -- changes to make
+func (a *AppDB) ApplyChangeset(ctx context.Context, cs *Changeset) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			for _, c := range cs.Changes {
+				if err := applyChange(ctx, tx, c); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	a.logOp("apply_changeset", start, err, slog.Int("changes", len(cs.Changes)))
+	return err
+}
+
+func applyChange(ctx context.Context, tx *sql.Tx, c Change) error {
+	var query string
+	var args []any
+	switch c.Op {
+	case ChangeInsert:
+		columns := sortedKeys(c.New)
+		for _, col := range columns {
+			args = append(args, c.New[col])
+		}
+		query = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(c.Table),
+			strings.Join(quoteIdents(columns), ", "), placeholders(len(columns)))
+	case ChangeUpdate:
+		var set []string
+		for _, col := range sortedKeys(c.New) {
+			if !sameValue(c.New[col], c.Old[col]) {
+				set = append(set, quoteIdent(col)+" = ?")
+				args = append(args, c.New[col])
+			}
+		}
+		if len(set) == 0 {
+			return nil
+		}
+		cond, condArgs := matchRow(c.Old)
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteIdent(c.Table), strings.Join(set, ", "), cond)
+		args = append(args, condArgs...)
+	case ChangeDelete:
+		cond, condArgs := matchRow(c.Old)
+		query = fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdent(c.Table), cond)
+		args = condArgs
+	default:
+		return &ChangeConflictError{c, fmt.Errorf("unknown operation %q", c.Op)}
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return &ChangeConflictError{c, err}
+	}
+	if c.Op != ChangeInsert {
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return &ChangeConflictError{c, errRowChanged}
+		}
+	}
+	return nil
+}
+
+// matchRow returns the condition matching a row with exactly the given values.
+func matchRow(row map[string]any) (string, []any) {
+	var conds []string
+	var args []any
+	for _, col := range sortedKeys(row) {
+		conds = append(conds, quoteIdent(col)+" IS ?")
+		args = append(args, row[col])
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// sameValue reports whether two column values are equal.
+func sameValue(a, b any) bool {
+	ab, aBlob := a.([]byte)
+	bb, bBlob := b.([]byte)
+	if aBlob || bBlob {
+		return aBlob && bBlob && bytes.Equal(ab, bb)
+	}
+	return a == b
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MarshalJSON encodes the change with its values in the ExportJSON encoding.
+func (c Change) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	table, _ := json.Marshal(c.Table)
+	fmt.Fprintf(&buf, `{"table":%s,"op":%q`, table, c.Op)
+	for _, side := range []struct {
+		name string
+		row  map[string]any
+	}{{"old", c.Old}, {"new", c.New}} {
+		if side.row == nil {
+			continue
+		}
+		fmt.Fprintf(&buf, `,%q:{`, side.name)
+		for i, col := range sortedKeys(side.row) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(col)
+			buf.Write(name)
+			buf.WriteByte(':')
+			if err := appendJSONValue(&buf, side.row[col]); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a change encoded by MarshalJSON.
+func (c *Change) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Table string
+		Op    ChangeOp
+		Old   map[string]any
+		New   map[string]any
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	*c = Change{Table: raw.Table, Op: raw.Op}
+	var err error
+	if c.Old, err = jsonRow(raw.Old); err != nil {
+		return err
+	}
+	c.New, err = jsonRow(raw.New)
+	return err
+}
+
+// jsonRow converts the decoded values of a row in the ExportJSON encoding.
+func jsonRow(raw map[string]any) (map[string]any, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	row := make(map[string]any, len(raw))
+	for col, v := range raw {
+		value, err := jsonColumnValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col, err)
+		}
+		row[col] = value
+	}
+	return row, nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestRecordChanges(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);", "INSERT INTO t VALUES (1, 'a');"})
+	cs, err := db.RecordChanges(ctx, []string{"t"}, func(tx *sql.Tx) error {
+		for _, s := range []string{
+			"INSERT INTO t VALUES (2, 'c'), (3, 'd')",
+			"UPDATE t SET v = 'b'",
+			"DELETE FROM t WHERE id = 2",
+		} {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := func(id int64, v string) map[string]any { return map[string]any{"id": id, "v": v} }
+	want := []Change{
+		{Table: "t", Op: ChangeInsert, New: row(2, "c")},
+		{Table: "t", Op: ChangeInsert, New: row(3, "d")},
+		{Table: "t", Op: ChangeUpdate, Old: row(1, "a"), New: row(1, "b")},
+		{Table: "t", Op: ChangeUpdate, Old: row(2, "c"), New: row(2, "b")},
+		{Table: "t", Op: ChangeUpdate, Old: row(3, "d"), New: row(3, "b")},
+		{Table: "t", Op: ChangeDelete, Old: row(2, "b")},
+	}
+	if !reflect.DeepEqual(cs.Changes, want) {
+		t.Fatalf("changes = %v, want %v", cs.Changes, want)
+	}
+
+	if err := db.ApplyChangeset(ctx, cs.Invert()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tableRows(t, db); !reflect.DeepEqual(got, []string{"1=a"}) {
+		t.Fatalf("rows after inverse = %v", got)
+	}
+	if err := db.ApplyChangeset(ctx, cs); err != nil {
+		t.Fatal(err)
+	}
+	if got := tableRows(t, db); !reflect.DeepEqual(got, []string{"1=b", "3=b"}) {
+		t.Fatalf("rows after reapplying = %v", got)
+	}
+	if err := db.ApplyChangeset(ctx, cs); err == nil {
+		t.Fatal("applying changeset twice succeeded")
+	}
+}
+
+// tableRows returns the rows of table t as id=v, in id order.
+func tableRows(t *testing.T, db *AppDB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT id || '=' || v FROM t ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
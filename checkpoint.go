@@ -0,0 +1,84 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// CheckpointMode is how a WAL checkpoint treats readers and writers, passed to Checkpoint.
+type CheckpointMode string
+
+const (
+	// CheckpointPassive copies as much of the log as it can without waiting for readers or writers.
+	CheckpointPassive CheckpointMode = "PASSIVE"
+	// CheckpointFull waits for writers to finish, then copies the whole log.
+	CheckpointFull CheckpointMode = "FULL"
+	// CheckpointRestart is CheckpointFull, then waits for readers so the next writer starts the
+	// log from the beginning.
+	CheckpointRestart CheckpointMode = "RESTART"
+	// CheckpointTruncate is CheckpointRestart, then truncates the log file to zero bytes.
+	CheckpointTruncate CheckpointMode = "TRUNCATE"
+)
+
+// CheckpointResult reports the outcome of a checkpoint.
+type CheckpointResult struct {
+	// Busy is true if the checkpoint couldn't complete because of other connections.
+	Busy bool
+	// Log is the number of frames in the write-ahead log, or -1 if it isn't in WAL mode.
+	Log int
+	// Checkpointed is the number of frames copied into the database, or -1 if it isn't in WAL mode.
+	Checkpointed int
+}
+
+// WithAutoCheckpoint sets the size in pages the write-ahead log may reach before a commit
+// checkpoints it, bounding its growth. SQLite's default is 1000 pages; zero or less turns
+// automatic checkpoints off, leaving them to Checkpoint. It has no effect with WithWALHook, which
+// manages checkpoints itself.
+// pages -- log size that triggers a checkpoint
+func WithAutoCheckpoint(pages int) Option {
+	return func(c *config) {
+		c.autoCheckpoint = max(pages, 0)
+	}
+}
+
+// Checkpoint copies the write-ahead log into the database file, making the changes durable in
+// the file itself, for example before the system suspends. mode says whether to wait for other
+// connections and whether to reset or truncate the log afterwards.
+// mode -- how to treat other readers and writers
+func (a *AppDB) Checkpoint(mode CheckpointMode) (*CheckpointResult, error) {
+	return a.CheckpointContext(context.Background(), mode)
+}
+
+// CheckpointContext is Checkpoint with a context.
+func (a *AppDB) CheckpointContext(ctx context.Context, mode CheckpointMode) (*CheckpointResult, error) {
+	start := time.Now()
+	r, err := checkpoint(ctx, a.DB, mode)
+	a.logOp("checkpoint", start, err, slog.String("mode", string(mode)))
+	return r, err
+}
+
+func checkpoint(ctx context.Context, db querier, mode CheckpointMode) (*CheckpointResult, error) {
+	switch mode {
+	case CheckpointPassive, CheckpointFull, CheckpointRestart, CheckpointTruncate:
+	default:
+		return nil, fmt.Errorf("unknown checkpoint mode %q", mode)
+	}
+	r := &CheckpointResult{}
+	err := db.QueryRowContext(ctx, fmt.Sprintf("PRAGMA wal_checkpoint(%s)", mode)).Scan(&r.Busy, &r.Log, &r.Checkpointed)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
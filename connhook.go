@@ -0,0 +1,72 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// initConnector adds extensions to, runs statements on and attaches databases to every new
+// connection before the pool hands it out, for settings SQLite keeps per connection rather than
+// per database file.
+type initConnector struct {
+	driver.Connector
+	extensions *extensions
+	statements []string
+}
+
+func (c *initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !c.extensions.empty() {
+		added, err := addExtensions(conn, c.extensions)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = added
+	}
+	statements := c.statements
+	if attach := c.extensions.attachments.statements(); len(attach) > 0 {
+		statements = append(append([]string(nil), statements...), attach...)
+	}
+	for _, stmt := range statements {
+		if err := execConn(ctx, conn, stmt); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// execConn executes a statement without arguments on a driver connection.
+func execConn(ctx context.Context, conn driver.Conn, stmt string) error {
+	if ex, ok := conn.(driver.ExecerContext); ok {
+		_, err := ex.ExecContext(ctx, stmt, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	st, err := conn.Prepare(stmt)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if sc, ok := st.(driver.StmtExecContext); ok {
+		_, err = sc.ExecContext(ctx, nil)
+		return err
+	}
+	_, err = st.Exec(nil)
+	return err
+}
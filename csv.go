@@ -0,0 +1,367 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCSVBatchSize is the number of rows ImportCSV inserts per transaction unless
+// CSVOptions says otherwise.
+const DefaultCSVBatchSize = 1000
+
+// CSVOptions configures ImportCSV. The zero value imports a comma-separated file whose header
+// names the table's columns.
+type CSVOptions struct {
+	// Columns maps header names to the table columns they fill. Headers not in the map fill the
+	// column of the same name; mapping a header to "" skips it.
+	Columns map[string]string
+	// Comma is the field delimiter, ',' if zero.
+	Comma rune
+	// BatchSize is the number of rows inserted per transaction, DefaultCSVBatchSize if zero.
+	BatchSize int
+	// EmptyAsNull inserts empty fields as NULL in text columns too. Empty fields in numeric
+	// columns are always NULL.
+	EmptyAsNull bool
+	// MaxRejects stops the import with an error once more than this many rows have been rejected.
+	// Zero means no limit.
+	MaxRejects int
+}
+
+// CSVReport describes the outcome of ImportCSV.
+type CSVReport struct {
+	// Inserted counts the rows inserted.
+	Inserted int
+	// Rejected lists the rows that could not be converted or inserted.
+	Rejected []CSVReject
+}
+
+// CSVReject is a row rejected by ImportCSV.
+type CSVReject struct {
+	// Line is the line of the file the row starts on.
+	Line   int
+	Record []string
+	Err    error
+}
+
+type CSVColumnError struct {
+	Header string
+	Table  string
+}
+
+func (e *CSVColumnError) Error() string {
+	return fmt.Sprintf("CSV column %s has no matching column in table %s", e.Header, e.Table)
+}
+
+// ImportCSV inserts the rows of a CSV file into table. The first record is a header naming the
+// column each field fills, subject to opts.Columns. Fields are converted to suit the type
+// affinity of their column, so "42" is inserted into an INTEGER column as an integer, and rows
+// whose fields can't be converted, or whose insert fails, are rejected and reported rather than
+// ending the import. Rows are inserted in transactions of opts.BatchSize; if the import stops
+// with an error, batches already committed remain.
+// ctx -- context for the import
+// table -- name of the table to import into
+// r -- source of the CSV file
+// opts -- import settings, may be nil
+func (a *AppDB) ImportCSV(ctx context.Context, table string, r io.Reader, opts *CSVOptions) (*CSVReport, error) {
+	start := time.Now()
+	if opts == nil {
+		opts = &CSVOptions{}
+	}
+	report := &CSVReport{}
+	err := importCSV(ctx, a.DB, table, r, opts, report)
+	a.logOp("import_csv", start, err, slog.String("table", table), slog.Int("rows", report.Inserted), slog.Int("rejected", len(report.Rejected)))
+	return report, err
+}
+
+// csvField is a CSV field that fills a table column.
+type csvField struct {
+	index    int
+	column   string
+	affinity string
+}
+
+func importCSV(ctx context.Context, db *sql.DB, table string, r io.Reader, opts *CSVOptions, report *CSVReport) error {
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	fields, err := csvFields(ctx, db, table, header, opts)
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = quoteIdent(f.column)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(fields)), ", ")
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(table), strings.Join(quoted, ", "), placeholders)
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultCSVBatchSize
+	}
+	reject := func(line int, record []string, err error) error {
+		report.Rejected = append(report.Rejected, CSVReject{line, record, err})
+		if opts.MaxRejects > 0 && len(report.Rejected) > opts.MaxRejects {
+			return fmt.Errorf("import stopped after %d rejected rows", len(report.Rejected))
+		}
+		return nil
+	}
+	for done := false; !done; {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.PrepareContext(ctx, insert)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		inserted := 0
+		for n := 0; n < batchSize; n++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				done = true
+				break
+			}
+			var line int
+			var args []any
+			if err == nil {
+				line, _ = cr.FieldPos(0)
+				args, err = csvArgs(record, fields, opts)
+			}
+			if err == nil {
+				_, err = stmt.ExecContext(ctx, args...)
+			}
+			if err != nil {
+				var perr *csv.ParseError
+				if errors.As(err, &perr) {
+					line = perr.StartLine
+				}
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				} else {
+					err = reject(line, record, err)
+				}
+				if err != nil {
+					stmt.Close()
+					tx.Rollback()
+					return err
+				}
+				continue
+			}
+			inserted++
+		}
+		stmt.Close()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		report.Inserted += inserted
+	}
+	return nil
+}
+
+// csvFields matches the header to the table's columns.
+func csvFields(ctx context.Context, db querier, table string, header []string, opts *CSVOptions) ([]csvField, error) {
+	affinities, err := columnAffinities(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(affinities) == 0 {
+		return nil, fmt.Errorf("no such table: %s", table)
+	}
+	var fields []csvField
+	for i, h := range header {
+		column, mapped := opts.Columns[h]
+		if !mapped {
+			column = h
+		}
+		if column == "" {
+			continue
+		}
+		affinity, ok := affinities[column]
+		if !ok {
+			return nil, &CSVColumnError{h, table}
+		}
+		fields = append(fields, csvField{i, column, affinity})
+	}
+	return fields, nil
+}
+
+// columnAffinities returns the type affinity of each column of table, following SQLite's rules
+// for deriving it from the declared type.
+func columnAffinities(ctx context.Context, db querier, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	affinities := map[string]string{}
+	for rows.Next() {
+		var name, declared string
+		if err := rows.Scan(&name, &declared); err != nil {
+			return nil, err
+		}
+		affinities[name] = affinity(declared)
+	}
+	return affinities, rows.Err()
+}
+
+// affinity returns the type affinity of a declared column type.
+func affinity(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "INT"):
+		return "INTEGER"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "TEXT"
+	case t == "", strings.Contains(t, "BLOB"):
+		return "BLOB"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "REAL"
+	}
+	return "NUMERIC"
+}
+
+// csvArgs converts the fields of a record to insert arguments.
+func csvArgs(record []string, fields []csvField, opts *CSVOptions) ([]any, error) {
+	args := make([]any, len(fields))
+	for i, f := range fields {
+		if f.index >= len(record) {
+			return nil, fmt.Errorf("missing field for column %s", f.column)
+		}
+		v, err := coerce(record[f.index], f.affinity, opts.EmptyAsNull)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", f.column, err)
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+// coerce converts a field to the type its column expects.
+func coerce(s string, affinity string, emptyAsNull bool) (any, error) {
+	if s == "" && (emptyAsNull || (affinity != "TEXT" && affinity != "BLOB")) {
+		return nil, nil
+	}
+	switch affinity {
+	case "INTEGER":
+		if i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			return i, nil
+		}
+		return nil, fmt.Errorf("%q is not an integer", s)
+	case "REAL":
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%q is not a number", s)
+	case "NUMERIC":
+		t := strings.TrimSpace(s)
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+// ExportCSV runs query and writes the results to w as CSV, with a header record of the result's
+// column names. NULL is written as an empty field, blobs as their raw bytes, and times in
+// RFC 3339 format.
+// ctx -- context for the query
+// query -- SQL query to run
+// w -- destination of the CSV file
+// args -- arguments for placeholders in query
+func (a *AppDB) ExportCSV(ctx context.Context, query string, w io.Writer, args ...any) error {
+	start := time.Now()
+	n, err := exportCSV(ctx, a, query, w, args)
+	a.logOp("export_csv", start, err, slog.Int("rows", n))
+	return err
+}
+
+func exportCSV(ctx context.Context, q querier, query string, w io.Writer, args []any) (int, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return 0, err
+	}
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			record[i] = csvValue(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// csvValue formats a column value as a CSV field.
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportCSV(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price REAL, note TEXT);"})
+	input := "Code;Name;Price;Ignored;note\n" +
+		"1;apple;1.5;x;\n" +
+		"2;pear;cheap;x;\n" +
+		"3;plum;;x;ripe\n"
+	opts := &CSVOptions{
+		Columns:   map[string]string{"Code": "id", "Name": "name", "Price": "price", "Ignored": ""},
+		Comma:     ';',
+		BatchSize: 2,
+	}
+	report, err := db.ImportCSV(ctx, "items", strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 2 {
+		t.Errorf("inserted %d rows, want 2", report.Inserted)
+	}
+	if len(report.Rejected) != 1 || report.Rejected[0].Line != 3 || report.Rejected[0].Record[1] != "pear" {
+		t.Errorf("rejected = %+v, want line 3", report.Rejected)
+	}
+	got := queryStrings(t, db, "SELECT id || ':' || typeof(price) || ':' || quote(note) FROM items ORDER BY id")
+	want := []string{"1:real:''", "3:null:'ripe'"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+
+	opts = &CSVOptions{EmptyAsNull: true, MaxRejects: 1}
+	input = "id,name,note\n4,fig,\n1,dup,\n1,dup,\n5,kiwi,\n"
+	report, err = db.ImportCSV(ctx, "items", strings.NewReader(input), opts)
+	if err == nil {
+		t.Fatal("import past MaxRejects succeeded")
+	}
+	if report.Inserted != 0 || len(report.Rejected) != 2 {
+		t.Errorf("report = %+v, want nothing inserted and 2 rejected", report)
+	}
+	if got := queryStrings(t, db, "SELECT name FROM items WHERE id = 4"); len(got) != 0 {
+		t.Error("rows from the stopped batch were committed")
+	}
+
+	var colErr *CSVColumnError
+	if _, err := db.ImportCSV(ctx, "items", strings.NewReader("id,colour\n"), nil); !errors.As(err, &colErr) || colErr.Header != "colour" {
+		t.Errorf("error = %v, want a CSVColumnError for colour", err)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package docs is a document store kept in an appdb database, for data with too loose a shape for
+// a relational schema but which still needs querying. Documents are stored as JSON, and paths
+// within them that are queried often can be indexed.
+package docs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+// TablePrefix starts the name of the table holding each collection. Tables named with the "appdb_"
+// prefix are left out of the application's schema, so schema validation ignores them.
+const TablePrefix = "appdb_docs_"
+
+// ErrNotFound is returned for a document id that isn't in the collection.
+var ErrNotFound = errors.New("Document not found")
+
+// PathError reports a document path that isn't a dotted list of field names.
+type PathError struct {
+	Path string
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("Invalid document path %q", e.Path)
+}
+
+// validPath matches dotted lists of field names, such as "user.email".
+var validPath = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Collection is a set of JSON documents keyed by id.
+type Collection struct {
+	db      *appdb.AppDB
+	table   string
+	indexed map[string]bool
+}
+
+// Open returns the named collection, creating its table if needed, and indexing each of paths
+// that isn't already indexed. Each path is a dotted list of field names, such as "user.email",
+// and is indexed with a generated column and an index on it, which Find uses to filter on the
+// path. Indexes declared by earlier calls are kept.
+// ctx -- context for the statements
+// db -- database to keep the collection in
+// name -- name of the collection
+// paths -- document paths to index
+func Open(ctx context.Context, db *appdb.AppDB, name string, paths ...string) (*Collection, error) {
+	for _, p := range paths {
+		if !validPath.MatchString(p) {
+			return nil, &PathError{p}
+		}
+	}
+	c := &Collection{db: db, table: TablePrefix + name, indexed: map[string]bool{}}
+	t := quote(c.table)
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+t+" (id TEXT PRIMARY KEY, doc TEXT NOT NULL CHECK (json_valid(doc)))")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_xinfo(?) WHERE hidden IN (2, 3)", c.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		c.indexed[column] = true
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if c.indexed[p] {
+			continue
+		}
+		// Virtual columns can be added to an existing table, and cost nothing to store.
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s AS (json_extract(doc, '%s')) VIRTUAL", t, quote(p), jsonPath(p)),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", quote(c.table+"_"+p), t, quote(p)),
+		}
+		for _, stmt := range statements {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return nil, err
+			}
+		}
+		c.indexed[p] = true
+	}
+	return c, nil
+}
+
+// quote quotes an SQL identifier.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// jsonPath returns the SQLite JSON path of a dotted document path.
+func jsonPath(path string) string {
+	return "$." + path
+}
+
+// Put stores doc, marshalled to JSON, as the document with the given id, replacing any document
+// already stored with it.
+// ctx -- context for the statement
+// id -- id of the document
+// doc -- document to marshal
+func (c *Collection) Put(ctx context.Context, id string, doc any) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.ExecContext(ctx, "INSERT INTO "+quote(c.table)+" (id, doc) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET doc = excluded.doc",
+		id, string(b))
+	return err
+}
+
+// Get unmarshals the document with the given id into dest, returning ErrNotFound if there is none.
+// ctx -- context for the query
+// id -- id of the document
+// dest -- pointer to unmarshal the document into
+func (c *Collection) Get(ctx context.Context, id string, dest any) error {
+	var doc string
+	err := c.db.QueryRowContext(ctx, "SELECT doc FROM "+quote(c.table)+" WHERE id = ?", id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(doc), dest)
+}
+
+// Delete removes the document with the given id, doing nothing if there is none.
+// ctx -- context for the statement
+// id -- id of the document
+func (c *Collection) Delete(ctx context.Context, id string) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM "+quote(c.table)+" WHERE id = ?", id)
+	return err
+}
+
+// Filter is a condition on the value at a path in each document, made with Eq and its neighbours.
+type Filter struct {
+	path  string
+	op    string
+	value any
+}
+
+// Eq matches documents whose value at path equals value.
+func Eq(path string, value any) Filter { return Filter{path, "=", value} }
+
+// Ne matches documents whose value at path is present and does not equal value.
+func Ne(path string, value any) Filter { return Filter{path, "!=", value} }
+
+// Lt matches documents whose value at path is less than value.
+func Lt(path string, value any) Filter { return Filter{path, "<", value} }
+
+// Le matches documents whose value at path is less than or equal to value.
+func Le(path string, value any) Filter { return Filter{path, "<=", value} }
+
+// Gt matches documents whose value at path is greater than value.
+func Gt(path string, value any) Filter { return Filter{path, ">", value} }
+
+// Ge matches documents whose value at path is greater than or equal to value.
+func Ge(path string, value any) Filter { return Filter{path, ">=", value} }
+
+// Find unmarshals the documents matching every filter into the slice dest points to, in order of
+// id. Filters on indexed paths use the index; others read every document.
+// ctx -- context for the query
+// dest -- pointer to a slice to unmarshal documents into
+// filters -- conditions the documents must meet
+func (c *Collection) Find(ctx context.Context, dest any, filters ...Filter) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Find destination must be a pointer to a slice, not %T", dest)
+	}
+	var where []string
+	var args []any
+	for _, f := range filters {
+		if !validPath.MatchString(f.path) {
+			return &PathError{f.path}
+		}
+		column := "json_extract(doc, ?)"
+		if c.indexed[f.path] {
+			column = quote(f.path)
+		} else {
+			args = append(args, jsonPath(f.path))
+		}
+		where = append(where, column+" "+f.op+" ?")
+		args = append(args, f.value)
+	}
+	query := "SELECT doc FROM " + quote(c.table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := c.db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	slice := v.Elem()
+	for rows.Next() {
+		var doc string
+		if err := rows.Scan(&doc); err != nil {
+			return err
+		}
+		elem := reflect.New(slice.Type().Elem())
+		if err := json.Unmarshal([]byte(doc), elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return rows.Err()
+}
+
+// Drop removes the collection and every document in it.
+// ctx -- context for the statement
+func (c *Collection) Drop(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+quote(c.table))
+	return err
+}
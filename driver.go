@@ -0,0 +1,128 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Opener returns a connector for dsn using a database/sql driver that speaks SQLite.
+type Opener func(dsn string) (driver.Connector, error)
+
+type UnknownDriverError struct {
+	Name string
+}
+
+func (e *UnknownDriverError) Error() string {
+	return fmt.Sprintf("Unknown appdb driver %s", e.Name)
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Opener)
+)
+
+// RegisterDriver makes a SQLite driver available to appdb under name, for selection with
+// WithDriver. Registering a name again replaces the earlier opener. The driver appdb was built
+// with is registered under its database/sql name ("sqlite3" for github.com/mattn/go-sqlite3,
+// "sqlite" for modernc.org/sqlite).
+func RegisterDriver(name string, opener Opener) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[name] = opener
+}
+
+// SQLDriver returns an Opener for a driver already registered with database/sql under name,
+// for example a SQLCipher build of go-sqlite3:
+//
+//	appdb.RegisterDriver("sqlcipher", appdb.SQLDriver("sqlite3_cipher"))
+func SQLDriver(name string) Opener {
+	return func(dsn string) (driver.Connector, error) {
+		db, err := sql.Open(name, dsn)
+		if err != nil {
+			return nil, err
+		}
+		d := db.Driver()
+		db.Close()
+		if dc, ok := d.(driver.DriverContext); ok {
+			return dc.OpenConnector(dsn)
+		}
+		return dsnConnector{dsn, d}, nil
+	}
+}
+
+// WithDriver selects the registered driver used to open the database.
+func WithDriver(name string) Option {
+	return func(c *config) {
+		c.driver = name
+	}
+}
+
+// openDriver opens a connection pool for dsn using the named registered driver. The extensions,
+// if not nil, are added to and the statements run on each new connection, and closer, if not nil,
+// is closed when the pool is closed.
+func openDriver(name string, dsn string, ext *extensions, statements []string, closer io.Closer) (*sql.DB, error) {
+	driversMu.RLock()
+	opener, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, &UnknownDriverError{name}
+	}
+	if err := registerExtensions(ext); err != nil {
+		return nil, err
+	}
+	connector, err := opener(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Databases can be attached, and hooks wanted, after opening, so the extensions are checked
+	// as each connection is made.
+	if ext != nil || len(statements) > 0 {
+		connector = &initConnector{connector, ext, statements}
+	}
+	if closer != nil {
+		connector = &closeConnector{connector, closer}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// closeConnector closes something alongside the connection pool. database/sql closes a
+// connector that implements io.Closer when the DB is closed.
+type closeConnector struct {
+	driver.Connector
+	closer io.Closer
+}
+
+func (c *closeConnector) Close() error {
+	if cl, ok := c.Connector.(io.Closer); ok {
+		cl.Close()
+	}
+	return c.closer.Close()
+}
+
+// dsnConnector adapts a driver that doesn't implement driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+)
+
+// wrappedDriver opens connections of the built-in driver hidden behind another type, as a driver
+// registered by an application would be.
+type wrappedDriver struct {
+	driver.Driver
+}
+
+type wrappedConn struct {
+	driver.Conn
+}
+
+func (d wrappedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return wrappedConn{conn}, nil
+}
+
+func TestRegisterDriver(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(driverName, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.Driver()
+	db.Close()
+	RegisterDriver("appdb_test_wrapped", func(dsn string) (driver.Connector, error) {
+		return dsnConnector{dsn, wrappedDriver{d}}, nil
+	})
+
+	a := newTestDB(t, []string{"CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);"}, WithDriver("appdb_test_wrapped"))
+	err = a.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1, 'a')")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := a.QueryRowContext(ctx, "SELECT v FROM t WHERE id = 1").Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v != "a" {
+		t.Errorf("v = %q, want %q", v, "a")
+	}
+	if err := a.ValidateContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
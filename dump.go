@@ -0,0 +1,204 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Dump writes the whole database, schema and data, to w as an SQL script in the style of the
+// sqlite3 shell's .dump command. Replaying the script, for example with ImportDump, recreates the
+// database including its app name and schema version. The rows of virtual tables are dumped with
+// their rowids, except full-text indexes of other tables, which are rebuilt from them instead.
+// The dump is read in one transaction, so it is consistent even while the database is being
+// written.
+// w -- destination of the SQL script
+func (a *AppDB) Dump(w io.Writer) error {
+	return a.DumpContext(context.Background(), w)
+}
+
+// DumpContext is Dump with a context.
+func (a *AppDB) DumpContext(ctx context.Context, w io.Writer) error {
+	start := time.Now()
+	tx, err := a.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err == nil {
+		err = dump(ctx, tx, w)
+		tx.Rollback()
+	}
+	a.logOp("dump", start, err)
+	return err
+}
+
+// schemaObject is one entry of sqlite_master.
+type schemaObject struct {
+	kind string
+	name string
+	sql  string
+}
+
+// dump writes the database readable through q to w.
+func dump(ctx context.Context, q querier, w io.Writer) error {
+	objects, err := schemaObjects(ctx, q)
+	if err != nil {
+		return err
+	}
+	shadow, err := shadowTables(ctx, q)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "PRAGMA foreign_keys=OFF;")
+	fmt.Fprintln(bw, "BEGIN TRANSACTION;")
+	for _, pragma := range []string{"application_id", "user_version"} {
+		v, err := readPragmaUint32(ctx, q, pragma)
+		if err != nil {
+			return err
+		}
+		if v != 0 {
+			fmt.Fprintf(bw, "PRAGMA %s=%d;\n", pragma, int32(v))
+		}
+	}
+	hasSequence := false
+	var rebuild []string
+	for _, o := range objects {
+		if o.kind != "table" {
+			continue
+		}
+		switch {
+		case o.name == "sqlite_sequence":
+			hasSequence = true
+			continue
+		case strings.HasPrefix(o.name, "sqlite_") || shadow[o.name]:
+			// Internal and virtual table shadow tables are maintained by SQLite.
+			continue
+		}
+		fmt.Fprintf(bw, "%s;\n", o.sql)
+		if strings.HasPrefix(strings.ToUpper(o.sql), "CREATE VIRTUAL TABLE") {
+			// A full-text index of another table is rebuilt from it once its rows are in; the
+			// rows of other virtual tables keep their rowids, which may tie them to other rows.
+			if externalContent(o.sql) {
+				rebuild = append(rebuild, fmt.Sprintf("INSERT INTO %s(%s) VALUES('rebuild');", quoteIdent(o.name), quoteIdent(o.name)))
+				continue
+			}
+			if err := dumpRows(ctx, q, bw, o.name, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dumpRows(ctx, q, bw, o.name, false); err != nil {
+			return err
+		}
+	}
+	if hasSequence {
+		fmt.Fprintln(bw, "DELETE FROM sqlite_sequence;")
+		if err := dumpRows(ctx, q, bw, "sqlite_sequence", false); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range rebuild {
+		fmt.Fprintln(bw, stmt)
+	}
+	for _, o := range objects {
+		if o.kind != "table" && o.sql != "" {
+			fmt.Fprintf(bw, "%s;\n", o.sql)
+		}
+	}
+	fmt.Fprintln(bw, "COMMIT;")
+	return bw.Flush()
+}
+
+// schemaObjects lists the database's tables, indexes, triggers and views in creation order.
+// Automatic indexes have no SQL.
+func schemaObjects(ctx context.Context, q querier) ([]schemaObject, error) {
+	rows, err := q.QueryContext(ctx, "SELECT type, name, coalesce(sql, '') FROM sqlite_master ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		if err := rows.Scan(&o.kind, &o.name, &o.sql); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// shadowTables returns the names of tables that hold the data of virtual tables.
+func shadowTables(ctx context.Context, q querier) (map[string]bool, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_list WHERE schema = 'main' AND type = 'shadow'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shadow := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		shadow[name] = true
+	}
+	return shadow, rows.Err()
+}
+
+// externalContent reports whether the CREATE VIRTUAL TABLE statement sql makes an FTS4 or FTS5
+// index of the rows of another table, whose own rows are only the content table's read through it.
+func externalContent(sql string) bool {
+	m := contentOption.FindStringSubmatch(sql)
+	return m != nil && m[1] != "''" && m[1] != `""`
+}
+
+// contentOption matches an FTS4 or FTS5 table's content option, capturing its value.
+var contentOption = regexp.MustCompile(`(?is)\busing\s+fts[45]\s*\(.*\bcontent\s*=\s*('(?:[^']|'')*'|"(?:[^"]|"")*"|[^\s,)]+)`)
+
+// dumpRows writes an INSERT statement for each row of table, including the rowid if withRowid is
+// set. SQLite's quote function renders the values, so they replay with the same types.
+func dumpRows(ctx context.Context, q querier, w io.Writer, table string, withRowid bool) error {
+	columns, err := tableColumns(ctx, q, table)
+	if err != nil {
+		return err
+	}
+	if withRowid {
+		columns = append([]string{"rowid"}, columns...)
+	}
+	quoted := make([]string, len(columns))
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+		values[i] = "quote(" + quoteIdent(c) + ")"
+	}
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", strings.Join(values, " || ',' || "), quoteIdent(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	prefix := fmt.Sprintf("INSERT INTO %s(%s) VALUES(", quoteIdent(table), strings.Join(quoted, ","))
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s%s);\n", prefix, row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{
+		"CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, v TEXT, b BLOB, f REAL);",
+		"INSERT INTO t (v, b, f) VALUES ('it''s', x'00ff', 1.5), (NULL, NULL, 2), ('semi;colon', x'', -0.25);",
+		"DELETE FROM t WHERE id = 2;",
+		"CREATE INDEX t_v ON t (v);",
+		"CREATE VIEW tv AS SELECT v FROM t;",
+	})
+	var dump bytes.Buffer
+	if err := db.DumpContext(ctx, &dump); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := InitFromDump(filepath.Join(t.TempDir(), "restored.db"), "test", 1, &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	query := "SELECT id || ',' || quote(v) || ',' || quote(b) || ',' || quote(f) FROM t ORDER BY id"
+	if got, want := queryStrings(t, restored, query), queryStrings(t, db, query); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored rows = %v, want %v", got, want)
+	}
+	if got := queryStrings(t, restored, "SELECT seq FROM sqlite_sequence WHERE name = 't'"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("sequence = %v, want [3]", got)
+	}
+	if got := queryStrings(t, restored, "SELECT name FROM sqlite_master WHERE type IN ('index', 'view') AND sql IS NOT NULL ORDER BY name"); !reflect.DeepEqual(got, []string{"t_v", "tv"}) {
+		t.Errorf("indexes and views = %v", got)
+	}
+}
+
+func TestDumpVirtualTables(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{
+		"CREATE TABLE doc (id INTEGER PRIMARY KEY, body TEXT, x REAL, y REAL);",
+		"INSERT INTO doc VALUES (1, 'red fish', 1, 1), (5, 'blue fish', 2, 3), (7, 'red car', 5, 5);",
+	})
+	if _, err := db.CreateFullText(ctx, "doc_fts", "doc", "body"); err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			t.Skip("FTS5 not built in; use the sqlite_fts5 build tag")
+		}
+		t.Fatal(err)
+	}
+	if _, err := db.CreateSpatialIndex(ctx, "doc_rt", "doc", "x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE VIRTUAL TABLE notes USING fts5(body)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO notes (rowid, body) VALUES (10, 'red note'), (20, 'blue note')"); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err := db.DumpContext(ctx, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump.String(), `INSERT INTO "doc_fts"("body")`) {
+		t.Errorf("dump holds the rows of an external content index:\n%s", dump.String())
+	}
+	restored, err := InitFromDump(filepath.Join(t.TempDir(), "restored.db"), "test", 1, &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for _, query := range []string{
+		"SELECT rowid FROM doc_fts WHERE doc_fts MATCH 'red' ORDER BY rowid",
+		"SELECT count(*) FROM doc_fts",
+		"SELECT id || ':' || min_x || ':' || max_y FROM doc_rt ORDER BY id",
+		"SELECT rowid || ':' || body FROM notes WHERE notes MATCH 'note' ORDER BY rowid",
+	} {
+		if got, want := queryStrings(t, restored, query), queryStrings(t, db, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", query, got, want)
+		}
+	}
+	// The index is kept up to date after the restore.
+	if _, err := restored.ExecContext(ctx, "INSERT INTO doc VALUES (9, 'red kite', 0, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryStrings(t, restored, "SELECT rowid FROM doc_fts WHERE doc_fts MATCH 'red' ORDER BY rowid"); !reflect.DeepEqual(got, []string{"1", "7", "9"}) {
+		t.Errorf("matches after insert = %v", got)
+	}
+}
+
+// queryStrings returns the single text column of the rows of query.
+func queryStrings(t *testing.T, db *AppDB, query string) []string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+type DecryptionError struct {
+	Err error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("Unable to decrypt database: %s", e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// WithEncryptionKey encrypts the database with SQLCipher, using key as the raw 256-bit encryption
+// key (32 bytes, or 48 bytes including an explicit salt). The key is set on every connection with
+// PRAGMA key, and opening fails with a DecryptionError if the database can't be read with it.
+// This needs a driver built with SQLCipher, selected with RegisterDriver and WithDriver; with any
+// other driver opening fails rather than silently storing the data unencrypted.
+func WithEncryptionKey(key []byte) Option {
+	k := make([]byte, len(key))
+	copy(k, key)
+	return func(c *config) {
+		c.encryptionKey = k
+	}
+}
+
+// keyStatement returns the PRAGMA setting a raw SQLCipher key.
+func keyStatement(key []byte) string {
+	return fmt.Sprintf(`PRAGMA key = "x'%s'";`, hex.EncodeToString(key))
+}
+
+// verifyDecryption checks that the driver supports encryption and that the database can be read.
+func verifyDecryption(ctx context.Context, db *sql.DB) error {
+	var cipherVersion string
+	err := db.QueryRowContext(ctx, "PRAGMA cipher_version").Scan(&cipherVersion)
+	if err == sql.ErrNoRows || (err == nil && cipherVersion == "") {
+		return &DecryptionError{fmt.Errorf("driver does not support SQLCipher encryption")}
+	}
+	if err != nil {
+		return &DecryptionError{err}
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+		return &DecryptionError{err}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+// extensions are the Go functions, aggregates, collations, hooks and attached databases added to
+// each connection.
+type extensions struct {
+	functions   []sqlFunction
+	aggregates  []sqlFunction
+	collations  []sqlCollation
+	hooks       *connHooks
+	attachments *attachments
+}
+
+// empty reports whether there is nothing to add.
+func (e *extensions) empty() bool {
+	return e == nil || (len(e.functions) == 0 && len(e.aggregates) == 0 && len(e.collations) == 0 && e.hooks == nil && e.attachments.empty())
+}
+
+// sqlFunction is a Go function, or aggregate constructor, to be called from SQL.
+type sqlFunction struct {
+	name string
+	fn   any
+}
+
+// sqlCollation is a Go comparison used to collate text.
+type sqlCollation struct {
+	name string
+	cmp  func(a, b string) int
+}
+
+// WithFunction makes a Go function available to SQL on every connection as the scalar function
+// name, for example to provide REGEXP, which SQLite declares but doesn't implement:
+//
+//	appdb.WithFunction("regexp", func(re, s string) (bool, error) {
+//		return regexp.MatchString(re, s)
+//	})
+//
+// fn must be a func whose parameters and first result are of types SQLite values convert to and
+// from: integers, floats, bool, string, []byte or any. It may return an error as a second result,
+// which fails the statement, and may be variadic. The function is taken to have side effects or
+// depend on more than its arguments, so SQLite calls it every time; it can't be used in indexes or
+// generated columns.
+// A function that doesn't fit these rules makes opening the database fail. With the pure Go
+// driver, functions are registered for the whole process and can't be removed, so opening a
+// database fails if a different Go function was registered with the same name before. The same
+// function registered again, as when a database is reopened, replaces the earlier registration;
+// closures made from one function literal count as the same function.
+// name -- name of the SQL function
+// fn -- Go function implementing it
+func WithFunction(name string, fn any) Option {
+	return func(c *config) {
+		c.extensions.functions = append(c.extensions.functions, sqlFunction{name, fn})
+	}
+}
+
+// WithAggregate makes a Go type available to SQL on every connection as the aggregate function
+// name, for aggregates SQLite lacks such as a median or percentile. constructor is called at the
+// start of each group to make a new aggregate, a pointer with two methods: Step, called with the
+// arguments of each row, and Done, which returns the result. For example:
+//
+//	type median struct{ values []float64 }
+//
+//	func (m *median) Step(v float64) { m.values = append(m.values, v) }
+//	func (m *median) Done() float64  { ... }
+//
+//	appdb.WithAggregate("median", func() *median { return &median{} })
+//
+// The constructor, Step and Done may each also return an error, which fails the statement.
+// Arguments and results follow the rules for WithFunction, including registration for the whole
+// process with the pure Go driver, where a name can't be registered again with a different
+// constructor.
+// name -- name of the SQL aggregate function
+// constructor -- function returning a new aggregate
+func WithAggregate(name string, constructor any) Option {
+	return func(c *config) {
+		c.extensions.aggregates = append(c.extensions.aggregates, sqlFunction{name, constructor})
+	}
+}
+
+// WithCollation makes a Go comparison available on every connection as the collation name, for
+// ordering and comparing text in ways SQLite's built-in BINARY, NOCASE and RTRIM collations can't,
+// such as by locale or in natural order:
+//
+//	appdb.WithCollation("natural", naturalCompare)
+//
+// and then "ORDER BY title COLLATE natural", or a column declared "title TEXT COLLATE natural".
+// cmp returns a negative number, zero or a positive number as a sorts before, equal to or after
+// b, and must be a consistent ordering that never changes; an index built with one ordering is
+// corrupted if read with another. A schema using the collation must be opened with it. As for
+// WithFunction, the pure Go driver registers collations for the whole process, and a name can't
+// be registered again with a different comparison.
+// name -- name of the collation
+// cmp -- function comparing two strings
+func WithCollation(name string, cmp func(a, b string) int) Option {
+	return func(c *config) {
+		c.extensions.collations = append(c.extensions.collations, sqlCollation{name, cmp})
+	}
+}
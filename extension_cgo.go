@@ -0,0 +1,58 @@
+//go:build cgo && !appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// registerExtensions does nothing, as go-sqlite3 registers extensions on each connection.
+func registerExtensions(ext *extensions) error {
+	return nil
+}
+
+// addExtensions registers the functions, aggregates and collations on a go-sqlite3 connection,
+// returning the connection to use in its place, which installs the hooks once they are wanted.
+// Connections of other drivers are used as they are if there is nothing to register, and have no
+// hooks.
+func addExtensions(conn driver.Conn, ext *extensions) (driver.Conn, error) {
+	c, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		if len(ext.functions) > 0 || len(ext.aggregates) > 0 || len(ext.collations) > 0 {
+			return nil, fmt.Errorf("cannot register SQL functions with driver connection %T", conn)
+		}
+		return conn, nil
+	}
+	for _, f := range ext.functions {
+		if err := c.RegisterFunc(f.name, f.fn, false); err != nil {
+			return nil, fmt.Errorf("registering SQL function %s: %w", f.name, err)
+		}
+	}
+	for _, f := range ext.aggregates {
+		if err := c.RegisterAggregator(f.name, f.fn, false); err != nil {
+			return nil, fmt.Errorf("registering SQL aggregate %s: %w", f.name, err)
+		}
+	}
+	for _, col := range ext.collations {
+		if err := c.RegisterCollation(col.name, col.cmp); err != nil {
+			return nil, fmt.Errorf("registering collation %s: %w", col.name, err)
+		}
+	}
+	if ext.hooks == nil {
+		return conn, nil
+	}
+	return &hookedConn{SQLiteConn: c, changes: &connChanges{hooks: ext.hooks}}, nil
+}
@@ -0,0 +1,448 @@
+//go:build !cgo || appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+var (
+	extensionsMu sync.Mutex
+	// functions maps the lower-cased names of the functions and aggregates registered with
+	// modernc.org/sqlite to their current implementation.
+	functions = map[string]*registeredFunction{}
+	// collations maps the names of the collations registered with modernc.org/sqlite to their
+	// current comparison.
+	collations = map[string]*registeredCollation{}
+)
+
+// errRegistered is returned when registering a name already registered with other Go code.
+var errRegistered = errors.New("already registered with a different function")
+
+type registeredFunction struct {
+	// code identifies the Go function registered, so registering it again can be told apart from
+	// registering another function with the same name.
+	code         uintptr
+	nArgs        int32
+	call         func(args []driver.Value) (driver.Value, error)
+	newAggregate func() (sqlite.AggregateFunction, error)
+}
+
+type registeredCollation struct {
+	code uintptr
+	cmp  func(a, b string) int
+}
+
+// registerExtensions registers the functions and collations with modernc.org/sqlite, which adds
+// them to every connection opened afterwards. modernc.org/sqlite can't unregister them, so a name
+// already registered with the same Go function, such as when a database is opened again, is
+// pointed at the new registration, and a name registered with a different one is an error.
+func registerExtensions(ext *extensions) error {
+	if ext == nil {
+		return nil
+	}
+	for _, f := range ext.functions {
+		call, nArgs, err := adaptFunction(f.fn)
+		if err != nil {
+			return fmt.Errorf("registering SQL function %s: %w", f.name, err)
+		}
+		if err := registerFunction(f.name, funcCode(f.fn), nArgs, call); err != nil {
+			return fmt.Errorf("registering SQL function %s: %w", f.name, err)
+		}
+	}
+	for _, f := range ext.aggregates {
+		newAggregate, nArgs, err := adaptAggregate(f.fn)
+		if err != nil {
+			return fmt.Errorf("registering SQL aggregate %s: %w", f.name, err)
+		}
+		if err := registerAggregate(f.name, funcCode(f.fn), nArgs, newAggregate); err != nil {
+			return fmt.Errorf("registering SQL aggregate %s: %w", f.name, err)
+		}
+	}
+	for _, c := range ext.collations {
+		if err := registerCollation(c.name, funcCode(c.cmp), c.cmp); err != nil {
+			return fmt.Errorf("registering collation %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// funcCode returns the code pointer of a Go function, which is the same for every closure made
+// from one function literal.
+func funcCode(fn any) uintptr {
+	return reflect.ValueOf(fn).Pointer()
+}
+
+func registerFunction(name string, code uintptr, nArgs int32, call func([]driver.Value) (driver.Value, error)) error {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	key := strings.ToLower(name)
+	if r, ok := functions[key]; ok {
+		if r.code != code || r.nArgs != nArgs || r.call == nil {
+			return errRegistered
+		}
+		r.call = call
+		return nil
+	}
+	r := &registeredFunction{code: code, nArgs: nArgs, call: call}
+	err := sqlite.RegisterScalarFunction(name, nArgs, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		extensionsMu.Lock()
+		call := r.call
+		extensionsMu.Unlock()
+		return call(args)
+	})
+	if err != nil {
+		return err
+	}
+	functions[key] = r
+	return nil
+}
+
+func registerAggregate(name string, code uintptr, nArgs int32, newAggregate func() (sqlite.AggregateFunction, error)) error {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	key := strings.ToLower(name)
+	if r, ok := functions[key]; ok {
+		if r.code != code || r.nArgs != nArgs || r.newAggregate == nil {
+			return errRegistered
+		}
+		r.newAggregate = newAggregate
+		return nil
+	}
+	r := &registeredFunction{code: code, nArgs: nArgs, newAggregate: newAggregate}
+	err := sqlite.RegisterFunction(name, &sqlite.FunctionImpl{
+		NArgs: nArgs,
+		MakeAggregate: func(ctx sqlite.FunctionContext) (sqlite.AggregateFunction, error) {
+			extensionsMu.Lock()
+			newAggregate := r.newAggregate
+			extensionsMu.Unlock()
+			return newAggregate()
+		},
+	})
+	if err != nil {
+		return err
+	}
+	functions[key] = r
+	return nil
+}
+
+func registerCollation(name string, code uintptr, cmp func(a, b string) int) error {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	if r, ok := collations[name]; ok {
+		if r.code != code {
+			return errRegistered
+		}
+		r.cmp = cmp
+		return nil
+	}
+	r := &registeredCollation{code: code, cmp: cmp}
+	err := sqlite.RegisterCollationUtf8(name, func(a, b string) int {
+		extensionsMu.Lock()
+		cmp := r.cmp
+		extensionsMu.Unlock()
+		return cmp(a, b)
+	})
+	if err != nil {
+		return err
+	}
+	collations[name] = r
+	return nil
+}
+
+// addExtensions does nothing, as modernc.org/sqlite adds registered extensions to each
+// connection itself and has no update hook.
+func addExtensions(conn driver.Conn, ext *extensions) (driver.Conn, error) {
+	return conn, nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// adaptFunction wraps a Go function to take and return SQLite values, as go-sqlite3 does for
+// functions registered with it, returning the number of arguments it takes, or -1 if variadic.
+func adaptFunction(fn any) (func([]driver.Value) (driver.Value, error), int32, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return nil, 0, errors.New("not a function")
+	}
+	if err := checkResults(t); err != nil {
+		return nil, 0, err
+	}
+	args, nArgs, err := argConverter(t)
+	if err != nil {
+		return nil, 0, err
+	}
+	call := func(values []driver.Value) (driver.Value, error) {
+		in, err := args(values)
+		if err != nil {
+			return nil, err
+		}
+		return result(v.Call(in))
+	}
+	return call, nArgs, nil
+}
+
+// checkResults checks that a function returns a value SQLite can take, and optionally an error.
+func checkResults(t reflect.Type) error {
+	if t.NumOut() != 1 && t.NumOut() != 2 {
+		return errors.New("function must return 1 or 2 values")
+	}
+	if t.NumOut() == 2 && !t.Out(1).Implements(errorType) {
+		return errors.New("second return value must be error")
+	}
+	if !sqlValueKind(t.Out(0)) {
+		return fmt.Errorf("unsupported result type %s", t.Out(0))
+	}
+	return nil
+}
+
+// result converts the results of a function checked by checkResults to an SQLite value.
+func result(out []reflect.Value) (driver.Value, error) {
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return toSQL(out[0]), nil
+}
+
+// argConverter returns a function converting SQLite values to the arguments of a function of type
+// t, and the number of arguments it takes, or -1 if variadic.
+func argConverter(t reflect.Type) (func([]driver.Value) ([]reflect.Value, error), int32, error) {
+	fixed := t.NumIn()
+	nArgs := int32(fixed)
+	if t.IsVariadic() {
+		fixed--
+		nArgs = -1
+	}
+	for i := 0; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if i == fixed {
+			in = in.Elem()
+		}
+		if !sqlValueKind(in) {
+			return nil, 0, fmt.Errorf("unsupported argument type %s", in)
+		}
+	}
+	convert := func(args []driver.Value) ([]reflect.Value, error) {
+		if len(args) < fixed || (!t.IsVariadic() && len(args) > fixed) {
+			return nil, fmt.Errorf("function takes %d arguments, got %d", fixed, len(args))
+		}
+		in := make([]reflect.Value, len(args))
+		for i, a := range args {
+			pt := t.In(min(i, t.NumIn()-1))
+			if i >= fixed {
+				pt = pt.Elem()
+			}
+			arg, err := toGo(a, pt)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %w", i+1, err)
+			}
+			in[i] = arg
+		}
+		return in, nil
+	}
+	return convert, nArgs, nil
+}
+
+// adaptAggregate checks an aggregate constructor as go-sqlite3 does, returning a function making
+// a new aggregate for each group and the number of arguments its Step method takes.
+func adaptAggregate(constructor any) (func() (sqlite.AggregateFunction, error), int32, error) {
+	c := reflect.ValueOf(constructor)
+	t := c.Type()
+	switch {
+	case t.Kind() != reflect.Func:
+		return nil, 0, errors.New("not a function")
+	case t.NumIn() != 0:
+		return nil, 0, errors.New("constructor must not have arguments")
+	case t.NumOut() != 1 && t.NumOut() != 2:
+		return nil, 0, errors.New("constructor must return 1 or 2 values")
+	case t.NumOut() == 2 && !t.Out(1).Implements(errorType):
+		return nil, 0, errors.New("second return value must be error")
+	case t.Out(0).Kind() != reflect.Pointer && t.Out(0).Kind() != reflect.Interface:
+		return nil, 0, errors.New("constructor must return a pointer or interface")
+	}
+	step, ok := methodType(t.Out(0), "Step")
+	if !ok {
+		return nil, 0, errors.New("aggregate has no Step method")
+	}
+	if step.NumOut() > 1 || (step.NumOut() == 1 && !step.Out(0).Implements(errorType)) {
+		return nil, 0, errors.New("Step must return nothing or an error")
+	}
+	args, nArgs, err := argConverter(step)
+	if err != nil {
+		return nil, 0, err
+	}
+	done, ok := methodType(t.Out(0), "Done")
+	if !ok {
+		return nil, 0, errors.New("aggregate has no Done method")
+	}
+	if done.NumIn() != 0 {
+		return nil, 0, errors.New("Done must not have arguments")
+	}
+	if err := checkResults(done); err != nil {
+		return nil, 0, err
+	}
+	newAggregate := func() (sqlite.AggregateFunction, error) {
+		out := c.Call(nil)
+		if len(out) == 2 && !out[1].IsNil() {
+			return nil, out[1].Interface().(error)
+		}
+		if out[0].IsNil() {
+			return nil, errors.New("aggregate constructor returned nil")
+		}
+		return &aggregate{step: out[0].MethodByName("Step"), done: out[0].MethodByName("Done"), args: args}, nil
+	}
+	return newAggregate, nArgs, nil
+}
+
+// methodType returns the type of the named method of t without its receiver.
+func methodType(t reflect.Type, name string) (reflect.Type, bool) {
+	m, ok := t.MethodByName(name)
+	if !ok {
+		return nil, false
+	}
+	if t.Kind() == reflect.Interface {
+		return m.Type, true
+	}
+	in := make([]reflect.Type, m.Type.NumIn()-1)
+	for i := range in {
+		in[i] = m.Type.In(i + 1)
+	}
+	out := make([]reflect.Type, m.Type.NumOut())
+	for i := range out {
+		out[i] = m.Type.Out(i)
+	}
+	return reflect.FuncOf(in, out, m.Type.IsVariadic()), true
+}
+
+// aggregate adapts a go-sqlite3 style aggregate to modernc.org/sqlite.
+type aggregate struct {
+	step reflect.Value
+	done reflect.Value
+	args func([]driver.Value) ([]reflect.Value, error)
+}
+
+func (a *aggregate) Step(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error {
+	in, err := a.args(rowArgs)
+	if err != nil {
+		return err
+	}
+	out := a.step.Call(in)
+	if len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
+
+func (a *aggregate) WindowInverse(ctx *sqlite.FunctionContext, rowArgs []driver.Value) error {
+	return errors.New("aggregate can't be used as a window function")
+}
+
+func (a *aggregate) WindowValue(ctx *sqlite.FunctionContext) (driver.Value, error) {
+	return result(a.done.Call(nil))
+}
+
+func (a *aggregate) Final(ctx *sqlite.FunctionContext) {}
+
+// sqlValueKind reports whether values of t convert to and from SQLite values.
+func sqlValueKind(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	}
+	return false
+}
+
+// toGo converts an SQLite value to a Go value of type t.
+func toGo(a driver.Value, t reflect.Type) (reflect.Value, error) {
+	if a == nil {
+		return reflect.Zero(t), nil
+	}
+	if t.Kind() == reflect.Interface {
+		return reflect.ValueOf(&a).Elem(), nil
+	}
+	switch x := a.(type) {
+	case int64:
+		switch t.Kind() {
+		case reflect.Bool:
+			return reflect.ValueOf(x != 0), nil
+		case reflect.String, reflect.Slice:
+			return reflect.Value{}, fmt.Errorf("cannot use integer as %s", t)
+		}
+	case float64:
+		switch t.Kind() {
+		case reflect.Bool, reflect.String, reflect.Slice:
+			return reflect.Value{}, fmt.Errorf("cannot use float as %s", t)
+		}
+	case string:
+		switch t.Kind() {
+		case reflect.String:
+			return reflect.ValueOf(x).Convert(t), nil
+		case reflect.Slice:
+			return reflect.ValueOf([]byte(x)).Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use text as %s", t)
+	case []byte:
+		switch t.Kind() {
+		case reflect.String:
+			return reflect.ValueOf(string(x)).Convert(t), nil
+		case reflect.Slice:
+			return reflect.ValueOf(x).Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use blob as %s", t)
+	}
+	return reflect.ValueOf(a).Convert(t), nil
+}
+
+// toSQL converts a function result to an SQLite value.
+func toSQL(v reflect.Value) driver.Value {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Bool:
+		if v.Bool() {
+			return int64(1)
+		}
+		return int64(0)
+	case reflect.String:
+		return v.String()
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Bytes()
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	}
+	return nil
+}
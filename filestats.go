@@ -0,0 +1,116 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileStats describes the size and contents of a database.
+type FileStats struct {
+	// PageSize is the size of a database page in bytes.
+	PageSize int64
+	// PageCount is the number of pages in the database.
+	PageCount int64
+	// FreelistCount is the number of unused pages, which VACUUM would return to the filesystem.
+	FreelistCount int64
+	// FileSize is the size of the database file in bytes, or zero for an in-memory database.
+	FileSize int64
+	// WALSize is the size of the write-ahead log in bytes, or zero if there is none.
+	WALSize int64
+	// Tables, Indexes, Views and Triggers count the schema objects, leaving out those SQLite and
+	// appdb create for their own use.
+	Tables   int
+	Indexes  int
+	Views    int
+	Triggers int
+}
+
+// FileStats reports the size of the database and the number of objects in its schema.
+func (a *AppDB) FileStats() (*FileStats, error) {
+	return a.FileStatsContext(context.Background())
+}
+
+// FileStatsContext is FileStats with a context.
+func (a *AppDB) FileStatsContext(ctx context.Context) (*FileStats, error) {
+	start := time.Now()
+	s, err := fileStats(ctx, a.DB, a.dsn)
+	a.logOp("file_stats", start, err)
+	return s, err
+}
+
+func fileStats(ctx context.Context, q querier, dbPath string) (*FileStats, error) {
+	s := &FileStats{}
+	for _, p := range []struct {
+		pragma string
+		value  *int64
+	}{
+		{"page_size", &s.PageSize},
+		{"page_count", &s.PageCount},
+		{"freelist_count", &s.FreelistCount},
+	} {
+		if err := q.QueryRowContext(ctx, "PRAGMA "+p.pragma).Scan(p.value); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := q.QueryContext(ctx, `SELECT type, count(*) FROM sqlite_master WHERE name NOT LIKE 'sqlite\_%' ESCAPE '\' AND tbl_name NOT LIKE 'appdb\_%' ESCAPE '\' GROUP BY type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "table":
+			s.Tables = n
+		case "index":
+			s.Indexes = n
+		case "view":
+			s.Views = n
+		case "trigger":
+			s.Triggers = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if isMemoryPath(dbPath) {
+		return s, nil
+	}
+	path := filePath(dbPath)
+	if s.FileSize, err = fileSize(path); err != nil {
+		return nil, err
+	}
+	if s.WALSize, err = fileSize(path + "-wal"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fileSize returns the size of the file at path, or zero if it doesn't exist.
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
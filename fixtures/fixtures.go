@@ -0,0 +1,278 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package fixtures loads known rows into an appdb database, so that tests can start from a known
+// state.
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/AndrewMobbs/appdb"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadError reports a fixture file that couldn't be read or loaded. Table is empty if the failure
+// wasn't in loading a particular table, and Row is the index of the failing row within the table's
+// rows in that file, or -1.
+type LoadError struct {
+	File  string
+	Table string
+	Row   int
+	Err   error
+}
+
+func (e *LoadError) Error() string {
+	switch {
+	case e.Table == "":
+		return fmt.Sprintf("Error %s loading fixtures from %s", e.Err, e.File)
+	case e.Row < 0:
+		return fmt.Sprintf("Error %s loading fixtures for table %s from %s", e.Err, e.Table, e.File)
+	}
+	return fmt.Sprintf("Error %s loading fixture row %d of table %s from %s", e.Err, e.Row, e.Table, e.File)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Load replaces the rows of the tables named in the fixture files with those the files give. Each
+// file, YAML (".yml" or ".yaml") or JSON (".json"), maps table names to lists of rows, each a map of
+// column names to values:
+//
+//	users:
+//	  - id: 1
+//	    name: alice
+//	posts:
+//	  - id: 10
+//	    user_id: 1
+//	    tags: [go, sqlite]
+//
+// Lists and maps within a row are stored as JSON text. Everything is done in one transaction:
+// the existing rows of each table are deleted, child tables first, and the fixture rows inserted
+// with parent tables first, following the foreign keys between them. Foreign key checks are
+// deferred to the commit, so rows may refer to each other in cycles.
+// ctx -- context for the transaction
+// db -- database to load the fixtures into
+// paths -- fixture files, loaded in order
+func Load(ctx context.Context, db *appdb.AppDB, paths ...string) error {
+	var files []file
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return &LoadError{File: p, Row: -1, Err: err}
+		}
+		f, err := parse(p, data)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	return load(ctx, db, files)
+}
+
+// LoadFS is Load reading the fixture files matching the patterns from fsys, such as an embed.FS.
+// Files matching a pattern are loaded in lexical order.
+// ctx -- context for the transaction
+// db -- database to load the fixtures into
+// fsys -- file system holding the fixture files
+// patterns -- fs.Glob patterns naming the files
+func LoadFS(ctx context.Context, db *appdb.AppDB, fsys fs.FS, patterns ...string) error {
+	var files []file
+	for _, pattern := range patterns {
+		names, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return &LoadError{File: pattern, Row: -1, Err: err}
+		}
+		for _, name := range names {
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return &LoadError{File: name, Row: -1, Err: err}
+			}
+			f, err := parse(name, data)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+		}
+	}
+	return load(ctx, db, files)
+}
+
+// file is the parsed contents of one fixture file.
+type file struct {
+	name   string
+	tables map[string][]map[string]any
+}
+
+// parse decodes a fixture file according to its extension.
+func parse(name string, data []byte) (file, error) {
+	f := file{name: name}
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &f.tables)
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&f.tables)
+	default:
+		err = fmt.Errorf("unknown fixture file type %q", filepath.Ext(name))
+	}
+	if err != nil {
+		return f, &LoadError{File: name, Row: -1, Err: err}
+	}
+	return f, nil
+}
+
+// load deletes and inserts the rows of the files' tables in one transaction.
+func load(ctx context.Context, db *appdb.AppDB, files []file) error {
+	var tables []string
+	for _, f := range files {
+		for t := range f.tables {
+			if !slices.Contains(tables, t) {
+				tables = append(tables, t)
+			}
+		}
+	}
+	schema, err := db.SchemaContext(ctx)
+	if err != nil {
+		return err
+	}
+	order := insertOrder(schema, tables)
+	return db.WithTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = ON"); err != nil {
+			return err
+		}
+		for i := len(order) - 1; i >= 0; i-- {
+			if _, err := appdb.Delete(order[i]).Exec(ctx, tx); err != nil {
+				return &LoadError{File: fileWith(files, order[i]), Table: order[i], Row: -1, Err: err}
+			}
+		}
+		for _, t := range order {
+			for _, f := range files {
+				for i, row := range f.tables[t] {
+					if err := insert(ctx, tx, t, row); err != nil {
+						return &LoadError{File: f.name, Table: t, Row: i, Err: err}
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// insertOrder sorts tables so that each comes after the tables its foreign keys refer to, where
+// the references don't form a cycle. Tables are otherwise in name order.
+func insertOrder(schema *appdb.SchemaInfo, tables []string) []string {
+	parents := map[string][]string{}
+	for _, t := range tables {
+		info := schema.Table(t)
+		if info == nil {
+			continue
+		}
+		for _, fk := range info.ForeignKeys {
+			if fk.Table != t && slices.Contains(tables, fk.Table) && !slices.Contains(parents[t], fk.Table) {
+				parents[t] = append(parents[t], fk.Table)
+			}
+		}
+	}
+	remaining := slices.Clone(tables)
+	sort.Strings(remaining)
+	var order []string
+	for len(remaining) > 0 {
+		// Take the first table whose parents are all placed, or, if there is a cycle, the first
+		// table left.
+		next := 0
+		for i, t := range remaining {
+			placed := true
+			for _, p := range parents[t] {
+				if !slices.Contains(order, p) {
+					placed = false
+					break
+				}
+			}
+			if placed {
+				next = i
+				break
+			}
+		}
+		order = append(order, remaining[next])
+		remaining = slices.Delete(remaining, next, next+1)
+	}
+	return order
+}
+
+// fileWith returns the name of the first file with rows for table.
+func fileWith(files []file, table string) string {
+	for _, f := range files {
+		if _, ok := f.tables[table]; ok {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// insert inserts one fixture row.
+func insert(ctx context.Context, tx *sql.Tx, table string, row map[string]any) error {
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	values := make([]any, len(columns))
+	for i, c := range columns {
+		v, err := value(row[c])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c, err)
+		}
+		values[i] = v
+	}
+	if len(columns) == 0 {
+		_, err := tx.ExecContext(ctx, "INSERT INTO "+quote(table)+" DEFAULT VALUES")
+		return err
+	}
+	_, err := appdb.Insert(table).Columns(columns...).Values(values...).Exec(ctx, tx)
+	return err
+}
+
+// value converts a decoded fixture value to one the driver accepts.
+func value(v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	return v, nil
+}
+
+// quote quotes an identifier.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
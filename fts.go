@@ -0,0 +1,194 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// FullText is an FTS5 full-text index of text columns of a content table, kept up to date by
+// triggers on that table. The go-sqlite3 driver needs the sqlite_fts5 build tag for FTS5.
+type FullText struct {
+	db    *AppDB
+	table string
+	// Limit is the most results Search returns, or all of them if zero or less.
+	Limit int
+	// Open and Close surround the matching terms in snippets.
+	Open, Close string
+	// Tokens is the most tokens in a snippet, at most 64.
+	Tokens int
+}
+
+// SearchResult is a row matching a full-text query.
+type SearchResult struct {
+	// RowID is the rowid of the matching row of the content table.
+	RowID int64
+	// Rank is the BM25 score of the match, lower for better matches.
+	Rank float64
+	// Snippet is text from the best matching column with the matching terms marked.
+	Snippet string
+}
+
+// CreateFullText creates the FTS5 table named table indexing columns of the content table, with
+// triggers keeping it in step as content rows are inserted, updated and deleted, and indexes the
+// existing rows. The content table must have a rowid, so it can't be WITHOUT ROWID. If the index
+// already exists it is left as it is.
+// ctx -- context for the statements
+// table -- name of the full-text table
+// content -- name of the table to index
+// columns -- text columns of content to index
+func (a *AppDB) CreateFullText(ctx context.Context, table, content string, columns ...string) (*FullText, error) {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			if err := createFullText(ctx, tx, table, content, columns); err != nil {
+				return err
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("create_full_text", start, err, slog.String("table", table), slog.String("content", content))
+	if err != nil {
+		return nil, err
+	}
+	return a.FullText(table), nil
+}
+
+// FullText returns the full-text index table created earlier by CreateFullText.
+// table -- name of the full-text table
+func (a *AppDB) FullText(table string) *FullText {
+	return &FullText{db: a, table: table, Limit: 50, Open: "[", Close: "]", Tokens: 16}
+}
+
+func createFullText(ctx context.Context, tx *sql.Tx, table, content string, columns []string) error {
+	if len(columns) == 0 {
+		return fmt.Errorf("full-text index %s has no columns", table)
+	}
+	exists, err := tableExists(ctx, tx, table)
+	if err != nil || exists {
+		return err
+	}
+	fts := quoteIdent(table)
+	cols := strings.Join(quoteIdents(columns), ", ")
+	values := func(row string) string {
+		v := make([]string, len(columns))
+		for i, c := range columns {
+			v[i] = row + "." + quoteIdent(c)
+		}
+		return strings.Join(v, ", ")
+	}
+	insert := fmt.Sprintf("INSERT INTO %s(rowid, %s) VALUES (new.rowid, %s);", fts, cols, values("new"))
+	remove := fmt.Sprintf("INSERT INTO %s(%s, rowid, %s) VALUES ('delete', old.rowid, %s);", fts, fts, cols, values("old"))
+	statements := []string{
+		fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(%s, content='%s', content_rowid='rowid')",
+			fts, cols, strings.ReplaceAll(content, "'", "''")),
+	}
+	statements = append(statements, syncTriggers(table, content, insert, remove)...)
+	statements = append(statements, fmt.Sprintf("INSERT INTO %s(%s) VALUES ('rebuild')", fts, fts))
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the rows matching query, in FTS5 query syntax, best matches first.
+// ctx -- context for the query
+// query -- full-text query, such as "sqlite AND (search OR index)"
+func (f *FullText) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	start := time.Now()
+	results, err := f.search(ctx, query)
+	f.db.logOp("search", start, err, slog.String("table", f.table), slog.Int("results", len(results)))
+	return results, err
+}
+
+func (f *FullText) search(ctx context.Context, query string) ([]SearchResult, error) {
+	fts := quoteIdent(f.table)
+	limit := -1
+	if f.Limit > 0 {
+		limit = f.Limit
+	}
+	rows, err := f.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT rowid, rank, snippet(%s, -1, ?, ?, '…', ?) FROM %s WHERE %s MATCH ? ORDER BY rank LIMIT ?", fts, fts, fts),
+		f.Open, f.Close, min(max(f.Tokens, 1), 64), query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.RowID, &r.Rank, &r.Snippet); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// Rebuild reindexes every row of the content table, for example after changing it with the
+// triggers dropped.
+// ctx -- context for the statement
+func (f *FullText) Rebuild(ctx context.Context) error {
+	start := time.Now()
+	fts := quoteIdent(f.table)
+	_, err := f.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s(%s) VALUES ('rebuild')", fts, fts))
+	f.db.logOp("rebuild_full_text", start, err, slog.String("table", f.table))
+	return err
+}
+
+// Drop removes the full-text table and its triggers, leaving the content table as it is.
+// ctx -- context for the statements
+func (f *FullText) Drop(ctx context.Context) error {
+	start := time.Now()
+	err := f.db.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, f.db.DB, func(tx *sql.Tx) error {
+			if err := dropIndexTable(ctx, tx, f.table); err != nil {
+				return err
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	f.db.logOp("drop_full_text", start, err, slog.String("table", f.table))
+	return err
+}
+
+// syncTriggers returns the statements creating the triggers that keep the virtual table indexing
+// a content table in step with it, running insert for each new row and remove for each old one.
+func syncTriggers(table, content, insert, remove string) []string {
+	triggers := []Trigger{
+		{Name: table + "_ai", Table: content, Timing: TriggerAfter, Event: TriggerInsert, Body: []string{insert}},
+		{Name: table + "_ad", Table: content, Timing: TriggerAfter, Event: TriggerDelete, Body: []string{remove}},
+		{Name: table + "_au", Table: content, Timing: TriggerAfter, Event: TriggerUpdate, Body: []string{remove, insert}},
+	}
+	statements := make([]string, len(triggers))
+	for i, t := range triggers {
+		statements[i] = t.SQL()
+	}
+	return statements
+}
+
+// dropIndexTable drops a virtual table indexing a content table and the triggers maintaining it.
+func dropIndexTable(ctx context.Context, tx *sql.Tx, table string) error {
+	for _, suffix := range []string{"_ai", "_ad", "_au"} {
+		if _, err := tx.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+quoteIdent(table+suffix)); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+quoteIdent(table))
+	return err
+}
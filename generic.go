@@ -0,0 +1,71 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Querier runs queries. *AppDB, *sql.DB, *sql.Tx and *sql.Conn all satisfy it.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// Query runs a query and returns its rows as values of type T, which is matched to the columns as
+// for Select: a struct or pointer to one with fields matched by `db` tag or name, or any type
+// rows.Scan accepts for single-column results.
+// ctx -- context for the query
+// db -- database or transaction to query
+// query -- SQL query to run
+// args -- arguments for placeholders in query
+func Query[T any](ctx context.Context, db Querier, query string, args ...any) ([]T, error) {
+	var out []T
+	if err := selectRows(ctx, db, &out, query, args); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QueryOne runs a query and returns its first row as a value of type T, matched as for Query.
+// It returns sql.ErrNoRows if the query has no results.
+func QueryOne[T any](ctx context.Context, db Querier, query string, args ...any) (T, error) {
+	var out T
+	err := getRow(ctx, db, &out, query, args)
+	return out, err
+}
+
+// QueryFunc runs a query and converts each row to a T with fn, for results that don't map
+// directly onto a type.
+// ctx -- context for the query
+// db -- database or transaction to query
+// fn -- function scanning the current row
+// query -- SQL query to run
+// args -- arguments for placeholders in query
+func QueryFunc[T any](ctx context.Context, db Querier, fn func(rows *sql.Rows) (T, error), query string, args ...any) ([]T, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []T
+	for rows.Next() {
+		v, err := fn(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
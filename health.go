@@ -0,0 +1,115 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// HealthReport is the result of a health check.
+type HealthReport struct {
+	// Healthy is true if every check passed.
+	Healthy bool
+	// ReadOnly is true if the database is open read-only, in which case writing isn't checked.
+	ReadOnly bool
+	// Checks are the checks run, in order.
+	Checks []HealthCheck
+}
+
+// HealthCheck is the outcome of one part of a health check.
+type HealthCheck struct {
+	// Name is "ping", "write" or "quick_check".
+	Name     string
+	Duration time.Duration
+	// Err is the reason the check failed, or nil if it passed.
+	Err error
+}
+
+// Err returns the errors of the failed checks joined together, or nil if the database is healthy.
+func (r *HealthReport) Err() error {
+	var errs []error
+	for _, c := range r.Checks {
+		errs = append(errs, c.Err)
+	}
+	return errors.Join(errs...)
+}
+
+// Healthy checks that the database can be used, for an application's readiness probe. It pings
+// the database, checks that it can be written unless it is open read-only, and, if quickCheck is
+// set, runs PRAGMA quick_check. The write check takes the write lock briefly and changes nothing.
+// Checks stop at the first failure.
+// ctx -- context for the checks, whose deadline bounds how long they may take
+// quickCheck -- also check the database structure, which reads the whole file
+func (a *AppDB) Healthy(ctx context.Context, quickCheck bool) *HealthReport {
+	start := time.Now()
+	r := &HealthReport{}
+	run := func(name string, check func() error) bool {
+		t := time.Now()
+		err := check()
+		r.Checks = append(r.Checks, HealthCheck{name, time.Since(t), err})
+		return err == nil
+	}
+	ok := run("ping", func() error {
+		return a.PingContext(ctx)
+	})
+	if ok {
+		var err error
+		r.ReadOnly, err = a.readOnly(ctx)
+		if err != nil {
+			ok = run("write", func() error { return err })
+		} else if !r.ReadOnly {
+			ok = run("write", func() error {
+				return checkWritable(ctx, a.DB)
+			})
+		}
+	}
+	if ok && quickCheck {
+		ok = run("quick_check", func() error {
+			return checkIntegrity(ctx, a.DB, true)
+		})
+	}
+	r.Healthy = ok
+	a.logOp("health", start, r.Err(), slog.Bool("quick", quickCheck))
+	return r
+}
+
+// readOnly reports whether the database was opened read-only, either with a "mode=ro" or
+// "immutable=1" URI filename or with PRAGMA query_only.
+func (a *AppDB) readOnly(ctx context.Context) (bool, error) {
+	q := uriQuery(a.dsn)
+	if q.Get("mode") == "ro" || q.Get("immutable") == "1" {
+		return true, nil
+	}
+	var queryOnly bool
+	err := a.DB.QueryRowContext(ctx, "PRAGMA query_only").Scan(&queryOnly)
+	return queryOnly, err
+}
+
+// checkWritable takes the write lock by rewriting the user_version header field with its current
+// value, then rolls back.
+func checkWritable(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	version, err := readPragmaUint32(ctx, tx, "user_version")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", int32(version)))
+	return err
+}
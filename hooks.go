@@ -0,0 +1,271 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// changeBuffer is the number of change events a subscriber can fall behind before it misses some.
+const changeBuffer = 256
+
+// ChangeEvent is a row inserted, updated or deleted by a committed transaction.
+type ChangeEvent struct {
+	Op ChangeOp
+	// Database is the schema name of the database holding the table, "main" unless attached.
+	Database string
+	Table    string
+	RowID    int64
+}
+
+// connHooks passes the changes committed on every connection of a database to subscribers, and
+// calls the commit and rollback callbacks.
+type connHooks struct {
+	mu          sync.Mutex
+	subscribers map[chan ChangeEvent]string // channel to table, or "" for all tables
+	buses       map[*ChangeBus]bool
+	onCommit    callbacks
+	onRollback  callbacks
+	closed      bool
+	active      atomic.Bool // whether there are subscribers or buses, checked before recording changes
+}
+
+func newConnHooks() *connHooks {
+	return &connHooks{subscribers: map[chan ChangeEvent]string{}, buses: map[*ChangeBus]bool{}}
+}
+
+// Subscribe returns a channel receiving an event for each row of table changed by a committed
+// transaction, or for the rows of every table if table is empty. Changes to temporary tables
+// aren't sent, nor, as SQLite doesn't report them, are changes to WITHOUT ROWID tables, rows
+// replaced by ON CONFLICT REPLACE, or rows removed by a DELETE without a WHERE clause.
+// Events are sent without blocking the writer, so a subscriber that falls more than 256 events
+// behind misses events. The channel is closed by Unsubscribe or when the database is closed.
+// The driver's hooks are only installed on a connection once there is a subscriber, when it next
+// runs a statement, so changes made before then, even in a transaction still under way, aren't
+// sent. The pure Go driver, and drivers registered with RegisterDriver other than go-sqlite3, have
+// no update hook, so with them no events are sent.
+// table -- name of the table to watch, or empty for all tables
+func (a *AppDB) Subscribe(table string) <-chan ChangeEvent {
+	h := a.cfg.extensions.hooks
+	ch := make(chan ChangeEvent, changeBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subscribers[ch] = table
+	h.updateActive()
+	return ch
+}
+
+// Unsubscribe stops events being sent to a channel returned by Subscribe and closes it.
+// ch -- channel to stop
+func (a *AppDB) Unsubscribe(ch <-chan ChangeEvent) {
+	h := a.cfg.extensions.hooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subscribers {
+		if c == ch {
+			delete(h.subscribers, c)
+			close(c)
+		}
+	}
+	h.updateActive()
+}
+
+// OnCommit calls fn each time a transaction commits, on any connection, including each statement
+// run outside an explicit transaction that changes the database. fn runs on the committing
+// goroutine once the commit has completed, while it still holds the connection, so it must be
+// quick and must not use the database; it suits invalidating caches. If the commit fails, the
+// OnRollback callbacks are called instead. As for Subscribe, commits of transactions under way
+// when fn is added may be missed, and the pure Go driver and other drivers registered with
+// RegisterDriver have no commit hook, so with them fn is never called.
+// The function returned removes the callback.
+// fn -- function to call after each commit
+func (a *AppDB) OnCommit(fn func()) (remove func()) {
+	return a.cfg.extensions.hooks.onCommit.add(fn)
+}
+
+// OnRollback calls fn each time a transaction rolls back, on any connection, under the same
+// conditions as OnCommit. The function returned removes the callback.
+// fn -- function to call after each rollback
+func (a *AppDB) OnRollback(fn func()) (remove func()) {
+	return a.cfg.extensions.hooks.onRollback.add(fn)
+}
+
+// callbacks is a set of functions called by a hook.
+type callbacks struct {
+	mu     sync.Mutex
+	fns    map[int]func()
+	nextID int
+	count  atomic.Int32 // number of functions, checked before installing the hooks
+}
+
+// add adds fn to the set, returning the function removing it.
+func (c *callbacks) add(fn func()) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fns == nil {
+		c.fns = map[int]func(){}
+	}
+	id := c.nextID
+	c.nextID++
+	c.fns[id] = fn
+	c.count.Store(int32(len(c.fns)))
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.fns, id)
+		c.count.Store(int32(len(c.fns)))
+	}
+}
+
+// call calls the functions in the set, outside the lock so that they may add or remove callbacks.
+func (c *callbacks) call() {
+	c.mu.Lock()
+	fns := make([]func(), 0, len(c.fns))
+	for _, fn := range c.fns {
+		fns = append(fns, fn)
+	}
+	c.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// wanted reports whether there is anything to tell of changes, commits or rollbacks, so that the
+// driver's hooks need installing on connections.
+func (h *connHooks) wanted() bool {
+	return h.active.Load() || h.onCommit.count.Load() > 0 || h.onRollback.count.Load() > 0
+}
+
+// updateActive records whether changes need recording. h.mu must be held.
+func (h *connHooks) updateActive() {
+	h.active.Store(len(h.subscribers) > 0 || len(h.buses) > 0)
+}
+
+// close closes every subscriber's channel and every bus.
+func (h *connHooks) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subscribers {
+		close(c)
+	}
+	for b := range h.buses {
+		b.closeSubscribers()
+	}
+	h.subscribers = nil
+	h.buses = nil
+	h.closed = true
+	h.active.Store(false)
+}
+
+// publish sends the changes committed by a transaction to the subscribers.
+func (h *connHooks) publish(events []ChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for b := range h.buses {
+		b.publish(events)
+	}
+	for c, table := range h.subscribers {
+		for _, e := range events {
+			if table != "" && table != e.Table {
+				continue
+			}
+			select {
+			case c <- e:
+			default:
+			}
+		}
+	}
+}
+
+// connChanges holds the changes made on one connection until its transaction ends, when it calls
+// the commit or rollback callbacks. Its update, savepoint, commit and rollback methods are called
+// by the driver's hooks, which run on the connection's goroutine inside SQLite, so they must not
+// use the database.
+type connChanges struct {
+	hooks      *connHooks
+	pending    []ChangeEvent
+	savepoints []savepointMark
+	// committing is set by the commit hook, which runs before the commit is complete and may be
+	// followed by a rollback if it fails.
+	committing bool
+}
+
+// savepointMark is an open savepoint and the number of changes pending when it was opened.
+type savepointMark struct {
+	name    string
+	pending int
+}
+
+func (c *connChanges) update(op ChangeOp, database, table string, rowID int64) {
+	if database == "temp" || !c.hooks.active.Load() {
+		return
+	}
+	c.pending = append(c.pending, ChangeEvent{op, database, table, rowID})
+}
+
+// savepoint follows the savepoints opened, released and rolled back to, so that the changes
+// undone by ROLLBACK TO are dropped. op is "BEGIN", "RELEASE" or "ROLLBACK", as SQLite reports
+// savepoint statements to the authorizer.
+func (c *connChanges) savepoint(op, name string) {
+	if op == "BEGIN" {
+		c.savepoints = append(c.savepoints, savepointMark{name, len(c.pending)})
+		return
+	}
+	// Savepoint names are case-insensitive, and the most recent of a name is the one used.
+	i := len(c.savepoints) - 1
+	for i >= 0 && !strings.EqualFold(c.savepoints[i].name, name) {
+		i--
+	}
+	if i < 0 {
+		return
+	}
+	switch op {
+	case "RELEASE":
+		c.savepoints = c.savepoints[:i]
+	case "ROLLBACK":
+		// ROLLBACK TO leaves the savepoint open.
+		c.pending = c.pending[:c.savepoints[i].pending]
+		c.savepoints = c.savepoints[:i+1]
+	}
+}
+
+func (c *connChanges) commit() {
+	c.committing = true
+	c.savepoints = nil
+}
+
+func (c *connChanges) rollback() {
+	c.pending = nil
+	c.savepoints = nil
+	c.committing = false
+	c.hooks.onRollback.call()
+}
+
+// ended is called after each statement on the connection returns, with whether the connection
+// is now outside a transaction. Once a commit has completed it publishes the changes and calls
+// the commit callbacks.
+func (c *connChanges) ended(autocommit bool) {
+	if !c.committing || !autocommit {
+		return
+	}
+	c.committing = false
+	if len(c.pending) > 0 {
+		c.hooks.publish(c.pending)
+		c.pending = nil
+	}
+	c.hooks.onCommit.call()
+}
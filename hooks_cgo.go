@@ -0,0 +1,173 @@
+//go:build cgo && !appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// hookedConn is a go-sqlite3 connection that installs the driver's hooks before the first
+// statement run once they are wanted, and then tells its connChanges when each statement returns,
+// as SQLite's commit hook runs before the commit is complete. Rows tell it when they are closed,
+// and transactions when they end.
+type hookedConn struct {
+	*sqlite3.SQLiteConn
+	changes   *connChanges
+	installed bool
+}
+
+// sqliteConn returns the go-sqlite3 connection of a driver connection.
+func sqliteConn(dc any) (*sqlite3.SQLiteConn, bool) {
+	if h, ok := dc.(*hookedConn); ok {
+		return h.SQLiteConn, true
+	}
+	c, ok := dc.(*sqlite3.SQLiteConn)
+	return c, ok
+}
+
+// install registers the update, commit and rollback hooks and the authorizer on the connection
+// if anything wants them and they aren't registered already. It runs on the goroutine using the
+// connection, before a statement.
+func (c *hookedConn) install() {
+	if c.installed || !c.changes.hooks.wanted() {
+		return
+	}
+	c.installed = true
+	changes := c.changes
+	c.RegisterUpdateHook(func(op int, database string, table string, rowID int64) {
+		switch op {
+		case sqlite3.SQLITE_INSERT:
+			changes.update(ChangeInsert, database, table, rowID)
+		case sqlite3.SQLITE_UPDATE:
+			changes.update(ChangeUpdate, database, table, rowID)
+		case sqlite3.SQLITE_DELETE:
+			changes.update(ChangeDelete, database, table, rowID)
+		}
+	})
+	// SQLite has no savepoint hook, but reports savepoint statements to the authorizer as they
+	// are prepared, which is just before they run.
+	c.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
+		if action == sqlite3.SQLITE_SAVEPOINT {
+			changes.savepoint(arg1, arg2)
+		}
+		return sqlite3.SQLITE_OK
+	})
+	c.RegisterCommitHook(func() int {
+		changes.commit()
+		return 0
+	})
+	c.RegisterRollbackHook(changes.rollback)
+}
+
+func (c *hookedConn) ended() {
+	if c.installed {
+		c.changes.ended(c.AutoCommit())
+	}
+}
+
+func (c *hookedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.install()
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	c.ended()
+	return res, err
+}
+
+func (c *hookedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.install()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	return c.hookRows(rows, err)
+}
+
+func (c *hookedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.install()
+	st, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := st.(*sqlite3.SQLiteStmt)
+	if !ok {
+		return st, nil
+	}
+	return &hookedStmt{s, c}, nil
+}
+
+func (c *hookedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.install()
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &hookedTx{tx, c}, nil
+}
+
+// hookRows wraps the rows of a query so that closing them ends the statement.
+func (c *hookedConn) hookRows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		c.ended()
+		return nil, err
+	}
+	r, ok := rows.(*sqlite3.SQLiteRows)
+	if !ok {
+		return rows, nil
+	}
+	return &hookedRows{r, c}, nil
+}
+
+type hookedStmt struct {
+	*sqlite3.SQLiteStmt
+	conn *hookedConn
+}
+
+func (s *hookedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	s.conn.install()
+	res, err := s.SQLiteStmt.ExecContext(ctx, args)
+	s.conn.ended()
+	return res, err
+}
+
+func (s *hookedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	s.conn.install()
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	return s.conn.hookRows(rows, err)
+}
+
+type hookedRows struct {
+	*sqlite3.SQLiteRows
+	conn *hookedConn
+}
+
+func (r *hookedRows) Close() error {
+	err := r.SQLiteRows.Close()
+	r.conn.ended()
+	return err
+}
+
+type hookedTx struct {
+	driver.Tx
+	conn *hookedConn
+}
+
+func (t *hookedTx) Commit() error {
+	err := t.Tx.Commit()
+	t.conn.ended()
+	return err
+}
+
+func (t *hookedTx) Rollback() error {
+	err := t.Tx.Rollback()
+	t.conn.ended()
+	return err
+}
@@ -0,0 +1,77 @@
+//go:build cgo && !appdb_purego
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);"})
+	// The connections opened by InitAppDB were opened with nothing subscribed.
+	ch := db.Subscribe("t")
+	var commits int
+	remove := db.OnCommit(func() { commits++ })
+	defer remove()
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (1, 'a')"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.WithTx(ctx, func(tx *sql.Tx) error {
+		for _, s := range []string{
+			"INSERT INTO t VALUES (2, 'b')",
+			"SAVEPOINT s",
+			"INSERT INTO t VALUES (3, 'c')",
+			"ROLLBACK TO s",
+			"RELEASE s",
+			"UPDATE t SET v = 'x' WHERE id = 1",
+		} {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChangeEvent{
+		{ChangeInsert, "main", "t", 1},
+		{ChangeInsert, "main", "t", 2},
+		{ChangeUpdate, "main", "t", 1},
+	}
+	var got []ChangeEvent
+	for len(got) < len(want) {
+		select {
+		case e := <-ch:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if commits != 2 {
+		t.Errorf("commits = %d, want 2", commits)
+	}
+	db.Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("channel open after Unsubscribe")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+)
+
+// WithApplicationID records the database's identity in PRAGMA application_id, as a 32-bit hash of
+// the app name, and the schema version as a plain number in PRAGMA user_version. By default both
+// are packed together into user_version. Databases using the default layout are converted to the
+// application_id layout the first time they are opened with this option.
+func WithApplicationID() Option {
+	return func(c *config) {
+		c.applicationID = true
+	}
+}
+
+// getApplicationID returns the "application_id" value for a given app name: the first four bytes
+// of the SHA256 hash of the app name.
+func getApplicationID(appName string) int32 {
+	sum := sha256.Sum256([]byte(appName))
+	return int32(binary.LittleEndian.Uint32(sum[:4]))
+}
+
+// versionStatements returns the PRAGMA statements that record the app identity and schema version.
+func versionStatements(appName string, schemaVersion uint8, applicationID bool) []string {
+	if applicationID {
+		return []string{
+			fmt.Sprintf("PRAGMA application_id = %d ;", getApplicationID(appName)),
+			fmt.Sprintf("PRAGMA user_version = %d ;", schemaVersion),
+		}
+	}
+	return []string{fmt.Sprintf("PRAGMA user_version = %d ;", int32(getUserVersion(appName, schemaVersion)))}
+}
+
+// readPragmaUint32 reads a 32-bit header pragma. SQLite reports these as signed integers.
+func readPragmaUint32(ctx context.Context, db querier, pragma string) (uint32, error) {
+	var v int64
+	if err := db.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&v); err != nil {
+		return 0, err
+	}
+	return uint32(v), nil
+}
+
+// readSchemaVersion reads the schema version of the named database, "main" or an attached one,
+// checking that it belongs to appName. convert reports that the application_id layout was asked
+// for but the database uses the default layout, and so needs converting.
+func readSchemaVersion(ctx context.Context, db querier, schema string, appName string, applicationID bool) (version uint8, convert bool, err error) {
+	user_version, err := readPragmaUint32(ctx, db, quoteIdent(schema)+".user_version")
+	if err != nil {
+		return 0, false, err
+	}
+	packedId := user_version & 0x00ffffff
+	expectedPackedId := getUserVersion(appName, 0) & 0x00ffffff
+	if !applicationID {
+		if packedId != expectedPackedId {
+			return 0, false, &AppIdError{packedId, expectedPackedId}
+		}
+		return uint8(user_version >> 24), false, nil
+	}
+
+	appId, err := readPragmaUint32(ctx, db, quoteIdent(schema)+".application_id")
+	if err != nil {
+		return 0, false, err
+	}
+	expectedId := uint32(getApplicationID(appName))
+	switch {
+	case appId == expectedId:
+		if user_version > 0xff {
+			return 0, false, fmt.Errorf("Invalid schema version %d in user_version", user_version)
+		}
+		return uint8(user_version), false, nil
+	case appId == 0 && packedId == expectedPackedId:
+		return uint8(user_version >> 24), true, nil
+	}
+	return 0, false, &AppIdError{appId, expectedId}
+}
+
+// currentSchemaVersion reads the schema version of the database, checking that it belongs to
+// appName and converting it to the application_id layout if that was asked for.
+func currentSchemaVersion(ctx context.Context, db *sql.DB, appName string, applicationID bool) (uint8, error) {
+	version, convert, err := readSchemaVersion(ctx, db, "main", appName, applicationID)
+	if err != nil || !convert {
+		return version, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, stmt := range versionStatements(appName, version, true) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return version, tx.Commit()
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type ImportError struct {
+	Statement string
+	Err       error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("Error %s importing statement %s", e.Err, e.Statement)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ImportDump runs an SQL script, such as one written by Dump, in a single transaction. Statements
+// may span lines and string literals may contain semicolons. The script's own BEGIN and COMMIT
+// statements are skipped, and foreign keys are only checked at the end, so a failing script
+// leaves the database unchanged. A dump of a whole database is best loaded with InitFromDump,
+// since its tables will already exist in an initialised database.
+// r -- source of the SQL script
+func (a *AppDB) ImportDump(r io.Reader) error {
+	return a.ImportDumpContext(context.Background(), r)
+}
+
+// ImportDumpContext is ImportDump with a context.
+func (a *AppDB) ImportDumpContext(ctx context.Context, r io.Reader) error {
+	start := time.Now()
+	n, err := importScript(ctx, a.DB, r)
+	a.logOp("import_dump", start, err, slog.Int("statements", n))
+	return err
+}
+
+// InitFromDump creates a database at dbPath from an SQL script written by Dump, then checks that
+// it carries the expected app name and schema version. dbPath must not already exist; a database
+// that fails to load or validate is removed.
+// dbPath -- the filesystem location of the database file
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema in use (8-bit integer, used to validate database)
+// r -- source of the SQL script
+// opts -- options configuring the database connection.
+func InitFromDump(dbPath string, appName string, schemaVersion uint8, r io.Reader, opts ...Option) (*AppDB, error) {
+	return InitFromDumpContext(context.Background(), dbPath, appName, schemaVersion, r, opts...)
+}
+
+// InitFromDumpContext is InitFromDump with a context.
+func InitFromDumpContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, r io.Reader, opts ...Option) (*AppDB, error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	if !isMemoryPath(dbPath) {
+		if _, err := os.Stat(filePath(dbPath)); !os.IsNotExist(err) {
+			return nil, &os.PathError{Op: "init from dump", Path: filePath(dbPath), Err: os.ErrExist}
+		}
+		if err := createDBFile(filePath(dbPath), cfg); err != nil {
+			return nil, err
+		}
+	}
+	db, err := openAppDBNoValidate(ctx, dbPath, cfg, true)
+	if err == nil {
+		_, err = importScript(ctx, db, r)
+		if err == nil {
+			err = verifyCreatePragmas(ctx, db, cfg)
+		}
+		if err == nil {
+			err = validateDB(ctx, db, appName, schemaVersion, cfg.applicationID)
+		}
+		if err == nil && cfg.schemaChecksum {
+			err = verifySchemaChecksum(ctx, db)
+		}
+		if err == nil {
+			err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+		}
+		if err != nil {
+			db.Close()
+		}
+	}
+	logEvent(cfg.logger, "init_from_dump", dbPath, appName, schemaVersion, start, err, cfg.logFields()...)
+	if err != nil {
+		if !isMemoryPath(dbPath) {
+			os.Remove(filePath(dbPath))
+		}
+		return nil, err
+	}
+	return newAppDB(db, dbPath, appName, schemaVersion, cfg).startBackground(), nil
+}
+
+// importScript runs the statements of the script read from r in one transaction, returning how
+// many were run.
+func importScript(ctx context.Context, db *sql.DB, r io.Reader) (int, error) {
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "PRAGMA defer_foreign_keys = ON"); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, stmt := range SplitStatements(string(script)) {
+		switch firstKeyword(stmt) {
+		case "BEGIN", "COMMIT", "END", "ROLLBACK":
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return n, &ImportError{stmt, err}
+		}
+		n++
+	}
+	return n, tx.Commit()
+}
+
+// firstKeyword returns the first word of a statement in upper case, skipping leading comments.
+func firstKeyword(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "--"):
+			i := strings.IndexByte(stmt, '\n')
+			if i < 0 {
+				return ""
+			}
+			stmt = stmt[i+1:]
+		case strings.HasPrefix(stmt, "/*"):
+			i := strings.Index(stmt, "*/")
+			if i < 0 {
+				return ""
+			}
+			stmt = stmt[i+2:]
+		default:
+			end := strings.IndexFunc(stmt, func(c rune) bool { return !unicode.IsLetter(c) })
+			if end < 0 {
+				end = len(stmt)
+			}
+			return strings.ToUpper(stmt[:end])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportDump(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT);"})
+	script := `-- notes
+BEGIN TRANSACTION;
+INSERT INTO notes VALUES (1, 'one; two');
+INSERT INTO notes VALUES (2,
+  'multi
+line');
+COMMIT;
+`
+	if err := db.ImportDumpContext(ctx, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"one; two", "multi\nline"}
+	if got := queryStrings(t, db, "SELECT body FROM notes ORDER BY id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("bodies = %q, want %q", got, want)
+	}
+
+	var importErr *ImportError
+	err := db.ImportDumpContext(ctx, strings.NewReader("INSERT INTO notes VALUES (3, 'three');\nINSERT INTO missing VALUES (1);"))
+	if !errors.As(err, &importErr) || !strings.Contains(importErr.Statement, "missing") {
+		t.Fatalf("error = %v, want an ImportError for the missing table", err)
+	}
+	if got := queryStrings(t, db, "SELECT body FROM notes WHERE id = 3"); len(got) != 0 {
+		t.Error("failed script left rows behind")
+	}
+}
+
+func TestInitFromDumpValidates(t *testing.T) {
+	db := newTestDB(t, []string{"CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT);"})
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := InitFromDump(path, "other", 1, bytes.NewReader(dump.Bytes())); err == nil {
+		t.Fatal("InitFromDump with the wrong app name succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("database left behind after a failed load: %v", err)
+	}
+	restored, err := InitFromDump(path, "test", 1, bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Close()
+	if _, err := InitFromDump(path, "test", 1, bytes.NewReader(dump.Bytes())); !errors.Is(err, os.ErrExist) {
+		t.Errorf("error = %v, want the existing database refused", err)
+	}
+}
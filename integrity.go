@@ -0,0 +1,90 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrCorrupt is matched (with errors.Is) by the CorruptionError returned when an integrity check
+// finds problems.
+var ErrCorrupt = errors.New("Database is corrupt")
+
+// CorruptionError lists the problems reported by an integrity check, one per entry.
+type CorruptionError struct {
+	Problems []string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Database is corrupt: %d problems found, first: %s", len(e.Problems), e.Problems[0])
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// CheckIntegrity runs PRAGMA integrity_check, or the faster quick_check (which skips checking
+// that indexes match their tables), and returns a CorruptionError listing the problems found.
+// It returns nil if the database is sound.
+// ctx -- context for the check, which reads the whole database and may take some time
+// quick -- run quick_check rather than the full integrity_check
+func (a *AppDB) CheckIntegrity(ctx context.Context, quick bool) error {
+	start := time.Now()
+	err := checkIntegrity(ctx, a.DB, quick)
+	a.logOp("integrity_check", start, err, slog.Bool("quick", quick))
+	return err
+}
+
+// checkIntegrity runs the integrity check on q. A check that can't run because the database is
+// too badly damaged is reported as a CorruptionError too.
+func checkIntegrity(ctx context.Context, q querier, quick bool) error {
+	pragma := "PRAGMA integrity_check"
+	if quick {
+		pragma = "PRAGMA quick_check"
+	}
+	rows, err := q.QueryContext(ctx, pragma)
+	if err != nil {
+		return corruptionFrom(err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return corruptionFrom(err)
+	}
+	if len(problems) > 0 {
+		return &CorruptionError{problems}
+	}
+	return nil
+}
+
+// corruptionFrom converts the driver's SQLITE_CORRUPT and SQLITE_NOTADB errors to a
+// CorruptionError, which the drivers only report as text.
+func corruptionFrom(err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "malformed") || strings.Contains(msg, "file is not a database") {
+		return &CorruptionError{[]string{msg}}
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportJSON writes every row of table to w as newline-delimited JSON, one object per row keyed
+// by column name. Values keep their SQLite storage class: integers are written without a decimal
+// point and reals always with one (or an exponent), text as strings, NULL as null, and blobs as
+// an object {"blob": "<base64>"}. ImportJSON reads the same format back.
+// table -- name of the table to export
+// w -- destination of the rows
+func (a *AppDB) ExportJSON(table string, w io.Writer) error {
+	return a.ExportJSONContext(context.Background(), table, w)
+}
+
+// ExportJSONContext is ExportJSON with a context.
+func (a *AppDB) ExportJSONContext(ctx context.Context, table string, w io.Writer) error {
+	start := time.Now()
+	var n int
+	tx, err := a.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err == nil {
+		n, err = exportJSON(ctx, tx, table, w)
+		tx.Rollback()
+	}
+	a.logOp("export_json", start, err, slog.String("table", table), slog.Int("rows", n))
+	return err
+}
+
+func exportJSON(ctx context.Context, q querier, table string, w io.Writer) (int, error) {
+	columns, err := tableColumns(ctx, q, table)
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("no such table: %s", table)
+	}
+	// Unary plus drops the column's declared type, so drivers return the stored value unconverted.
+	exprs := make([]string, len(columns))
+	keys := make([][]byte, len(columns))
+	for i, c := range columns {
+		exprs[i] = "+" + quoteIdent(c)
+		keys[i], _ = json.Marshal(c)
+	}
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), quoteIdent(table)))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	bw := bufio.NewWriter(w)
+	var line bytes.Buffer
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		line.Reset()
+		line.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			line.Write(keys[i])
+			line.WriteByte(':')
+			if err := appendJSONValue(&line, v); err != nil {
+				return n, err
+			}
+		}
+		line.WriteString("}\n")
+		if _, err := bw.Write(line.Bytes()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// appendJSONValue writes one column value in the export encoding.
+func appendJSONValue(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			buf.WriteString("1e999")
+		case math.IsInf(v, -1):
+			buf.WriteString("-1e999")
+		default:
+			s := strconv.FormatFloat(v, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".e") {
+				s += ".0"
+			}
+			buf.WriteString(s)
+		}
+	case string:
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	case []byte:
+		buf.WriteString(`{"blob":"`)
+		buf.WriteString(base64.StdEncoding.EncodeToString(v))
+		buf.WriteString(`"}`)
+	default:
+		return fmt.Errorf("unexpected column value of type %T", v)
+	}
+	return nil
+}
+
+// ImportJSON inserts the rows read from r, in the format written by ExportJSON, into table in a
+// single transaction. Each object's keys name the columns to set, so rows may set different
+// columns. Nothing is inserted if any row fails.
+// table -- name of the table to import into
+// r -- source of the rows
+func (a *AppDB) ImportJSON(table string, r io.Reader) error {
+	return a.ImportJSONContext(context.Background(), table, r)
+}
+
+// ImportJSONContext is ImportJSON with a context.
+func (a *AppDB) ImportJSONContext(ctx context.Context, table string, r io.Reader) error {
+	start := time.Now()
+	var n int
+	tx, err := a.BeginTx(ctx, nil)
+	if err == nil {
+		n, err = importJSON(ctx, tx, table, r)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	a.logOp("import_json", start, err, slog.String("table", table), slog.Int("rows", n))
+	return err
+}
+
+func importJSON(ctx context.Context, tx *sql.Tx, table string, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	stmts := map[string]*sql.Stmt{}
+	defer func() {
+		for _, s := range stmts {
+			s.Close()
+		}
+	}()
+	n := 0
+	for {
+		var row map[string]any
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("row %d: %w", n+1, err)
+		}
+		columns := make([]string, 0, len(row))
+		for c := range row {
+			columns = append(columns, c)
+		}
+		sort.Strings(columns)
+		args := make([]any, len(columns))
+		for i, c := range columns {
+			if args[i], err = jsonColumnValue(row[c]); err != nil {
+				return n, fmt.Errorf("row %d column %s: %w", n+1, c, err)
+			}
+		}
+		key := strings.Join(columns, "\x00")
+		stmt, ok := stmts[key]
+		if !ok {
+			quoted := make([]string, len(columns))
+			for i, c := range columns {
+				quoted[i] = quoteIdent(c)
+			}
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+			stmt, err = tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(table), strings.Join(quoted, ", "), placeholders))
+			if err != nil {
+				return n, err
+			}
+			stmts[key] = stmt
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return n, fmt.Errorf("row %d: %w", n+1, err)
+		}
+		n++
+	}
+}
+
+// jsonColumnValue converts a decoded value in the export encoding to the value to insert.
+func jsonColumnValue(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, string:
+		return v, nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case json.Number:
+		if !strings.ContainsAny(string(v), ".eE") {
+			return v.Int64()
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, err
+		}
+		return f, nil
+	case map[string]any:
+		if s, ok := v["blob"].(string); ok && len(v) == 1 {
+			return base64.StdEncoding.DecodeString(s)
+		}
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
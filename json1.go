@@ -0,0 +1,145 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSON holds a value stored in a column as JSON text, marshalled with encoding/json. For example a
+// struct field of type JSON[Settings] is read and written by Select, Query and the builders.
+type JSON[T any] struct {
+	Val T
+}
+
+// Value marshals the value to JSON text.
+func (j JSON[T]) Value() (driver.Value, error) {
+	b, err := json.Marshal(j.Val)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan unmarshals JSON text, leaving the zero value for NULL.
+func (j *JSON[T]) Scan(src any) error {
+	var zero T
+	j.Val = zero
+	switch s := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(s), &j.Val)
+	case []byte:
+		return json.Unmarshal(s, &j.Val)
+	default:
+		return fmt.Errorf("cannot scan %T into JSON", src)
+	}
+}
+
+// JSONExtract returns the SQL expression extracting the value at path from the JSON in column.
+// A query uses an index made by CreateJSONIndex only when it uses the same expression.
+// column -- name of the JSON column
+// path -- JSON path, such as "$.address.city"
+func JSONExtract(column, path string) string {
+	return fmt.Sprintf("json_extract(%s, '%s')", quoteIdent(column), strings.ReplaceAll(path, "'", "''"))
+}
+
+// JSONGet unmarshals the value at path in the JSON column of the first row of table matching
+// where into dest. A missing path leaves dest unchanged, as unmarshalling JSON null does. It returns
+// sql.ErrNoRows if no row matches.
+// ctx -- context for the query
+// db -- database or transaction to query
+// table -- name of the table
+// column -- name of the JSON column
+// path -- JSON path, such as "$.address.city"
+// dest -- pointer to unmarshal the value into
+// where -- condition selecting the row, such as "id = ?"
+// args -- arguments for placeholders in where
+func JSONGet(ctx context.Context, db Querier, table, column, path string, dest any, where string, args ...any) error {
+	// json_quote gives the JSON text of scalars as well as of objects and arrays.
+	query := fmt.Sprintf("SELECT json_quote(json_extract(%s, ?)) FROM %s WHERE %s LIMIT 1",
+		quoteIdent(column), quoteIdent(table), where)
+	var text sql.NullString
+	if err := getRow(ctx, db, &text, query, append([]any{path}, args...)); err != nil {
+		return err
+	}
+	if !text.Valid {
+		return nil
+	}
+	return json.Unmarshal([]byte(text.String), dest)
+}
+
+// JSONSet sets the value at path in the JSON column of the rows of table matching where to value
+// marshalled to JSON, creating the path if needed. A NULL column is treated as an empty object.
+// ctx -- context for the statement
+// db -- database or transaction to update
+// table -- name of the table
+// column -- name of the JSON column
+// path -- JSON path, such as "$.address.city"
+// value -- value to marshal to JSON
+// where -- condition selecting the rows, such as "id = ?"
+// args -- arguments for placeholders in where
+func JSONSet(ctx context.Context, db Execer, table, column, path string, value any, where string, args ...any) (sql.Result, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	col := quoteIdent(column)
+	// json() stores the marshalled text as JSON rather than as a string.
+	stmt := fmt.Sprintf("UPDATE %s SET %s = json_set(coalesce(%s, '{}'), ?, json(?)) WHERE %s",
+		quoteIdent(table), col, col, where)
+	return db.ExecContext(ctx, stmt, append([]any{path, string(b)}, args...)...)
+}
+
+// CreateJSONIndex creates an index on the value at path in the JSON column of table, used by
+// queries comparing or ordering by JSONExtract(column, path). It does nothing if an index named
+// name already exists. The stored schema checksum is updated in the same transaction, which is
+// db itself if db is a transaction.
+// ctx -- context for the statement
+// db -- database or transaction to update
+// name -- name of the index
+// table -- name of the table
+// column -- name of the JSON column
+// path -- JSON path, such as "$.address.city"
+func CreateJSONIndex(ctx context.Context, db Execer, name, table, column, path string) error {
+	stmt := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s)",
+		quoteIdent(name), quoteIdent(table), JSONExtract(column, path))
+	var pool *sql.DB
+	switch d := db.(type) {
+	case *AppDB:
+		pool = d.DB
+	case *sql.DB:
+		pool = d
+	}
+	if pool != nil {
+		return runTx(ctx, pool, func(tx *sql.Tx) error {
+			return createJSONIndex(ctx, tx, stmt)
+		})
+	}
+	if q, ok := db.(querier); ok {
+		return createJSONIndex(ctx, q, stmt)
+	}
+	_, err := db.ExecContext(ctx, stmt)
+	return err
+}
+
+func createJSONIndex(ctx context.Context, q querier, stmt string) error {
+	if _, err := q.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+	return updateSchemaChecksum(ctx, q)
+}
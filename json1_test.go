@@ -0,0 +1,50 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateJSONIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	schema := []string{"CREATE TABLE users (id INTEGER PRIMARY KEY, prefs TEXT);"}
+	db, err := InitAppDB(path, "test", 1, schema, WithSchemaChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JSONSet(ctx, db, "users", "prefs", "$.theme", "dark", "1 = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO users (id, prefs) VALUES (1, '{\"theme\": \"light\"}')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateJSONIndex(ctx, db, "users_theme", "users", "prefs", "$.theme"); err != nil {
+		t.Fatal(err)
+	}
+	var theme string
+	if err := JSONGet(ctx, db, "users", "prefs", "$.theme", &theme, "id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if theme != "light" {
+		t.Errorf("theme = %q, want %q", theme, "light")
+	}
+	db.Close()
+
+	db, err = Open(path, "test", 1, WithSchemaChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
@@ -0,0 +1,193 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package kv is a key-value store kept in a table of an appdb database, for applications that
+// need to keep a few values without designing a schema.
+package kv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+// DefaultTable is the table Open keeps values in. Tables named with the "appdb_" prefix are left
+// out of the application's schema, so schema validation ignores them.
+const DefaultTable = "appdb_kv"
+
+// tablePrefix begins the names of the tables OpenTable keeps stores in.
+const tablePrefix = "appdb_"
+
+// ErrNotFound is returned for a key that isn't set, or has expired.
+var ErrNotFound = errors.New("Key not found")
+
+// Store is a key-value store. Values are stored as JSON, so any value encoding/json can marshal
+// may be set, and read back into any type it can unmarshal into.
+type Store struct {
+	db    *appdb.AppDB
+	table string
+	// now returns the current time, for expiry.
+	now func() time.Time
+}
+
+// Open returns the store kept in DefaultTable, creating the table if needed.
+// ctx -- context for the statements
+// db -- database to keep the store in
+func Open(ctx context.Context, db *appdb.AppDB) (*Store, error) {
+	return OpenTable(ctx, db, DefaultTable)
+}
+
+// OpenTable returns the store kept in table, creating the table if needed, for applications
+// wanting more than one store. The table's name must begin with "appdb_", as DefaultTable's does,
+// so that it stays out of the application's schema and its checksum.
+// ctx -- context for the statements
+// db -- database to keep the store in
+// table -- name of the table
+func OpenTable(ctx context.Context, db *appdb.AppDB, table string) (*Store, error) {
+	if !strings.HasPrefix(table, tablePrefix) {
+		return nil, fmt.Errorf("key-value table %s must be named with the %s prefix", table, tablePrefix)
+	}
+	t := quote(table)
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS " + t + " (key TEXT PRIMARY KEY, value TEXT NOT NULL, expires_at INTEGER) WITHOUT ROWID",
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (expires_at) WHERE expires_at IS NOT NULL", quote(table+"_expires_at"), t),
+	}
+	for _, stmt := range statements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{db: db, table: table, now: time.Now}, nil
+}
+
+// quote quotes an SQL identifier.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Set sets key to value, which never expires.
+// ctx -- context for the statement
+// key -- key to set
+// value -- value to marshal to JSON
+func (s *Store) Set(ctx context.Context, key string, value any) error {
+	return s.set(ctx, key, value, nil)
+}
+
+// SetTTL sets key to value, which expires after ttl.
+// ctx -- context for the statement
+// key -- key to set
+// value -- value to marshal to JSON
+// ttl -- time until the value expires
+func (s *Store) SetTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
+	expires := s.now().Add(ttl).UnixMilli()
+	return s.set(ctx, key, value, &expires)
+}
+
+func (s *Store) set(ctx context.Context, key string, value any, expires *int64) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "INSERT OR REPLACE INTO "+quote(s.table)+" (key, value, expires_at) VALUES (?, ?, ?)",
+		key, string(b), expires)
+	return err
+}
+
+// Get unmarshals the value of key into dest, returning ErrNotFound if it isn't set.
+// ctx -- context for the query
+// key -- key to read
+// dest -- pointer to unmarshal the value into
+func (s *Store) Get(ctx context.Context, key string, dest any) error {
+	var value string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM "+quote(s.table)+" WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)",
+		key, s.now().UnixMilli()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(value), dest)
+}
+
+// Lookup returns the value of key as a T, returning ErrNotFound if it isn't set.
+// ctx -- context for the query
+// s -- store to read
+// key -- key to read
+func Lookup[T any](ctx context.Context, s *Store, key string) (T, error) {
+	var v T
+	err := s.Get(ctx, key, &v)
+	return v, err
+}
+
+// Delete removes key, doing nothing if it isn't set.
+// ctx -- context for the statement
+// key -- key to remove
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+quote(s.table)+" WHERE key = ?", key)
+	return err
+}
+
+// List returns the keys starting with prefix that are set, in order.
+// ctx -- context for the query
+// prefix -- start of the keys to list, or empty for all keys
+func (s *Store) List(ctx context.Context, prefix string) ([]string, error) {
+	query := "SELECT key FROM " + quote(s.table) + " WHERE (expires_at IS NULL OR expires_at > ?) AND key >= ?"
+	args := []any{s.now().UnixMilli(), prefix}
+	if end, ok := prefixEnd(prefix); ok {
+		query += " AND key < ?"
+		args = append(args, end)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY key", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// prefixEnd returns the least string greater than every string starting with prefix, comparing
+// bytes as SQLite does, or false if there is none.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// PurgeExpired removes expired values, which are otherwise only ignored, returning the number
+// removed.
+// ctx -- context for the statement
+func (s *Store) PurgeExpired(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM "+quote(s.table)+" WHERE expires_at <= ?", s.now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package kv
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AndrewMobbs/appdb"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := appdb.InitAppDB(path, "test", 1, []string{"CREATE TABLE t (id INTEGER PRIMARY KEY);"}, appdb.WithSchemaChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	s, err := Open(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	if err := s.Set(ctx, "user/1", map[string]int{"age": 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "user/2", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL(ctx, "session", "x", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Lookup[map[string]int](ctx, s, "user/1")
+	if err != nil || got["age"] != 42 {
+		t.Fatalf("Lookup = %v, %v", got, err)
+	}
+	keys, err := s.List(ctx, "user/")
+	if err != nil || !reflect.DeepEqual(keys, []string{"user/1", "user/2"}) {
+		t.Fatalf("List = %v, %v", keys, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := Lookup[string](ctx, s, "session"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired Lookup error = %v, want ErrNotFound", err)
+	}
+	if n, err := s.PurgeExpired(ctx); err != nil || n != 1 {
+		t.Errorf("PurgeExpired = %d, %v, want 1", n, err)
+	}
+	if err := s.Delete(ctx, "user/2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup[string](ctx, s, "user/2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted Lookup error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := OpenTable(ctx, db, "settings"); err == nil {
+		t.Error("OpenTable accepted a table without the appdb_ prefix")
+	}
+	if _, err := OpenTable(ctx, db, "appdb_settings"); err != nil {
+		t.Fatal(err)
+	}
+	// The store's tables aren't part of the checksummed schema.
+	db.Close()
+	db, err = appdb.Open(path, "test", 1, appdb.WithSchemaChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// LintRule identifies a check made by LintSchema.
+type LintRule string
+
+const (
+	// LintUnindexedForeignKey is a foreign key whose columns no index starts with, so that every
+	// change to the parent table scans the child table.
+	LintUnindexedForeignKey LintRule = "unindexed foreign key"
+	// LintWithoutRowID is a table with a composite or non-integer primary key that would be
+	// smaller and faster declared WITHOUT ROWID.
+	LintWithoutRowID LintRule = "without rowid"
+	// LintTextPrimaryKey is a primary key of text, which is compared case-sensitively and stored
+	// again in a separate index unless the table is WITHOUT ROWID.
+	LintTextPrimaryKey LintRule = "text primary key"
+	// LintIntPrimaryKey is a primary key declared INT or similar rather than INTEGER, which isn't
+	// the rowid and so isn't assigned automatically.
+	LintIntPrimaryKey LintRule = "int primary key"
+	// LintReservedWord is a table, column or index named with an SQL keyword, which must be
+	// quoted wherever it is used.
+	LintReservedWord LintRule = "reserved word"
+)
+
+// LintFinding is one possible problem LintSchema found in a schema.
+type LintFinding struct {
+	Rule  LintRule
+	Table string
+	// Name is the column or index concerned, or empty for a finding about the table itself.
+	Name    string
+	Message string
+}
+
+func (f LintFinding) String() string {
+	name := f.Table
+	if f.Name != "" {
+		name += "." + f.Name
+	}
+	return fmt.Sprintf("%s %s: %s", f.Rule, name, f.Message)
+}
+
+// WithSchemaLint checks the schema passed to InitAppDB with LintSchema each time the database is
+// initialised, logging each finding as a warning. It is meant for development, to catch pitfalls
+// before the schema is shipped; findings don't stop the database opening.
+func WithSchemaLint() Option {
+	return func(c *config) {
+		c.schemaLint = true
+	}
+}
+
+// LintSchema checks the tables the schema statements create for common SQLite pitfalls: foreign
+// keys without an index, tables that would benefit from WITHOUT ROWID, text or non-INTEGER
+// primary keys and names that are SQL keywords. The findings are advice; not every one needs
+// acting on.
+// ctx -- context for building the schema in memory
+// schema -- SQL statements creating the schema, as passed to InitAppDB
+// opts -- options for the in-memory database, such as the driver and collations the schema uses
+func LintSchema(ctx context.Context, schema []string, opts ...Option) ([]LintFinding, error) {
+	return lintSchema(ctx, newConfig(opts), schema)
+}
+
+func lintSchema(ctx context.Context, cfg *config, schema []string) ([]LintFinding, error) {
+	s, err := schemaOf(ctx, cfg, schema)
+	if err != nil {
+		return nil, err
+	}
+	var findings []LintFinding
+	for i := range s.Tables {
+		findings = append(findings, lintTable(&s.Tables[i])...)
+	}
+	return findings, nil
+}
+
+// logLint logs the findings for a schema about to be used at init.
+func logLint(ctx context.Context, cfg *config, dbPath string, appName string, schema []string) {
+	findings, err := lintSchema(ctx, cfg, schema)
+	if err != nil {
+		// The schema itself is at fault, which creating it will report.
+		return
+	}
+	for _, f := range findings {
+		cfg.logger.Warn("appdb schema lint",
+			slog.String(LogKeyPath, dbPath),
+			slog.String(LogKeyApp, appName),
+			slog.String("rule", string(f.Rule)),
+			slog.String("table", f.Table),
+			slog.String("name", f.Name),
+			slog.String("message", f.Message))
+	}
+}
+
+// lintTable checks one table.
+func lintTable(t *TableInfo) []LintFinding {
+	var findings []LintFinding
+	add := func(rule LintRule, name string, format string, args ...any) {
+		findings = append(findings, LintFinding{Rule: rule, Table: t.Name, Name: name, Message: fmt.Sprintf(format, args...)})
+	}
+	if isKeyword(t.Name) {
+		add(LintReservedWord, "", "table name %s is an SQL keyword", t.Name)
+	}
+	for _, c := range t.Columns {
+		if isKeyword(c.Name) {
+			add(LintReservedWord, c.Name, "column name %s is an SQL keyword", c.Name)
+		}
+	}
+	for _, ix := range t.Indexes {
+		if ix.Origin == "c" && isKeyword(ix.Name) {
+			add(LintReservedWord, ix.Name, "index name %s is an SQL keyword", ix.Name)
+		}
+	}
+	if t.Virtual {
+		return findings
+	}
+
+	var key []ColumnInfo
+	for _, c := range t.Columns {
+		if c.PrimaryKey > 0 {
+			key = append(key, c)
+		}
+	}
+	slices.SortFunc(key, func(a, b ColumnInfo) int { return a.PrimaryKey - b.PrimaryKey })
+	rowid := len(key) == 1 && strings.EqualFold(key[0].Type, "INTEGER") && !t.WithoutRowID
+	if len(key) == 1 {
+		affinity := typeAffinity(key[0].Type)
+		switch {
+		case affinity == "TEXT" && t.WithoutRowID:
+			add(LintTextPrimaryKey, key[0].Name, "primary key %s is text, compared case-sensitively unless given a collation", key[0].Name)
+		case affinity == "TEXT":
+			add(LintTextPrimaryKey, key[0].Name, "primary key %s is text; consider an INTEGER key, or WITHOUT ROWID", key[0].Name)
+		case affinity == "INTEGER" && !rowid && !t.WithoutRowID:
+			add(LintIntPrimaryKey, key[0].Name, "primary key %s is declared %s, not INTEGER, so isn't the rowid and isn't assigned automatically", key[0].Name, key[0].Type)
+		}
+	}
+	if len(key) > 0 && !rowid && !t.WithoutRowID {
+		kind := "non-integer"
+		if len(key) > 1 {
+			kind = "composite"
+		}
+		add(LintWithoutRowID, "", "table has a %s primary key; consider WITHOUT ROWID", kind)
+	}
+
+	var keyNames []string
+	for _, c := range key {
+		keyNames = append(keyNames, c.Name)
+	}
+	for _, fk := range t.ForeignKeys {
+		indexed := hasPrefixColumns(keyNames, fk.Columns)
+		for _, ix := range t.Indexes {
+			if !ix.Partial && hasPrefixColumns(ix.Columns, fk.Columns) {
+				indexed = true
+			}
+		}
+		if !indexed {
+			cols := strings.Join(fk.Columns, ", ")
+			add(LintUnindexedForeignKey, cols, "foreign key (%s) referencing %s has no index", cols, fk.Table)
+		}
+	}
+	return findings
+}
+
+// hasPrefixColumns reports whether the leading columns of an index are the given columns, in any
+// order.
+func hasPrefixColumns(index []string, columns []string) bool {
+	if len(index) < len(columns) {
+		return false
+	}
+	for _, c := range columns {
+		if !slices.ContainsFunc(index[:len(columns)], func(i string) bool { return strings.EqualFold(i, c) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// typeAffinity returns the affinity SQLite gives a column of a declared type.
+func typeAffinity(declared string) string {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "INT"):
+		return "INTEGER"
+	case strings.Contains(t, "CHAR") || strings.Contains(t, "CLOB") || strings.Contains(t, "TEXT"):
+		return "TEXT"
+	case t == "" || strings.Contains(t, "BLOB"):
+		return "BLOB"
+	case strings.Contains(t, "REAL") || strings.Contains(t, "FLOA") || strings.Contains(t, "DOUB"):
+		return "REAL"
+	}
+	return "NUMERIC"
+}
+
+// isKeyword reports whether name is one of SQLite's keywords.
+func isKeyword(name string) bool {
+	_, ok := sqlKeywords[strings.ToUpper(name)]
+	return ok
+}
+
+// sqlKeywords are the keywords SQLite recognises.
+var sqlKeywords = func() map[string]struct{} {
+	words := strings.Fields(`ABORT ACTION ADD AFTER ALL ALTER ALWAYS ANALYZE AND AS ASC ATTACH
+		AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK COLLATE COLUMN COMMIT CONFLICT
+		CONSTRAINT CREATE CROSS CURRENT CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP DATABASE DEFAULT
+		DEFERRABLE DEFERRED DELETE DESC DETACH DISTINCT DO DROP EACH ELSE END ESCAPE EXCEPT EXCLUDE
+		EXCLUSIVE EXISTS EXPLAIN FAIL FILTER FIRST FOLLOWING FOR FOREIGN FROM FULL GENERATED GLOB
+		GROUP GROUPS HAVING IF IGNORE IMMEDIATE IN INDEX INDEXED INITIALLY INNER INSERT INSTEAD
+		INTERSECT INTO IS ISNULL JOIN KEY LAST LEFT LIKE LIMIT MATCH MATERIALIZED NATURAL NO NOT
+		NOTHING NOTNULL NULL NULLS OF OFFSET ON OR ORDER OTHERS OUTER OVER PARTITION PLAN PRAGMA
+		PRECEDING PRIMARY QUERY RAISE RANGE RECURSIVE REFERENCES REGEXP REINDEX RELEASE RENAME
+		REPLACE RESTRICT RETURNING RIGHT ROLLBACK ROW ROWS SAVEPOINT SELECT SET TABLE TEMP TEMPORARY
+		THEN TIES TO TRANSACTION TRIGGER UNBOUNDED UNION UNIQUE UPDATE USING VACUUM VALUES VIEW
+		VIRTUAL WHEN WHERE WINDOW WITH WITHOUT`)
+	m := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		m[w] = struct{}{}
+	}
+	return m
+}()
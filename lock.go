@@ -0,0 +1,66 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrAlreadyOpen is matched (with errors.Is) by the AlreadyOpenError returned when the database
+// is locked by another process.
+var ErrAlreadyOpen = errors.New("Database is already open")
+
+type AlreadyOpenError struct {
+	LockPath string
+}
+
+func (e *AlreadyOpenError) Error() string {
+	return fmt.Sprintf("Database is already open: %s is locked by another process", e.LockPath)
+}
+
+func (e *AlreadyOpenError) Is(target error) bool {
+	return target == ErrAlreadyOpen
+}
+
+// WithLockFile takes an exclusive advisory lock on a sidecar file, the database path with ".lock"
+// appended, for as long as the database is open. Opening fails with an AlreadyOpenError if another
+// process (or another AppDB in this process) holds the lock, so a desktop application can detect
+// a second instance cleanly rather than fighting over SQLITE_BUSY. The lock file is left in place
+// when the database is closed.
+func WithLockFile() Option {
+	return func(c *config) {
+		c.lockFile = true
+	}
+}
+
+// acquireLock creates and locks the sidecar lock file for dbPath. It returns nil if locking
+// isn't configured or the database is in memory.
+func acquireLock(dbPath string, cfg *config) (*os.File, error) {
+	if !cfg.lockFile || isMemoryPath(dbPath) {
+		return nil, nil
+	}
+	lockPath := filePath(dbPath) + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, cfg.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	held, err := lockFile(f)
+	if err != nil || held {
+		f.Close()
+		if held {
+			return nil, &AlreadyOpenError{lockPath}
+		}
+		return nil, err
+	}
+	return f, nil
+}
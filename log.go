@@ -0,0 +1,85 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Logger receives diagnostic messages from appdb. Arguments after the message are alternating
+// key/value pairs. *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger discards all messages. It is the default so that appdb is silent unless asked otherwise.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// WithLogger sets the logger used for the database. Passing nil silences logging.
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		c.logger = l
+	}
+}
+
+// SetLogger replaces the logger used for the database. Passing nil silences logging.
+func (a *AppDB) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	a.logger = l
+}
+
+// Keys of the structured fields attached to every operation event.
+const (
+	LogKeyOp            = "op"
+	LogKeyPath          = "path"
+	LogKeyApp           = "app"
+	LogKeySchemaVersion = "schemaVersion"
+	LogKeyDuration      = "duration"
+	LogKeyError         = "error"
+)
+
+// logEvent records the outcome of one operation with the standard set of fields. Successful
+// operations are logged at debug level and failures at error level.
+func logEvent(l Logger, op string, dbPath string, appName string, schemaVersion uint8, start time.Time, err error, args ...any) {
+	fields := []any{
+		slog.String(LogKeyOp, op),
+		slog.String(LogKeyPath, dbPath),
+		slog.String(LogKeyApp, appName),
+		slog.Int(LogKeySchemaVersion, int(schemaVersion)),
+		slog.Duration(LogKeyDuration, time.Since(start)),
+	}
+	fields = append(fields, args...)
+	if err != nil {
+		fields = append(fields, slog.Any(LogKeyError, err))
+		l.Error("appdb "+op+" failed", fields...)
+		return
+	}
+	l.Debug("appdb "+op, fields...)
+}
+
+// logOp records the outcome of an operation on an open database.
+func (a *AppDB) logOp(op string, start time.Time, err error, args ...any) {
+	logEvent(a.logger, op, a.path, a.appName, a.schemaVersion, start, err, args...)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ManagedDB describes a database a Manager opens on demand.
+type ManagedDB struct {
+	// Path is the location of the database file, relative to the Manager's directory unless it is
+	// absolute. It defaults to the database's name with a ".db" extension.
+	Path string
+	// AppName identifies the database, as the appName of Open. It defaults to the Manager's app
+	// name and the database's name joined by "-", such as "myapp-cache", so that each database
+	// has its own identity and, with WithEnvOverride, its own environment variable.
+	AppName string
+	// SchemaVersion is the schema version the database is opened at.
+	SchemaVersion uint8
+	// Migrations, if not nil, are applied to bring the database to SchemaVersion, as by Migrate.
+	Migrations []Migration
+	// Schema, if Migrations is nil, creates the database if it doesn't exist, as by InitAppDB.
+	// If both are nil the database must already exist.
+	Schema []string
+	// Options are applied after the Manager's shared options.
+	Options []Option
+}
+
+// Manager owns the databases of an application that keeps several, such as "main", "cache" and
+// "media-index", opening each the first time it is asked for and closing them all together.
+type Manager struct {
+	appName string
+	dir     string
+	opts    []Option
+
+	mu     sync.Mutex
+	specs  map[string]ManagedDB
+	dbs    map[string]*AppDB
+	opened []string // names of the open databases, in the order they were opened
+	closed bool
+}
+
+// NewManager returns a Manager for the databases of appName kept in dir. If dir is empty they are
+// kept in the directory DefaultPath gives for the application.
+// appName -- name of application
+// dir -- directory holding the database files
+// opts -- options shared by every database
+func NewManager(appName string, dir string, opts ...Option) (*Manager, error) {
+	if dir == "" {
+		p, err := DefaultPath(appName, opts...)
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Dir(p)
+	}
+	return &Manager{appName: appName, dir: dir, opts: opts, specs: map[string]ManagedDB{}, dbs: map[string]*AppDB{}}, nil
+}
+
+// Register adds a database to the Manager under name. It is opened by the first call to DB.
+// name -- name of the database
+// spec -- how to open the database
+func (m *Manager) Register(name string, spec ManagedDB) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("database manager is closed")
+	}
+	if _, ok := m.specs[name]; ok {
+		return fmt.Errorf("database %s is already registered", name)
+	}
+	if spec.Path == "" {
+		spec.Path = name + ".db"
+	}
+	if !filepath.IsAbs(spec.Path) && !isURI(spec.Path) && !isMemoryPath(spec.Path) {
+		spec.Path = filepath.Join(m.dir, spec.Path)
+	}
+	if spec.AppName == "" {
+		spec.AppName = m.appName + "-" + name
+	}
+	m.specs[name] = spec
+	return nil
+}
+
+// Names returns the names of the registered databases, in order.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.specs))
+	for name := range m.specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Path returns the location of the file of the database registered as name.
+// name -- name of the database
+func (m *Manager) Path(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	spec, ok := m.specs[name]
+	if !ok {
+		return "", fmt.Errorf("no database is registered as %s", name)
+	}
+	return spec.Path, nil
+}
+
+// DB returns the database registered as name, opening it if this is the first time it has been
+// asked for. Other calls to DB wait while a database is opened.
+// ctx -- context for opening the database
+// name -- name of the database
+func (m *Manager) DB(ctx context.Context, name string) (*AppDB, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errors.New("database manager is closed")
+	}
+	if a, ok := m.dbs[name]; ok {
+		return a, nil
+	}
+	spec, ok := m.specs[name]
+	if !ok {
+		return nil, fmt.Errorf("no database is registered as %s", name)
+	}
+	opts := append(append([]Option(nil), m.opts...), spec.Options...)
+	var a *AppDB
+	var err error
+	switch {
+	case spec.Migrations != nil:
+		a, err = MigrateContext(ctx, spec.Path, spec.AppName, spec.SchemaVersion, spec.Migrations, opts...)
+	case spec.Schema != nil:
+		a, err = InitAppDBContext(ctx, spec.Path, spec.AppName, spec.SchemaVersion, spec.Schema, opts...)
+	default:
+		a, err = OpenContext(ctx, spec.Path, spec.AppName, spec.SchemaVersion, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.dbs[name] = a
+	m.opened = append(m.opened, name)
+	return a, nil
+}
+
+// Close closes the open databases, most recently opened first, and returns the errors from any
+// that failed to close. The Manager can't be used afterwards.
+func (m *Manager) Close() error {
+	return m.close(func(a *AppDB) error { return a.Close() })
+}
+
+// CloseContext is Close closing each database gracefully with CloseContext, which shares ctx.
+// ctx -- context bounding how long to wait
+func (m *Manager) CloseContext(ctx context.Context) error {
+	return m.close(func(a *AppDB) error { return a.CloseContext(ctx) })
+}
+
+func (m *Manager) close(closeDB func(a *AppDB) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	var errs []error
+	for i := len(m.opened) - 1; i >= 0; i-- {
+		name := m.opened[i]
+		if err := closeDB(m.dbs[name]); err != nil {
+			errs = append(errs, fmt.Errorf("closing database %s: %w", name, err))
+		}
+	}
+	m.dbs = nil
+	m.opened = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package metrics exports the statistics of an appdb database to Prometheus.
+package metrics
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/AndrewMobbs/appdb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector reporting on one database: its connections, the file sizes
+// of the database and its write-ahead log, and, if the database was opened with
+// appdb.WithQueryStats, the latency, errors and busy errors of each statement.
+type Collector struct {
+	db *appdb.AppDB
+
+	openConnections  *prometheus.Desc
+	inUseConnections *prometheus.Desc
+	waitCount        *prometheus.Desc
+	statementLatency *prometheus.Desc
+	statementErrors  *prometheus.Desc
+	busyErrors       *prometheus.Desc
+	fileSize         *prometheus.Desc
+}
+
+// NewCollector returns a collector for db, labelling its metrics with the application name and
+// the database path, so databases of the same application can be registered together. Register a
+// collector for each database, for example:
+//
+//	prometheus.MustRegister(metrics.NewCollector(db))
+//
+// db -- database to report on
+func NewCollector(db *appdb.AppDB) *Collector {
+	labels := prometheus.Labels{"app": db.AppName(), "path": db.Path()}
+	return &Collector{
+		db: db,
+		openConnections: prometheus.NewDesc("appdb_open_connections",
+			"Number of open connections to the database.", nil, labels),
+		inUseConnections: prometheus.NewDesc("appdb_in_use_connections",
+			"Number of connections in use.", nil, labels),
+		waitCount: prometheus.NewDesc("appdb_connection_waits_total",
+			"Number of times a connection was waited for.", nil, labels),
+		statementLatency: prometheus.NewDesc("appdb_statement_duration_seconds",
+			"Time taken to run each statement.", []string{"statement"}, labels),
+		statementErrors: prometheus.NewDesc("appdb_statement_errors_total",
+			"Number of statements that failed.", []string{"statement"}, labels),
+		busyErrors: prometheus.NewDesc("appdb_busy_errors_total",
+			"Number of statements that failed because the database was locked.", nil, labels),
+		fileSize: prometheus.NewDesc("appdb_file_size_bytes",
+			"Size of the database files.", []string{"file"}, labels),
+	}
+}
+
+// Describe sends the descriptors of the collector's metrics.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openConnections
+	ch <- c.inUseConnections
+	ch <- c.waitCount
+	ch <- c.statementLatency
+	ch <- c.statementErrors
+	ch <- c.busyErrors
+	ch <- c.fileSize
+}
+
+// Collect sends the current value of each metric.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.db.DB.Stats()
+	ch <- prometheus.MustNewConstMetric(c.openConnections, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUseConnections, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(s.WaitCount))
+
+	var busy uint64
+	for _, st := range c.db.QueryStats() {
+		ch <- prometheus.MustNewConstSummary(c.statementLatency, st.Executions, st.Total.Seconds(),
+			map[float64]float64{0.5: st.P50.Seconds(), 0.95: st.P95.Seconds(), 0.99: st.P99.Seconds()}, st.Query)
+		ch <- prometheus.MustNewConstMetric(c.statementErrors, prometheus.CounterValue, float64(st.Errors), st.Query)
+		busy += st.Busy
+	}
+	ch <- prometheus.MustNewConstMetric(c.busyErrors, prometheus.CounterValue, float64(busy))
+
+	for file, path := range map[string]string{"db": c.db.Path(), "wal": c.db.Path() + "-wal"} {
+		fi, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) && file == "wal" {
+			// A database not in WAL mode, or checkpointed and closed, has no log.
+			fi, err = nil, nil
+		}
+		if err != nil {
+			continue
+		}
+		var size int64
+		if fi != nil {
+			size = fi.Size()
+		}
+		ch <- prometheus.MustNewConstMetric(c.fileSize, prometheus.GaugeValue, float64(size), file)
+	}
+}
@@ -0,0 +1,554 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Migration moves the schema from the previous version to Version. Down, if provided, reverses
+// the change so that the schema can be returned to the previous version. Down statements are
+// stored in the database when the migration is applied, so an older build of the application
+// that has never seen this migration can still undo it.
+// Each migration is applied in its own transaction, so its statements must not begin or commit
+// transactions themselves.
+// UpFunc and DownFunc are optional Go functions for changes SQL can't express, such as data
+// transformations. They run inside the step's transaction after the Up or Down statements.
+// A migration with a DownFunc can only be undone by a build of the application that has it, so
+// its Down statements are not stored in the database.
+// DisableForeignKeys turns foreign key enforcement off while the step runs, as SQLite requires
+// when a table is rebuilt, and checks the foreign keys before committing.
+// Triggers are created after the Up statements, replacing any of the same name, so a migration
+// redeclares a trigger to change it. Stepping down drops them after the Down statements and
+// recreates the versions declared by earlier migrations.
+type Migration struct {
+	Version            uint8
+	Name               string
+	Up                 []string
+	Down               []string
+	UpFunc             func(ctx context.Context, tx *sql.Tx) error
+	DownFunc           func(ctx context.Context, tx *sql.Tx) error
+	DisableForeignKeys bool
+	Triggers           []Trigger
+}
+
+type NoMigrationError struct {
+	Version uint8
+	Down    bool
+}
+
+func (e *NoMigrationError) Error() string {
+	if e.Down {
+		return fmt.Sprintf("No down migration from schema version %d", e.Version)
+	}
+	return fmt.Sprintf("No migration to schema version %d", e.Version)
+}
+
+// MigrationError reports a failed migration step. The step's transaction has been rolled back,
+// so the database is left at schema version From. Statement is empty if the failure wasn't in
+// one of the migration's own statements.
+type MigrationError struct {
+	From      uint8
+	To        uint8
+	Down      bool
+	Statement string
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	if e.Statement == "" {
+		return fmt.Sprintf("Error %s migrating schema from version %d to %d", e.Err, e.From, e.To)
+	}
+	return fmt.Sprintf("Error %s migrating schema from version %d to %d on statement %s", e.Err, e.From, e.To, e.Statement)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// ForeignKeyError lists the foreign key violations left by a migration that ran with foreign key
+// enforcement off, one per entry.
+type ForeignKeyError struct {
+	Violations []string
+}
+
+func (e *ForeignKeyError) Error() string {
+	return fmt.Sprintf("Foreign key check failed: %d violations found, first: %s", len(e.Violations), e.Violations[0])
+}
+
+// step is one migration applied in one direction, taking the schema from one version to the next.
+type step struct {
+	migration *Migration
+	down      bool
+	from      uint8
+	to        uint8
+	// previous are the earlier declarations of the migration's triggers, restored going down.
+	previous []Trigger
+}
+
+// statements returns the SQL to run for the step.
+func (s step) statements() []string {
+	if s.down {
+		return s.downStatements()
+	}
+	return append(slices.Clip(s.migration.Up), replaceTriggers(s.migration.Triggers)...)
+}
+
+// downStatements returns the SQL reverting the step's migration.
+func (s step) downStatements() []string {
+	statements := slices.Clip(s.migration.Down)
+	for _, t := range s.migration.Triggers {
+		statements = append(statements, t.DropSQL())
+	}
+	for _, t := range s.previous {
+		statements = append(statements, t.SQL())
+	}
+	return statements
+}
+
+// fn returns the Go function to run for the step, if any.
+func (s step) fn() func(ctx context.Context, tx *sql.Tx) error {
+	if s.down {
+		return s.migration.DownFunc
+	}
+	return s.migration.UpFunc
+}
+
+// Migrate opens the database at dbPath, creating it if necessary, and applies migrations until
+// the schema is at schemaVersion. If the database is newer than schemaVersion, down migrations
+// are applied instead, and a NoMigrationError is returned if any needed step has no Down.
+// A newly created database starts at schema version 0.
+// Each applied step is recorded in the migration history (see MigrationHistory), and a
+// ChecksumError is returned if a migration that was already applied has since been changed.
+// dbPath -- the filesystem location of the database file
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema to migrate to
+// migrations -- the available migrations, in any order
+// opts -- options configuring the database connection.
+func Migrate(dbPath string, appName string, schemaVersion uint8, migrations []Migration, opts ...Option) (*AppDB, error) {
+	return MigrateContext(context.Background(), dbPath, appName, schemaVersion, migrations, opts...)
+}
+
+// MigrateContext is Migrate with a context.
+func MigrateContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, migrations []Migration, opts ...Option) (_ *AppDB, err error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	ctx, end := cfg.tracer.Start(ctx, Operation{Name: "migrate", Path: dbPath, AppName: appName})
+	defer func() { end(err) }()
+	var db *sql.DB
+	created := false
+	if _, err := os.Stat(filePath(dbPath)); os.IsNotExist(err) || isMemoryPath(dbPath) {
+		// The required tables and the tables seeded are created by the migrations, so are checked
+		// and seeded after they run.
+		initCfg := *cfg
+		initCfg.requiredTables = nil
+		initCfg.seed = nil
+		initCfg.seedFuncs = nil
+		db, err = createAppDB(ctx, dbPath, appName, 0, nil, &initCfg)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	} else {
+		db, err = openAppDBNoValidate(ctx, dbPath, cfg, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	current, err := currentSchemaVersion(ctx, db, appName, cfg.applicationID)
+	var steps []step
+	if err == nil {
+		steps, err = planMigration(ctx, db, current, schemaVersion, migrations)
+	}
+	if err == nil && cfg.schemaChecksum {
+		err = verifySchemaChecksum(ctx, db)
+	}
+	if err == nil && len(steps) > 0 {
+		m := newAppDB(db, dbPath, appName, steps[0].from, cfg)
+		err = runMigration(ctx, m, steps, cfg)
+		m.stmts.close()
+	}
+	if err == nil {
+		err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+	}
+	if err == nil && created {
+		err = seedDB(ctx, db, cfg)
+	}
+	logEvent(cfg.logger, "migrate", dbPath, appName, schemaVersion, start, err, cfg.logFields()...)
+	if err != nil {
+		db.Close()
+		if created && !isMemoryPath(dbPath) {
+			removeDBFiles(filePath(dbPath))
+		}
+		return nil, err
+	}
+	return newAppDB(db, dbPath, appName, schemaVersion, cfg).startBackground(), nil
+}
+
+// PlannedStep describes one migration step that Migrate would apply.
+type PlannedStep struct {
+	From       uint8
+	To         uint8
+	Name       string
+	Down       bool
+	Statements []string
+	HasFunc    bool // a Go function runs after the statements
+}
+
+// MigrationPlan is the ordered list of steps needed to reach a schema version.
+type MigrationPlan []PlannedStep
+
+// Statements returns every statement in the plan, in the order they would be executed.
+// The bookkeeping appdb does between steps (such as updating user_version) is not included.
+func (p MigrationPlan) Statements() []string {
+	var s []string
+	for _, st := range p {
+		s = append(s, st.Statements...)
+	}
+	return s
+}
+
+// Plan works out the steps Migrate would apply to bring the database at dbPath to schemaVersion,
+// without changing the database. A database that doesn't exist yet is planned from version 0.
+// dbPath -- the filesystem location of the database file
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema to migrate to
+// migrations -- the available migrations, in any order
+// opts -- options configuring the database connection.
+func Plan(dbPath string, appName string, schemaVersion uint8, migrations []Migration, opts ...Option) (MigrationPlan, error) {
+	return PlanContext(context.Background(), dbPath, appName, schemaVersion, migrations, opts...)
+}
+
+// PlanContext is Plan with a context.
+func PlanContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, migrations []Migration, opts ...Option) (MigrationPlan, error) {
+	var steps []step
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	if _, err := os.Stat(filePath(dbPath)); os.IsNotExist(err) || isMemoryPath(dbPath) {
+		steps, err = planSteps(migrations, nil, 0, schemaVersion)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		db, err := openAppDBNoValidate(ctx, dbPath, cfg, false)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		current, _, err := readSchemaVersion(ctx, db, "main", appName, cfg.applicationID)
+		if err != nil {
+			return nil, err
+		}
+		steps, err = planMigration(ctx, db, current, schemaVersion, migrations)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return toPlan(steps), nil
+}
+
+// planned describes the step for callers outside the package.
+func (s step) planned() PlannedStep {
+	return PlannedStep{
+		From:       s.from,
+		To:         s.to,
+		Name:       s.migration.Name,
+		Down:       s.down,
+		Statements: s.statements(),
+		HasFunc:    s.fn() != nil,
+	}
+}
+
+// toPlan describes the steps for callers outside the package.
+func toPlan(steps []step) MigrationPlan {
+	plan := make(MigrationPlan, 0, len(steps))
+	for _, st := range steps {
+		plan = append(plan, st.planned())
+	}
+	return plan
+}
+
+// planMigration works out the steps needed to take the open database to target, first checking
+// that none of the migrations already applied have changed since.
+func planMigration(ctx context.Context, db *sql.DB, current uint8, target uint8, migrations []Migration) ([]step, error) {
+	if err := verifyChecksums(ctx, db, migrations, current); err != nil {
+		return nil, err
+	}
+	stored, err := storedDownMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return planSteps(migrations, stored, current, target)
+}
+
+// MigrateHook is called by Migrate before or after the migration steps run. It is only called
+// when there is at least one step to apply. The AppDB's schema version is the version the
+// database is at when the hook runs.
+type MigrateHook func(ctx context.Context, db *AppDB, plan MigrationPlan) error
+
+// StepHook is called by Migrate before or after each migration step, inside the step's
+// transaction. Returning an error rolls the step back.
+type StepHook func(ctx context.Context, tx *sql.Tx, step PlannedStep) error
+
+// WithBeforeMigrate adds a hook called before any migration step runs, for example to take a
+// backup. An error from the hook stops the migration before anything is changed.
+func WithBeforeMigrate(h MigrateHook) Option {
+	return func(c *config) {
+		c.beforeMigrate = append(c.beforeMigrate, h)
+	}
+}
+
+// WithAfterMigrate adds a hook called after all migration steps have been applied, for example to
+// refresh cached data. An error from the hook is returned by Migrate, but the migration has
+// already been committed.
+func WithAfterMigrate(h MigrateHook) Option {
+	return func(c *config) {
+		c.afterMigrate = append(c.afterMigrate, h)
+	}
+}
+
+// WithBeforeStep adds a hook called at the start of each migration step.
+func WithBeforeStep(h StepHook) Option {
+	return func(c *config) {
+		c.beforeStep = append(c.beforeStep, h)
+	}
+}
+
+// WithAfterStep adds a hook called at the end of each migration step, before it is committed.
+func WithAfterStep(h StepHook) Option {
+	return func(c *config) {
+		c.afterStep = append(c.afterStep, h)
+	}
+}
+
+// planSteps works out the ordered steps needed to take the schema from current to target.
+// stored holds down migrations recorded in the database, used for versions this build doesn't know.
+func planSteps(migrations []Migration, stored map[uint8][]string, current, target uint8) ([]step, error) {
+	byVersion := make(map[uint8]*Migration, len(migrations))
+	for i := range migrations {
+		byVersion[migrations[i].Version] = &migrations[i]
+	}
+	var steps []step
+	for v := current; v < target; v++ {
+		m, ok := byVersion[v+1]
+		if !ok {
+			return nil, &NoMigrationError{Version: v + 1}
+		}
+		steps = append(steps, step{migration: m, from: v, to: v + 1, previous: previousTriggers(migrations, m)})
+	}
+	for v := current; v > target; v-- {
+		m, ok := byVersion[v]
+		if !ok && len(stored[v]) > 0 {
+			m = &Migration{Version: v, Down: stored[v]}
+			ok = true
+		}
+		if !ok || (len(m.Down) == 0 && m.DownFunc == nil) {
+			return nil, &NoMigrationError{Version: v, Down: true}
+		}
+		steps = append(steps, step{migration: m, down: true, from: v, to: v - 1, previous: previousTriggers(migrations, m)})
+	}
+	return steps, nil
+}
+
+// runMigration runs the before-migrate hooks, each step in turn, and then the after-migrate
+// hooks, stopping at the first failure.
+func runMigration(ctx context.Context, a *AppDB, steps []step, cfg *config) error {
+	plan := toPlan(steps)
+	for _, h := range cfg.beforeMigrate {
+		if err := h(ctx, a, plan); err != nil {
+			return err
+		}
+	}
+	for _, s := range steps {
+		if err := applyStep(ctx, a.DB, a.appName, s, cfg); err != nil {
+			return err
+		}
+		a.schemaVersion = s.to
+	}
+	if err := updateSchemaChecksum(ctx, a.DB); err != nil {
+		return err
+	}
+	for _, h := range cfg.afterMigrate {
+		if err := h(ctx, a, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStep runs one step in its own transaction, recording the new schema version as part of
+// the same transaction. If anything fails the transaction is rolled back, leaving the database
+// at the version it had before the step.
+func applyStep(ctx context.Context, db *sql.DB, appName string, s step, cfg *config) (err error) {
+	migrationErr := func(stmt string, err error) error {
+		return &MigrationError{From: s.from, To: s.to, Down: s.down, Statement: stmt, Err: err}
+	}
+	start := time.Now()
+	var b interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	} = db
+	if s.migration.DisableForeignKeys {
+		// The pragma has no effect inside a transaction, so it is set on a connection of its own
+		// before the transaction begins.
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return migrationErr("", err)
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return migrationErr("", err)
+		}
+		if cfg.foreignKeys {
+			defer conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA foreign_keys = ON")
+		}
+		b = conn
+	}
+	tx, err := b.BeginTx(ctx, nil)
+	if err != nil {
+		return migrationErr("", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, h := range cfg.beforeStep {
+		if err := h(ctx, tx, s.planned()); err != nil {
+			return migrationErr("", err)
+		}
+	}
+	for _, stmt := range s.statements() {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return migrationErr(stmt, err)
+		}
+	}
+	if fn := s.fn(); fn != nil {
+		if err := fn(ctx, tx); err != nil {
+			return migrationErr("", err)
+		}
+	}
+	for _, h := range cfg.afterStep {
+		if err := h(ctx, tx, s.planned()); err != nil {
+			return migrationErr("", err)
+		}
+	}
+	if err := recordDownMigration(ctx, tx, s); err != nil {
+		return migrationErr("", err)
+	}
+	if err := recordHistory(ctx, tx, s, start); err != nil {
+		return migrationErr("", err)
+	}
+	for _, stmt := range versionStatements(appName, s.to, cfg.applicationID) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return migrationErr("", err)
+		}
+	}
+	if s.migration.DisableForeignKeys && cfg.foreignKeys {
+		if err := checkForeignKeys(ctx, tx); err != nil {
+			return migrationErr("", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return migrationErr("", err)
+	}
+	return nil
+}
+
+// checkForeignKeys returns a ForeignKeyError if any row refers to a parent row that doesn't exist.
+func checkForeignKeys(ctx context.Context, db querier) error {
+	rows, err := db.QueryContext(ctx, "SELECT \"table\", rowid, parent FROM pragma_foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var violations []string
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		if err := rows.Scan(&table, &rowid, &parent); err != nil {
+			return err
+		}
+		if rowid.Valid {
+			violations = append(violations, fmt.Sprintf("%s row %d refers to a missing row in %s", table, rowid.Int64, parent))
+		} else {
+			violations = append(violations, fmt.Sprintf("%s row refers to a missing row in %s", table, parent))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &ForeignKeyError{Violations: violations}
+	}
+	return nil
+}
+
+const downMigrationsTable = "appdb_down_migrations"
+
+// storedDownMigrations reads the down migrations recorded in the database, keyed by version.
+func storedDownMigrations(ctx context.Context, db *sql.DB) (map[uint8][]string, error) {
+	stored := make(map[uint8][]string)
+	exists, err := tableExists(ctx, db, downMigrationsTable)
+	if err != nil || !exists {
+		return stored, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version, statements FROM "+downMigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v uint8
+		var statements string
+		if err := rows.Scan(&v, &statements); err != nil {
+			return nil, err
+		}
+		var down []string
+		if err := json.Unmarshal([]byte(statements), &down); err != nil {
+			return nil, err
+		}
+		stored[v] = down
+	}
+	return stored, rows.Err()
+}
+
+// recordDownMigration keeps the stored down migrations in step with the schema: an applied up
+// migration records its Down statements, and an applied down migration removes them.
+func recordDownMigration(ctx context.Context, db querier, s step) error {
+	if s.down {
+		exists, err := tableExists(ctx, db, downMigrationsTable)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "DELETE FROM "+downMigrationsTable+" WHERE version = ?", s.from)
+		return err
+	}
+	if len(s.migration.Down) == 0 || s.migration.DownFunc != nil {
+		return nil
+	}
+	down, err := json.Marshal(s.downStatements())
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+downMigrationsTable+" (version INTEGER PRIMARY KEY, statements TEXT NOT NULL);")
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT OR REPLACE INTO "+downMigrationsTable+" (version, statements) VALUES (?, ?)", s.to, string(down))
+	return err
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type MigrationFileError struct {
+	File   string
+	Reason string
+}
+
+func (e *MigrationFileError) Error() string {
+	return fmt.Sprintf("Invalid migration file %s: %s", e.File, e.Reason)
+}
+
+// MigrationsFromFS reads migrations from the SQL files in fsys, for use with embedded files:
+//
+//	//go:embed migrations/*.sql
+//	var migrationFiles embed.FS
+//
+// Each file name starts with the schema version it migrates to, optionally followed by an
+// underscore and a descriptive name, e.g. 0003_add_index.sql. Files ending .down.sql hold the
+// down migration for that version; files ending .up.sql or just .sql hold the up migration.
+// Every .sql file anywhere in fsys is read.
+func MigrationsFromFS(fsys fs.FS) ([]Migration, error) {
+	byVersion := make(map[uint8]*Migration)
+	// Files are tracked apart from their statements, as an empty file has none.
+	upFiles := make(map[uint8]string)
+	downFiles := make(map[uint8]string)
+	var versions []uint8
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(p) != ".sql" {
+			return nil
+		}
+		version, name, down, err := parseMigrationFileName(path.Base(p))
+		if err != nil {
+			return err
+		}
+		body, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+			versions = append(versions, version)
+		}
+		if down {
+			if _, ok := downFiles[version]; ok {
+				return &MigrationFileError{p, "duplicate down migration for version " + strconv.Itoa(int(version))}
+			}
+			m.Down = SplitStatements(string(body))
+			downFiles[version] = p
+		} else {
+			if _, ok := upFiles[version]; ok {
+				return &MigrationFileError{p, "duplicate migration for version " + strconv.Itoa(int(version))}
+			}
+			m.Up = SplitStatements(string(body))
+			m.Name = name
+			upFiles[version] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(versions))
+	for _, v := range versions {
+		if _, ok := upFiles[v]; !ok {
+			return nil, &MigrationFileError{downFiles[v], "down migration without an up migration"}
+		}
+		migrations = append(migrations, *byVersion[v])
+	}
+	return migrations, nil
+}
+
+// parseMigrationFileName splits a migration file name into its version, name and direction.
+func parseMigrationFileName(file string) (version uint8, name string, down bool, err error) {
+	base := strings.TrimSuffix(file, ".sql")
+	if strings.HasSuffix(base, ".down") {
+		down = true
+		base = strings.TrimSuffix(base, ".down")
+	} else {
+		base = strings.TrimSuffix(base, ".up")
+	}
+	digits, name, _ := strings.Cut(base, "_")
+	v, err := strconv.ParseUint(digits, 10, 8)
+	if err != nil || v == 0 {
+		return 0, "", false, &MigrationFileError{file, "name must start with a schema version from 1 to 255"}
+	}
+	return uint8(v), name, down, nil
+}
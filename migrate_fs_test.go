@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrationsFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0001_init.sql":       {Data: []byte("CREATE TABLE a (id INTEGER);\nCREATE TABLE b (id INTEGER);")},
+		"0001_init.down.sql":  {Data: []byte("DROP TABLE b;\nDROP TABLE a;")},
+		"0002_noop.up.sql":    {Data: []byte("-- nothing to do\n")},
+		"0003_index.sql":      {Data: []byte("CREATE INDEX a_id ON a (id);")},
+		"0003_index.down.sql": {Data: []byte("DROP INDEX a_id;")},
+		"README.md":           {Data: []byte("not a migration")},
+	}
+	migrations, err := MigrationsFromFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 3 {
+		t.Fatalf("got %d migrations, want 3", len(migrations))
+	}
+	for i, want := range []struct {
+		version  uint8
+		name     string
+		up, down int
+	}{{1, "init", 2, 2}, {2, "noop", 0, 0}, {3, "index", 1, 1}} {
+		m := migrations[i]
+		if m.Version != want.version || m.Name != want.name || len(m.Up) != want.up || len(m.Down) != want.down {
+			t.Errorf("migration %d = version %d %q with %d up and %d down statements, want %+v", i, m.Version, m.Name, len(m.Up), len(m.Down), want)
+		}
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"duplicate empty up": {
+			"0001_a.sql":    {Data: []byte("")},
+			"0001_b.up.sql": {Data: []byte("CREATE TABLE a (id INTEGER);")},
+		},
+		"duplicate down": {
+			"0001_a.sql":      {Data: []byte("CREATE TABLE a (id INTEGER);")},
+			"0001_a.down.sql": {Data: []byte("")},
+			"0001_b.down.sql": {Data: []byte("DROP TABLE a;")},
+		},
+		"down without up": {
+			"0001_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		},
+		"bad version": {
+			"init.sql": {Data: []byte("CREATE TABLE a (id INTEGER);")},
+		},
+	} {
+		var fileErr *MigrationFileError
+		if _, err := MigrationsFromFS(fsys); !errors.As(err, &fileErr) {
+			t.Errorf("%s: error = %v, want a MigrationFileError", name, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const historyTable = "appdb_migration_history"
+
+type ChecksumError struct {
+	Version          uint8
+	Checksum         string
+	ExpectedChecksum string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Migration to schema version %d changed after it was applied: Got checksum %s - Expected %s", e.Version, e.Checksum, e.ExpectedChecksum)
+}
+
+// AppliedMigration is one entry in the migration history recorded by Migrate.
+type AppliedMigration struct {
+	Version   uint8 // the version the step migrated to (up) or from (down)
+	Name      string
+	Down      bool
+	Checksum  string
+	AppliedAt time.Time
+	Duration  time.Duration
+}
+
+// checksum returns the hex SHA256 of a list of statements.
+func checksum(statements []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(statements, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationHistory returns every migration step applied to the database, oldest first.
+func (a *AppDB) MigrationHistory(ctx context.Context) ([]AppliedMigration, error) {
+	exists, err := tableExists(ctx, a.DB, historyTable)
+	if err != nil || !exists {
+		return nil, err
+	}
+	rows, err := a.QueryContext(ctx, "SELECT version, name, direction, checksum, applied_at, duration_ms FROM "+historyTable+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []AppliedMigration
+	for rows.Next() {
+		var m AppliedMigration
+		var direction, appliedAt string
+		var durationMs int64
+		if err := rows.Scan(&m.Version, &m.Name, &direction, &m.Checksum, &appliedAt, &durationMs); err != nil {
+			return nil, err
+		}
+		m.Down = direction == "down"
+		m.AppliedAt, err = time.Parse(time.RFC3339Nano, appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		m.Duration = time.Duration(durationMs) * time.Millisecond
+		history = append(history, m)
+	}
+	return history, rows.Err()
+}
+
+// recordHistory adds an applied step to the migration history.
+func recordHistory(ctx context.Context, tx *sql.Tx, s step, start time.Time) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+historyTable+` (
+		id INTEGER PRIMARY KEY,
+		version INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL);`)
+	if err != nil {
+		return err
+	}
+	version, direction := s.to, "up"
+	if s.down {
+		version, direction = s.from, "down"
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO "+historyTable+" (version, name, direction, checksum, applied_at, duration_ms) VALUES (?, ?, ?, ?, ?, ?)",
+		version, s.migration.Name, direction, checksum(s.statements()), start.UTC().Format(time.RFC3339Nano), time.Since(start).Milliseconds())
+	return err
+}
+
+// verifyChecksums checks that the up migrations already applied to the database, up to version
+// current, are the same as the ones recorded in the migration history.
+func verifyChecksums(ctx context.Context, db *sql.DB, migrations []Migration, current uint8) error {
+	exists, err := tableExists(ctx, db, historyTable)
+	if err != nil || !exists {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > current {
+			continue
+		}
+		var recorded string
+		err := db.QueryRowContext(ctx, "SELECT checksum FROM "+historyTable+" WHERE version = ? AND direction = 'up' ORDER BY id DESC LIMIT 1", m.Version).Scan(&recorded)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sum := checksum((step{migration: &m}).statements()); sum != recorded {
+			return &ChecksumError{m.Version, sum, recorded}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var testMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "items",
+		Up:      []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);"},
+		Down:    []string{"DROP TABLE items;"},
+	},
+	{
+		Version: 2,
+		Name:    "tags",
+		Up:      []string{"CREATE TABLE tags (id INTEGER PRIMARY KEY, item INTEGER REFERENCES items (id));"},
+		Down:    []string{"DROP TABLE tags;"},
+	},
+}
+
+// migrateTo migrates the database at path to version, checking the version reached.
+func migrateTo(t *testing.T, path string, version uint8, migrations []Migration) {
+	t.Helper()
+	db, err := Migrate(path, "test", version, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.SchemaVersion() != version {
+		t.Fatalf("schema version = %d, want %d", db.SchemaVersion(), version)
+	}
+}
+
+// hasTable reports whether the database at path has the table.
+func hasTable(t *testing.T, path string, table string) bool {
+	t.Helper()
+	db, err := openAppDBNoValidate(context.Background(), path, newConfig(nil), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exists, err := tableExists(context.Background(), db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	migrateTo(t, path, 2, testMigrations)
+	if !hasTable(t, path, "tags") {
+		t.Fatal("tags not created")
+	}
+
+	migrateTo(t, path, 1, testMigrations)
+	if hasTable(t, path, "tags") || !hasTable(t, path, "items") {
+		t.Fatal("downgrade to version 1 didn't drop only tags")
+	}
+
+	// A build that only knows version 1 can undo version 2 with the stored down statements.
+	migrateTo(t, path, 2, testMigrations)
+	migrateTo(t, path, 1, testMigrations[:1])
+	if hasTable(t, path, "tags") {
+		t.Fatal("stored down migration didn't drop tags")
+	}
+
+	db, err := Migrate(path, "test", 1, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.MigrationHistory(context.Background())
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downs int
+	for _, h := range history {
+		if h.Down {
+			downs++
+		}
+	}
+	if len(history) != 5 || downs != 2 {
+		t.Errorf("history has %d steps with %d down, want 5 with 2", len(history), downs)
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	migrateTo(t, path, 1, testMigrations)
+
+	broken := append([]Migration(nil), testMigrations...)
+	broken[1].Up = []string{"CREATE TABLE tags (id INTEGER PRIMARY KEY);", "CREATE TABLE broken ("}
+	var migrationErr *MigrationError
+	if _, err := Migrate(path, "test", 2, broken); !errors.As(err, &migrationErr) {
+		t.Fatalf("error = %v, want a MigrationError", err)
+	}
+	if migrationErr.From != 1 || migrationErr.To != 2 || migrationErr.Statement != "CREATE TABLE broken (" {
+		t.Errorf("error = %+v", migrationErr)
+	}
+	if hasTable(t, path, "tags") {
+		t.Error("failed step wasn't rolled back")
+	}
+
+	var noMigration *NoMigrationError
+	if _, err := Migrate(path, "test", 3, testMigrations); !errors.As(err, &noMigration) || noMigration.Version != 3 {
+		t.Errorf("error = %v, want no migration to version 3", err)
+	}
+	irreversible := append([]Migration(nil), testMigrations...)
+	irreversible[0].Down = nil
+	if _, err := Migrate(path, "test", 0, irreversible); !errors.As(err, &noMigration) || !noMigration.Down {
+		t.Errorf("error = %v, want no down migration", err)
+	}
+
+	changed := append([]Migration(nil), testMigrations...)
+	changed[0].Up = []string{"CREATE TABLE items (id INTEGER PRIMARY KEY);"}
+	var checksumErr *ChecksumError
+	if _, err := Migrate(path, "test", 2, changed); !errors.As(err, &checksumErr) {
+		t.Errorf("error = %v, want a ChecksumError", err)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ModelError reports a model SchemaFromStructs can't derive a table from. Field is empty if the
+// problem isn't with a particular field.
+type ModelError struct {
+	Model string
+	Field string
+	Err   string
+}
+
+func (e *ModelError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Cannot derive a table from %s: %s", e.Model, e.Err)
+	}
+	return fmt.Sprintf("Cannot derive a column for field %s of %s: %s", e.Field, e.Model, e.Err)
+}
+
+// TableNamer is implemented by models that name their own table.
+type TableNamer interface {
+	TableName() string
+}
+
+// SchemaFromStructs returns the statements creating a table for each model, a struct or pointer to
+// one, in the order given. The table is named by the model's TableName method, or otherwise is the
+// type name in lower case. Each exported field is a column, named as for Select: by its `db` tag,
+// or otherwise by the field name in lower case, with the fields of embedded structs included and
+// fields tagged `db:"-"` left out.
+// Options follow the name in the `db` tag, separated by commas:
+//
+//	type=T         declared type T, rather than one derived from the field's Go type
+//	pk             part of the primary key
+//	unique         UNIQUE, or with unique=name part of a unique index of that name
+//	index          indexed, or with index=name part of an index of that name
+//	fk=table.col   REFERENCES table(col); with fk=table the reference is to its primary key
+//	default=expr   DEFAULT expr, which can't contain a comma
+//
+// For example `db:"owner_id,fk=users.id,index"`. Columns are NOT NULL unless their Go type is a
+// pointer, slice, map or sql.Null type. Indexes named by the option alone are named after the
+// table and column, such as "users_email_idx".
+// models -- structs describing the tables
+func SchemaFromStructs(models ...any) ([]string, error) {
+	var statements []string
+	for _, m := range models {
+		stmts, err := modelStatements(m)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmts...)
+	}
+	return statements, nil
+}
+
+// modelColumn is a column derived from a struct field.
+type modelColumn struct {
+	name        string
+	sqlType     string
+	nullable    bool
+	primaryKey  bool
+	constraints []string
+}
+
+// modelIndex is an index derived from the fields naming it.
+type modelIndex struct {
+	name    string
+	unique  bool
+	columns []string
+}
+
+// modelStatements returns the statements creating the table and indexes for one model.
+func modelStatements(model any) ([]string, error) {
+	t := reflect.TypeOf(model)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("SchemaFromStructs model must be a struct or pointer to one, not %T", model)
+	}
+	table := strings.ToLower(t.Name())
+	if n, ok := model.(TableNamer); ok {
+		table = n.TableName()
+	} else if n, ok := reflect.New(t).Interface().(TableNamer); ok {
+		table = n.TableName()
+	}
+	if table == "" {
+		return nil, &ModelError{Model: t.String(), Err: "no table name"}
+	}
+	var columns []modelColumn
+	var indexes []*modelIndex
+	err := modelFields(t, func(f reflect.StructField, name string, opts []string) error {
+		col, err := modelColumnFor(t, table, f, name, opts, &indexes)
+		columns = append(columns, col)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, &ModelError{Model: t.String(), Err: "no columns"}
+	}
+
+	var keys []string
+	for _, c := range columns {
+		if c.primaryKey {
+			keys = append(keys, quoteIdent(c.name))
+		}
+	}
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		def := quoteIdent(c.name) + " " + c.sqlType
+		// A lone INTEGER PRIMARY KEY is the rowid, which SQLite assigns if it isn't given.
+		rowid := c.primaryKey && len(keys) == 1 && strings.EqualFold(c.sqlType, "INTEGER")
+		if !c.nullable && !rowid {
+			def += " NOT NULL"
+		}
+		if c.primaryKey && len(keys) == 1 {
+			def += " PRIMARY KEY"
+		}
+		defs[i] = strings.Join(append([]string{def}, c.constraints...), " ")
+	}
+	if len(keys) > 1 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(keys, ", ")+")")
+	}
+	statements := []string{"CREATE TABLE " + quoteIdent(table) + " (" + strings.Join(defs, ", ") + ");"}
+	for _, ix := range indexes {
+		create := "CREATE INDEX "
+		if ix.unique {
+			create = "CREATE UNIQUE INDEX "
+		}
+		statements = append(statements, create+quoteIdent(ix.name)+" ON "+quoteIdent(table)+" ("+strings.Join(quoteIdents(ix.columns), ", ")+");")
+	}
+	return statements, nil
+}
+
+// modelFields calls fn for each field of a model that is a column, in order, with its column name
+// and tag options.
+func modelFields(t reflect.Type, fn func(f reflect.StructField, name string, opts []string) error) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		name, rest, _ := strings.Cut(tag, ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			if err := modelFields(ft, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		var opts []string
+		if rest != "" {
+			opts = strings.Split(rest, ",")
+		}
+		if err := fn(f, name, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modelColumnFor derives the column for a field, adding any indexes it names to indexes.
+func modelColumnFor(t reflect.Type, table string, f reflect.StructField, name string, opts []string, indexes *[]*modelIndex) (modelColumn, error) {
+	fieldErr := func(format string, args ...any) error {
+		return &ModelError{Model: t.String(), Field: f.Name, Err: fmt.Sprintf(format, args...)}
+	}
+	col := modelColumn{name: name}
+	col.sqlType, col.nullable = columnType(f.Type)
+	addIndex := func(ixName string, unique bool) {
+		for _, ix := range *indexes {
+			if ix.name == ixName {
+				ix.columns = append(ix.columns, name)
+				return
+			}
+		}
+		*indexes = append(*indexes, &modelIndex{name: ixName, unique: unique, columns: []string{name}})
+	}
+	for _, opt := range opts {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "type":
+			col.sqlType = value
+		case "pk":
+			col.primaryKey = true
+		case "unique":
+			if hasValue {
+				addIndex(value, true)
+			} else {
+				col.constraints = append(col.constraints, "UNIQUE")
+			}
+		case "index":
+			if !hasValue {
+				value = table + "_" + name + "_idx"
+			}
+			addIndex(value, false)
+		case "fk":
+			parent, column, hasColumn := strings.Cut(value, ".")
+			if parent == "" {
+				return col, fieldErr("fk option has no table")
+			}
+			ref := "REFERENCES " + quoteIdent(parent)
+			if hasColumn {
+				ref += "(" + quoteIdent(column) + ")"
+			}
+			col.constraints = append(col.constraints, ref)
+		case "default":
+			col.constraints = append(col.constraints, "DEFAULT "+value)
+		case "":
+		default:
+			return col, fieldErr("unknown option %q", key)
+		}
+	}
+	if col.sqlType == "" {
+		return col, fieldErr("no SQL type for Go type %s; give one with the type option", f.Type)
+	}
+	return col, nil
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// columnType returns the declared type for values of a Go type, empty if there is no natural one,
+// and whether the column should accept NULL.
+func columnType(t reflect.Type) (string, bool) {
+	nullable := false
+	if t.Kind() == reflect.Pointer {
+		t, nullable = t.Elem(), true
+	}
+	switch t {
+	case timeType:
+		return "TIMESTAMP", nullable
+	case rawJSONType:
+		return "TEXT", true
+	}
+	// sql.NullString, sql.Null[T] and the like hold their value in their first field.
+	if t.Kind() == reflect.Struct && t.PkgPath() == "database/sql" && strings.HasPrefix(t.Name(), "Null") && t.NumField() == 2 {
+		sqlType, _ := columnType(t.Field(0).Type)
+		return sqlType, true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "INTEGER", nullable
+	case reflect.Float32, reflect.Float64:
+		return "REAL", nullable
+	case reflect.String:
+		return "TEXT", nullable
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "BLOB", true
+		}
+		return "", true
+	case reflect.Map:
+		return "", true
+	}
+	return "", nullable
+}
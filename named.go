@@ -0,0 +1,124 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type NamedParamError struct {
+	Name string
+}
+
+func (e *NamedParamError) Error() string {
+	return fmt.Sprintf("No value for named parameter %s", e.Name)
+}
+
+// Named rewrites a query using named parameters (":name", "@name" or "$name") to use positional
+// placeholders, returning the arguments in order. A parameter used more than once is bound each
+// time. Parameters in string literals, quoted identifiers and comments are left alone. Bindings
+// not used by the query are ignored, so one map can serve several queries; a parameter with no
+// binding is a NamedParamError. Keys of params are names without the prefix.
+// query -- SQL using named parameters
+// params -- value of each parameter
+func Named(query string, params map[string]any) (string, []any, error) {
+	var b strings.Builder
+	var args []any
+	r := []rune(query)
+	start := 0
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			i += 2
+			for i < len(r) && !(r[i] == '*' && i+1 < len(r) && r[i+1] == '/') {
+				i++
+			}
+			i++
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			for i++; i < len(r); i++ {
+				if r[i] == closing {
+					if closing != ']' && i+1 < len(r) && r[i+1] == closing {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		case (c == ':' || c == '@' || c == '$') && i+1 < len(r) && isIdentRune(r[i+1]) && r[i+1] != '$':
+			j := i + 1
+			for j < len(r) && isIdentRune(r[j]) && r[j] != '$' {
+				j++
+			}
+			name := string(r[i+1 : j])
+			v, ok := params[name]
+			if !ok {
+				return "", nil, &NamedParamError{string(r[i:j])}
+			}
+			b.WriteString(string(r[start:i]))
+			b.WriteByte('?')
+			args = append(args, v)
+			start = j
+			i = j - 1
+		case isIdentRune(c):
+			for i+1 < len(r) && isIdentRune(r[i+1]) {
+				i++
+			}
+		}
+	}
+	if start < len(r) {
+		b.WriteString(string(r[start:]))
+	}
+	return b.String(), args, nil
+}
+
+// ExecNamed executes a statement using named parameters, as described for Named.
+// ctx -- context for the statement
+// query -- SQL using named parameters
+// params -- value of each parameter
+func (a *AppDB) ExecNamed(ctx context.Context, query string, params map[string]any) (sql.Result, error) {
+	start := time.Now()
+	q, args, err := Named(query, params)
+	var res sql.Result
+	if err == nil {
+		err = a.cfg.retry.do(ctx, func() error {
+			var err error
+			res, err = a.ExecContext(ctx, q, args...)
+			return err
+		})
+	}
+	a.logOp("exec", start, err)
+	return res, err
+}
+
+// QueryNamed runs a query using named parameters, as described for Named.
+// ctx -- context for the query
+// query -- SQL using named parameters
+// params -- value of each parameter
+func (a *AppDB) QueryNamed(ctx context.Context, query string, params map[string]any) (*sql.Rows, error) {
+	q, args, err := Named(query, params)
+	if err != nil {
+		return nil, err
+	}
+	return a.QueryContext(ctx, q, args...)
+}
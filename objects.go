@@ -0,0 +1,261 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"time"
+)
+
+const (
+	// objectsTable holds the size and hash of each stored object.
+	objectsTable = "appdb_objects"
+	// objectChunksTable holds the contents of stored objects, a chunk to a row.
+	objectChunksTable = "appdb_object_chunks"
+)
+
+// DefaultObjectChunkSize is the size of the chunks ObjectStore splits objects into unless its
+// ChunkSize says otherwise.
+const DefaultObjectChunkSize = 256 << 10
+
+// ObjectHashError reports an object whose contents no longer match the hash recorded when it was
+// stored.
+type ObjectHashError struct {
+	Name         string
+	Hash         string
+	ExpectedHash string
+}
+
+func (e *ObjectHashError) Error() string {
+	return fmt.Sprintf("Object %s is corrupt: Got hash %s - Expected %s", e.Name, e.Hash, e.ExpectedHash)
+}
+
+// ObjectStore stores large byte streams split into chunks across rows, so that they can be
+// written and read without holding them whole in memory, with a SHA-256 hash of each checked as
+// it is read. Unlike Blob, each read and write touches only one chunk, so large objects are cheap
+// to stream. Objects are kept in tables of their own, which schema validation ignores.
+type ObjectStore struct {
+	db *AppDB
+	// ChunkSize is the size of the chunks objects are split into as they are stored.
+	ChunkSize int
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name string
+	// Size is the length of the object in bytes.
+	Size int64
+	// Hash is the hex-encoded SHA-256 hash of the object.
+	Hash string
+	// Stored is when the object was stored.
+	Stored time.Time
+}
+
+// OpenObjectStore returns the store of large objects in the database, creating its tables if
+// needed.
+// ctx -- context for the statements
+func (a *AppDB) OpenObjectStore(ctx context.Context) (*ObjectStore, error) {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			statements := []string{
+				"CREATE TABLE IF NOT EXISTS " + objectsTable + " (name TEXT PRIMARY KEY, size INTEGER NOT NULL, hash TEXT NOT NULL, stored_at INTEGER NOT NULL)",
+				"CREATE TABLE IF NOT EXISTS " + objectChunksTable + " (name TEXT NOT NULL, seq INTEGER NOT NULL, data BLOB NOT NULL, PRIMARY KEY (name, seq)) WITHOUT ROWID",
+			}
+			for _, stmt := range statements {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	a.logOp("open_object_store", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStore{db: a, ChunkSize: DefaultObjectChunkSize}, nil
+}
+
+// Put stores the contents of r as the object with the given name, replacing any object stored
+// with it, in a single transaction. The transaction is not retried if the database is busy, since
+// r can't be read again.
+// ctx -- context for the statements
+// name -- name of the object
+// r -- contents of the object
+func (s *ObjectStore) Put(ctx context.Context, name string, r io.Reader) (ObjectInfo, error) {
+	start := time.Now()
+	var info ObjectInfo
+	err := runTx(ctx, s.db.DB, func(tx *sql.Tx) error {
+		var err error
+		info, err = s.put(ctx, tx, name, r)
+		return err
+	})
+	s.db.logOp("put_object", start, err, slog.String("name", name), slog.Int64("size", info.Size))
+	return info, err
+}
+
+func (s *ObjectStore) put(ctx context.Context, tx *sql.Tx, name string, r io.Reader) (ObjectInfo, error) {
+	if err := deleteObject(ctx, tx, name); err != nil {
+		return ObjectInfo{}, err
+	}
+	size := s.ChunkSize
+	if size <= 0 {
+		size = DefaultObjectChunkSize
+	}
+	info := ObjectInfo{Name: name, Stored: time.Now()}
+	h := sha256.New()
+	buf := make([]byte, size)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			info.Size += int64(n)
+			_, err := tx.ExecContext(ctx, "INSERT INTO "+objectChunksTable+" (name, seq, data) VALUES (?, ?, ?)", name, seq, buf[:n])
+			if err != nil {
+				return ObjectInfo{}, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+	info.Hash = hex.EncodeToString(h.Sum(nil))
+	_, err := tx.ExecContext(ctx, "INSERT INTO "+objectsTable+" (name, size, hash, stored_at) VALUES (?, ?, ?, ?)",
+		name, info.Size, info.Hash, info.Stored.UnixMilli())
+	return info, err
+}
+
+// Stat describes the object with the given name, returning sql.ErrNoRows if there is none.
+// ctx -- context for the query
+// name -- name of the object
+func (s *ObjectStore) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	info := ObjectInfo{Name: name}
+	var stored int64
+	err := s.db.QueryRowContext(ctx, "SELECT size, hash, stored_at FROM "+objectsTable+" WHERE name = ?", name).Scan(&info.Size, &info.Hash, &stored)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info.Stored = time.UnixMilli(stored)
+	return info, nil
+}
+
+// Open opens the object with the given name for reading, returning sql.ErrNoRows if there is
+// none. Chunks are read as they are needed, so the object may be replaced or deleted part way
+// through; the Reader then returns an error rather than a mixture of the two. Once the whole object
+// has been read, the Reader returns an ObjectHashError rather than io.EOF if its hash doesn't match.
+// ctx -- context for the queries, which applies to every read
+// name -- name of the object
+func (s *ObjectStore) Open(ctx context.Context, name string) (*ObjectReader, error) {
+	start := time.Now()
+	info, err := s.Stat(ctx, name)
+	s.db.logOp("open_object", start, err, slog.String("name", name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReader{db: s.db, ctx: ctx, info: info, hash: sha256.New()}, nil
+}
+
+// Delete removes the object with the given name, doing nothing if there is none.
+// ctx -- context for the statements
+// name -- name of the object
+func (s *ObjectStore) Delete(ctx context.Context, name string) error {
+	start := time.Now()
+	err := s.db.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, s.db.DB, func(tx *sql.Tx) error {
+			return deleteObject(ctx, tx, name)
+		})
+	})
+	s.db.logOp("delete_object", start, err, slog.String("name", name))
+	return err
+}
+
+func deleteObject(ctx context.Context, tx *sql.Tx, name string) error {
+	for _, table := range []string{objectChunksTable, objectsTable} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE name = ?", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObjectReader reads a stored object a chunk at a time.
+type ObjectReader struct {
+	db   *AppDB
+	ctx  context.Context
+	info ObjectInfo
+	hash hash.Hash
+	seq  int
+	read int64
+	buf  []byte
+	err  error
+}
+
+// Info describes the object being read.
+func (r *ObjectReader) Info() ObjectInfo {
+	return r.info
+}
+
+// Read reads the object, returning io.EOF at its end once its hash has been checked.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads the next chunk into buf, returning io.EOF or an error at the end of the object.
+func (r *ObjectReader) next() error {
+	var chunk []byte
+	err := r.db.QueryRowContext(r.ctx, "SELECT data FROM "+objectChunksTable+" WHERE name = ? AND seq = ?", r.info.Name, r.seq).Scan(&chunk)
+	if err == sql.ErrNoRows {
+		if r.read != r.info.Size {
+			return fmt.Errorf("object %s ended after %d of %d bytes", r.info.Name, r.read, r.info.Size)
+		}
+		if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.info.Hash {
+			return &ObjectHashError{r.info.Name, sum, r.info.Hash}
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	if r.read += int64(len(chunk)); r.read > r.info.Size {
+		return fmt.Errorf("object %s is longer than %d bytes", r.info.Name, r.info.Size)
+	}
+	r.hash.Write(chunk)
+	r.seq++
+	r.buf = chunk
+	return nil
+}
+
+// Close closes the Reader, after which it can't be read.
+func (r *ObjectReader) Close() error {
+	r.buf = nil
+	r.err = errors.New("read of closed object")
+	return nil
+}
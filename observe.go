@@ -0,0 +1,130 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// Keys of the structured fields attached to slow query events.
+const (
+	LogKeySQL  = "sql"
+	LogKeyArgs = "args"
+	LogKeyRows = "rows"
+)
+
+// WithSlowQueryLog logs statements that take longer than threshold at warning level, with their
+// SQL, duration and the number of rows affected. Statements run through the AppDB's methods are
+// timed, including the Exec and Query methods of the embedded sql.DB; statements in transactions
+// are not. Arguments are left out unless WithSlowQueryArgs is also given, since they may hold
+// personal data.
+// threshold -- shortest duration that is logged
+func WithSlowQueryLog(threshold time.Duration) Option {
+	return func(c *config) {
+		c.slowQuery = threshold
+	}
+}
+
+// WithSlowQueryArgs includes statement arguments in the slow query log.
+func WithSlowQueryArgs() Option {
+	return func(c *config) {
+		c.slowQueryArgs = true
+	}
+}
+
+// observer is told about each statement run for an AppDB. res is nil for queries.
+type observer func(query string, args []any, start time.Time, res sql.Result, err error)
+
+// observe records a statement that started at start in the query statistics and slow query log.
+func (a *AppDB) observe(query string, args []any, start time.Time, res sql.Result, err error) {
+	d := time.Since(start)
+	if a.stats != nil {
+		a.stats.record(query, d, res, err)
+	}
+	if a.cfg.slowQuery > 0 && d >= a.cfg.slowQuery {
+		a.logSlow(query, args, d, res, err)
+	}
+}
+
+// logSlow logs a statement that took longer than the slow query threshold.
+func (a *AppDB) logSlow(query string, args []any, d time.Duration, res sql.Result, err error) {
+	fields := []any{
+		slog.String(LogKeyPath, a.path),
+		slog.String(LogKeyApp, a.appName),
+		slog.String(LogKeySQL, query),
+		slog.Duration(LogKeyDuration, d),
+	}
+	if a.cfg.slowQueryArgs {
+		fields = append(fields, slog.Any(LogKeyArgs, args))
+	} else {
+		fields = append(fields, slog.Int(LogKeyArgs, len(args)))
+	}
+	if res != nil {
+		if n, err := res.RowsAffected(); err == nil {
+			fields = append(fields, slog.Int64(LogKeyRows, n))
+		}
+	}
+	if err != nil {
+		fields = append(fields, slog.Any(LogKeyError, err))
+	}
+	a.logger.Warn("appdb slow query", fields...)
+}
+
+// ExecContext executes a statement on the embedded sql.DB, recording it in the query statistics,
+// slow query log and tracer.
+func (a *AppDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, end := a.trace(ctx, "exec", query)
+	start := time.Now()
+	res, err := a.DB.ExecContext(ctx, query, args...)
+	a.observe(query, args, start, res, err)
+	end(err)
+	return res, err
+}
+
+// Exec is ExecContext without a context.
+func (a *AppDB) Exec(query string, args ...any) (sql.Result, error) {
+	return a.ExecContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query on the embedded sql.DB, recording it as for ExecContext. The query is
+// timed until the first row is ready.
+func (a *AppDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, end := a.trace(ctx, "query", query)
+	start := time.Now()
+	rows, err := a.DB.QueryContext(ctx, query, args...)
+	a.observe(query, args, start, nil, err)
+	end(err)
+	return rows, err
+}
+
+// Query is QueryContext without a context.
+func (a *AppDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return a.QueryContext(context.Background(), query, args...)
+}
+
+// QueryRowContext runs a query expected to return at most one row on the embedded sql.DB,
+// recording it as for ExecContext.
+func (a *AppDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, end := a.trace(ctx, "query", query)
+	start := time.Now()
+	row := a.DB.QueryRowContext(ctx, query, args...)
+	a.observe(query, args, start, nil, row.Err())
+	end(row.Err())
+	return row
+}
+
+// QueryRow is QueryRowContext without a context.
+func (a *AppDB) QueryRow(query string, args ...any) *sql.Row {
+	return a.QueryRowContext(context.Background(), query, args...)
+}
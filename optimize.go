@@ -0,0 +1,99 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"time"
+)
+
+// idlePoll is how often to check whether the database has become idle.
+const idlePoll = 50 * time.Millisecond
+
+// WithOptimize runs PRAGMA optimize when the database is closed and, if interval is positive,
+// every interval while it is open, keeping the query planner's statistics up to date in
+// long-running applications. Scheduled runs wait until no statements are running.
+// interval -- time between runs while open, or zero to run only on close
+func WithOptimize(interval time.Duration) Option {
+	return func(c *config) {
+		c.optimize = true
+		c.optimizeInterval = interval
+	}
+}
+
+// WithAnalyze runs ANALYZE every interval while the database is open and no statements are
+// running. ANALYZE reads every table and index, so the interval should be long; PRAGMA optimize
+// (see WithOptimize) only analyzes tables that need it and is usually enough.
+// interval -- time between runs
+func WithAnalyze(interval time.Duration) Option {
+	return func(c *config) {
+		c.analyzeInterval = interval
+	}
+}
+
+// Optimize runs PRAGMA optimize, which analyzes the tables whose statistics are likely to be out
+// of date. It is quick, and suits being run periodically or before closing.
+func (a *AppDB) Optimize(ctx context.Context) error {
+	start := time.Now()
+	err := optimize(ctx, a.DB)
+	a.logOp("optimize", start, err)
+	return err
+}
+
+// Analyze runs ANALYZE, gathering statistics on every table and index for the query planner.
+func (a *AppDB) Analyze(ctx context.Context) error {
+	start := time.Now()
+	err := analyze(ctx, a.DB)
+	a.logOp("analyze", start, err)
+	return err
+}
+
+func optimize(ctx context.Context, db querier) error {
+	_, err := db.ExecContext(ctx, "PRAGMA optimize")
+	return err
+}
+
+func analyze(ctx context.Context, db querier) error {
+	_, err := db.ExecContext(ctx, "ANALYZE")
+	return err
+}
+
+// maintain runs fn every interval once the database is idle, until ctx is cancelled.
+func (a *AppDB) maintain(ctx context.Context, op string, interval time.Duration, fn func(context.Context, querier) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Wait for the application's statements to finish so maintenance doesn't hold them up.
+		if a.waitIdle(ctx) != nil {
+			return
+		}
+		start := time.Now()
+		err := fn(ctx, a.DB)
+		a.logOp(op, start, err)
+	}
+}
+
+// waitIdle waits until no connections are in use, or ctx ends.
+func (a *AppDB) waitIdle(ctx context.Context) error {
+	for a.DB.Stats().InUse > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(idlePoll):
+		}
+	}
+	return nil
+}
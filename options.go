@@ -0,0 +1,198 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Option configures how a database is opened by InitAppDB or Open.
+type Option func(*config)
+
+// config holds the settings applied when a database is opened.
+type config struct {
+	journalMode JournalMode
+	synchronous Synchronous
+	pageSize    int
+	cacheSize   int
+	mmapSize    int64
+	tempStore   TempStore
+	autoVacuum  AutoVacuum
+	secure      bool
+	busyTimeout time.Duration
+	foreignKeys bool
+	logger      Logger
+	tracer      Tracer
+	driver      string
+	dirMode     os.FileMode
+	fileMode    os.FileMode
+	envOverride bool
+	lockFile    bool
+	retry       RetryPolicy
+	extensions  extensions
+
+	stmtCacheSize int
+	slowQuery     time.Duration
+	slowQueryArgs bool
+	queryStats    bool
+
+	autoBackupInterval time.Duration
+	autoBackupDir      string
+	autoBackupSink     BackupSink
+	autoBackupKeep     int
+	walHook            WALHook
+	walHookInterval    time.Duration
+	autoCheckpoint     int // -1 leaves SQLite's default
+	optimize           bool
+	optimizeInterval   time.Duration
+	analyzeInterval    time.Duration
+
+	schemaChecksum bool
+	schemaLint     bool
+	requiredTables []string
+	seed           []string
+	seedFuncs      []SeedFunc
+	applicationID  bool
+	encryptionKey  []byte
+
+	beforeMigrate []MigrateHook
+	afterMigrate  []MigrateHook
+	beforeStep    []StepHook
+	afterStep     []StepHook
+}
+
+// newConfig returns the default configuration with the given options applied.
+func newConfig(opts []Option) *config {
+	c := &config{
+		foreignKeys: true,
+		busyTimeout: DefaultBusyTimeout,
+		logger:      nopLogger{},
+		tracer:      nopTracer{},
+		driver:      driverName,
+		dirMode:     0700,
+		fileMode:    0600,
+
+		stmtCacheSize:  DefaultStmtCacheSize,
+		autoCheckpoint: -1,
+		extensions:     extensions{hooks: newConnHooks(), attachments: &attachments{}},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithWAL puts the database into write-ahead logging mode. It is shorthand for WithJournalMode(WAL).
+func WithWAL() Option {
+	return WithJournalMode(WAL)
+}
+
+// DefaultBusyTimeout is how long SQLite waits on a locked database unless WithBusyTimeout says
+// otherwise. It matches the default of github.com/mattn/go-sqlite3, so all drivers behave alike.
+const DefaultBusyTimeout = 5 * time.Second
+
+// WithDirMode sets the permissions of the directory created to hold a new database. The default
+// is 0700. Existing directories are left as they are.
+func WithDirMode(mode os.FileMode) Option {
+	return func(c *config) {
+		c.dirMode = mode.Perm()
+	}
+}
+
+// WithFileMode sets the permissions of a newly created database file. The default is 0600, since
+// application databases often hold private data. SQLite gives its journal and WAL files the same
+// permissions as the database file.
+func WithFileMode(mode os.FileMode) Option {
+	return func(c *config) {
+		c.fileMode = mode.Perm()
+	}
+}
+
+// WithBusyTimeout sets how long SQLite waits on a locked database before returning SQLITE_BUSY,
+// applied to every connection. A timeout of zero returns SQLITE_BUSY immediately.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d < 0 {
+			d = 0
+		}
+		c.busyTimeout = d
+	}
+}
+
+// WithForeignKeys enables or disables foreign key enforcement on every connection. Enforcement is
+// on by default; legacy schemas whose data doesn't satisfy their foreign keys can turn it off.
+func WithForeignKeys(enabled bool) Option {
+	return func(c *config) {
+		c.foreignKeys = enabled
+	}
+}
+
+// logFields returns the settings recorded with open events, so the log shows how the database was
+// configured.
+func (c *config) logFields() []any {
+	var f []any
+	if c.journalMode != "" {
+		f = append(f, slog.String("journalMode", string(c.journalMode)))
+	}
+	if c.synchronous != "" {
+		f = append(f, slog.String("synchronous", string(c.synchronous)))
+	}
+	return f
+}
+
+// connStatements returns the statements that must be run on every new connection, because SQLite
+// keeps these settings per connection rather than in the database file. When create is set the
+// database is new, and settings that must be made before anything is written come first.
+func (c *config) connStatements(create bool) []string {
+	var s []string
+	if c.encryptionKey != nil {
+		s = append(s, keyStatement(c.encryptionKey))
+	}
+	if create && c.pageSize > 0 {
+		s = append(s, fmt.Sprintf("PRAGMA page_size = %d ;", c.pageSize))
+	}
+	if create && c.autoVacuum != "" {
+		s = append(s, fmt.Sprintf("PRAGMA auto_vacuum = %s ;", c.autoVacuum))
+	}
+	if c.journalMode != "" {
+		s = append(s, fmt.Sprintf("PRAGMA journal_mode = %s ;", c.journalMode))
+	}
+	if c.synchronous != "" {
+		s = append(s, fmt.Sprintf("PRAGMA synchronous = %s ;", c.synchronous))
+	}
+	if c.cacheSize != 0 {
+		s = append(s, fmt.Sprintf("PRAGMA cache_size = %d ;", c.cacheSize))
+	}
+	if c.mmapSize > 0 {
+		s = append(s, fmt.Sprintf("PRAGMA mmap_size = %d ;", c.mmapSize))
+	}
+	if c.tempStore != "" {
+		s = append(s, fmt.Sprintf("PRAGMA temp_store = %s ;", c.tempStore))
+	}
+	if c.secure {
+		s = append(s, `PRAGMA secure_delete = ON;`)
+	}
+	if c.walHook != nil {
+		s = append(s, `PRAGMA wal_autocheckpoint = 0;`)
+	} else if c.autoCheckpoint >= 0 {
+		s = append(s, fmt.Sprintf("PRAGMA wal_autocheckpoint = %d ;", c.autoCheckpoint))
+	}
+	s = append(s, fmt.Sprintf("PRAGMA busy_timeout = %d ;", c.busyTimeout.Milliseconds()))
+	if c.foreignKeys {
+		s = append(s, `PRAGMA foreign_keys = ON;`)
+	} else {
+		s = append(s, `PRAGMA foreign_keys = OFF;`)
+	}
+	return s
+}
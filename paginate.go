@@ -0,0 +1,177 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PageQuery describes a query to read a page at a time with keyset pagination, which stays fast
+// and stable however deep the reader goes, unlike LIMIT with OFFSET.
+type PageQuery struct {
+	// Query selects the rows, without ORDER BY or LIMIT clauses.
+	Query string
+	// Args are the arguments for placeholders in Query.
+	Args []any
+	// Keys are result columns that order the rows and together identify each one, for example
+	// {"created", "id"}. Keys must not be NULL, as no row compares after a NULL to continue from.
+	Keys []string
+	// Desc orders the rows by descending keys rather than ascending.
+	Desc bool
+	// Limit is the most rows in a page.
+	Limit int
+}
+
+// Page is one page of results.
+type Page[T any] struct {
+	Items []T
+	// Next is the cursor for the following page, or empty if this is the last page.
+	Next string
+}
+
+type CursorError struct {
+	Cursor string
+	Err    error
+}
+
+func (e *CursorError) Error() string {
+	return fmt.Sprintf("Invalid page cursor %q: %s", e.Cursor, e.Err)
+}
+
+func (e *CursorError) Unwrap() error {
+	return e.Err
+}
+
+// Paginate reads the page of q following cursor, or the first page if cursor is empty. Rows are
+// matched to T as for Query. The cursor returned in Page.Next is an opaque string, safe to put
+// in a URL, holding the keys of the last row of the page. Paginate returns an error on reading a
+// row with a NULL key.
+// ctx -- context for the query
+// db -- database or transaction to query
+// q -- query to paginate
+// cursor -- cursor from the previous page, or empty
+func Paginate[T any](ctx context.Context, db Querier, q PageQuery, cursor string) (Page[T], error) {
+	var page Page[T]
+	if len(q.Keys) == 0 || q.Limit <= 0 {
+		return page, fmt.Errorf("pagination needs keys and a positive limit")
+	}
+	keys := quoteIdents(q.Keys)
+	after, err := decodeCursor(cursor, len(keys))
+	if err != nil {
+		return page, err
+	}
+	direction, compare := "", ">"
+	if q.Desc {
+		direction, compare = " DESC", "<"
+	}
+	// Unary plus drops the keys' declared types, so drivers return them unconverted for the cursor.
+	var s strings.Builder
+	fmt.Fprintf(&s, "SELECT q.*, +q.%s FROM (%s) AS q", strings.Join(keys, ", +q."), q.Query)
+	args := append([]any(nil), q.Args...)
+	if after != nil {
+		fmt.Fprintf(&s, " WHERE (q.%s) %s (%s)", strings.Join(keys, ", q."), compare, placeholders(len(keys)))
+		args = append(args, after...)
+	}
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		order[i] = "q." + k + direction
+	}
+	fmt.Fprintf(&s, " ORDER BY %s LIMIT %d", strings.Join(order, ", "), q.Limit+1)
+
+	rows, err := db.QueryContext(ctx, s.String(), args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return page, err
+	}
+	columns = columns[:len(columns)-len(keys)]
+	last := make([]any, len(keys))
+	for rows.Next() {
+		if len(page.Items) == q.Limit {
+			// The extra row shows there is another page.
+			page.Next, err = encodeCursor(last)
+			if err != nil {
+				return page, err
+			}
+			break
+		}
+		var item T
+		ptrs, err := scanTargets(columns, reflect.ValueOf(&item).Elem())
+		if err != nil {
+			return page, err
+		}
+		for i := range last {
+			ptrs = append(ptrs, &last[i])
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return page, err
+		}
+		for i, k := range last {
+			if k == nil {
+				return page, fmt.Errorf("pagination key %s is NULL", q.Keys[i])
+			}
+		}
+		page.Items = append(page.Items, item)
+	}
+	return page, rows.Err()
+}
+
+// encodeCursor encodes key values, keeping their storage classes as ExportJSON does.
+func encodeCursor(keys []any) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := appendJSONValue(&buf, k); err != nil {
+			return "", err
+		}
+	}
+	buf.WriteByte(']')
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeCursor decodes the n key values of a cursor, returning nil for an empty cursor.
+func decodeCursor(cursor string, n int) ([]any, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, &CursorError{cursor, err}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var raw []any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, &CursorError{cursor, err}
+	}
+	if len(raw) != n {
+		return nil, &CursorError{cursor, fmt.Errorf("has %d keys, expected %d", len(raw), n)}
+	}
+	keys := make([]any, n)
+	for i, v := range raw {
+		if keys[i], err = jsonColumnValue(v); err != nil {
+			return nil, &CursorError{cursor, err}
+		}
+	}
+	return keys, nil
+}
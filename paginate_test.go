@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t, []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, rank INTEGER);"})
+	for i := 1; i <= 5; i++ {
+		if _, err := db.ExecContext(ctx, "INSERT INTO items (id, rank) VALUES (?, ?)", i, i%2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type item struct {
+		ID   int64
+		Rank *int64
+	}
+	q := PageQuery{Query: "SELECT id, rank FROM items", Keys: []string{"rank", "id"}, Limit: 2}
+	var got []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not end")
+		}
+		page, err := Paginate[item](ctx, db, q, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range page.Items {
+			got = append(got, it.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	want := []int64{2, 4, 1, 3, 5}
+	if len(got) != len(want) {
+		t.Fatalf("ids = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ids = %v, want %v", got, want)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO items (id, rank) VALUES (6, NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	// Sorting first, the NULL row would end the first page with a cursor no row follows.
+	q.Limit = 1
+	if _, err := Paginate[item](ctx, db, q, ""); err == nil {
+		t.Error("Paginate with a NULL key succeeded")
+	}
+}
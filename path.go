@@ -0,0 +1,72 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPath returns the conventional per-user location for an application's database,
+// <data dir>/<appName>/<appName>.db, where the data directory depends on the platform:
+//
+//	Linux and other Unix: $XDG_DATA_HOME, or ~/.local/share if that is unset or not absolute
+//	macOS: ~/Library/Application Support
+//	Windows: %AppData%
+//
+// The directory is not created; InitAppDB does that.
+// With WithEnvOverride, the path in the app's environment variable (see PathEnvVar) is returned
+// instead if it is set.
+func DefaultPath(appName string, opts ...Option) (string, error) {
+	if p := newConfig(opts).resolvePath(appName, ""); p != "" {
+		return p, nil
+	}
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appName, appName+".db"), nil
+}
+
+// PathEnvVar returns the name of the environment variable that can override the location of an
+// application's database: the app name in upper case with anything other than letters and digits
+// replaced by underscores, followed by _DB_PATH. For "my-app" it is MY_APP_DB_PATH.
+func PathEnvVar(appName string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(appName))
+	return name + "_DB_PATH"
+}
+
+// WithEnvOverride lets the app's environment variable (see PathEnvVar) override the database
+// path given to InitAppDB, Open, OpenCompat, Migrate, Plan and DefaultPath, so users and CI
+// systems can redirect the database without changes to the application.
+func WithEnvOverride() Option {
+	return func(c *config) {
+		c.envOverride = true
+	}
+}
+
+// resolvePath returns the path from the app's environment variable if the override is enabled
+// and the variable is set, and dbPath otherwise.
+func (c *config) resolvePath(appName string, dbPath string) string {
+	if !c.envOverride {
+		return dbPath
+	}
+	if p := os.Getenv(PathEnvVar(appName)); p != "" {
+		return p
+	}
+	return dbPath
+}
@@ -0,0 +1,48 @@
+//go:build !windows && !darwin
+
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+package appdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		home    string
+		xdg     string
+		want    string
+		wantErr bool
+	}{
+		{name: "XDG_DATA_HOME set", home: "/home/user", xdg: "/data", want: "/data"},
+		{name: "XDG_DATA_HOME unset", home: "/home/user", want: filepath.Join("/home/user", ".local", "share")},
+		{name: "XDG_DATA_HOME relative", home: "/home/user", xdg: "data", want: filepath.Join("/home/user", ".local", "share")},
+		{name: "HOME unset", wantErr: true},
+		{name: "HOME unset, XDG_DATA_HOME set", xdg: "/data", want: "/data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", tt.home)
+			t.Setenv("XDG_DATA_HOME", tt.xdg)
+			got, err := dataDir()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dataDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("dataDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JournalMode is a SQLite rollback journal mode, set with WithJournalMode.
+type JournalMode string
+
+const (
+	JournalDelete   JournalMode = "DELETE"
+	JournalTruncate JournalMode = "TRUNCATE"
+	JournalPersist  JournalMode = "PERSIST"
+	JournalMemory   JournalMode = "MEMORY"
+	JournalOff      JournalMode = "OFF"
+	WAL             JournalMode = "WAL"
+)
+
+// Synchronous is a SQLite synchronous setting, set with WithSynchronous. Lower settings sync to
+// disk less often, trading durability after a power loss or OS crash for speed.
+type Synchronous string
+
+const (
+	SyncOff    Synchronous = "OFF"
+	SyncNormal Synchronous = "NORMAL"
+	SyncFull   Synchronous = "FULL"
+	SyncExtra  Synchronous = "EXTRA"
+)
+
+// level returns the number SQLite reports for the setting.
+func (s Synchronous) level() string {
+	switch s {
+	case SyncOff:
+		return "0"
+	case SyncNormal:
+		return "1"
+	case SyncFull:
+		return "2"
+	case SyncExtra:
+		return "3"
+	}
+	return string(s)
+}
+
+// TempStore is where SQLite keeps temporary tables and indices, set with WithTempStore.
+type TempStore string
+
+const (
+	TempStoreDefault TempStore = "DEFAULT"
+	TempStoreFile    TempStore = "FILE"
+	TempStoreMemory  TempStore = "MEMORY"
+)
+
+// level returns the number SQLite reports for the setting.
+func (t TempStore) level() string {
+	switch t {
+	case TempStoreDefault:
+		return "0"
+	case TempStoreFile:
+		return "1"
+	case TempStoreMemory:
+		return "2"
+	}
+	return string(t)
+}
+
+// AutoVacuum is a SQLite auto-vacuum mode, set with WithAutoVacuum.
+type AutoVacuum string
+
+const (
+	AutoVacuumNone AutoVacuum = "NONE"
+	AutoVacuumFull AutoVacuum = "FULL"
+	Incremental    AutoVacuum = "INCREMENTAL"
+)
+
+// level returns the number SQLite reports for the mode.
+func (v AutoVacuum) level() string {
+	switch v {
+	case AutoVacuumNone:
+		return "0"
+	case AutoVacuumFull:
+		return "1"
+	case Incremental:
+		return "2"
+	}
+	return string(v)
+}
+
+type PragmaError struct {
+	Pragma   string
+	Value    string
+	Expected string
+}
+
+func (e *PragmaError) Error() string {
+	return fmt.Sprintf("PRAGMA %s not applied: Got %s - Expected %s", e.Pragma, e.Value, e.Expected)
+}
+
+// WithJournalMode sets the journal mode, applied when the database is opened and on every
+// connection. Opening fails with a PragmaError if SQLite doesn't accept the mode, for example
+// WAL on an in-memory database. Most desktop applications want WAL, which lets readers carry on
+// while another connection writes.
+func WithJournalMode(mode JournalMode) Option {
+	return func(c *config) {
+		c.journalMode = mode
+	}
+}
+
+// WithSynchronous sets the synchronous mode on every connection. SyncNormal is usually enough
+// with WAL; SyncOff suits cache-style databases that can be rebuilt if lost.
+func WithSynchronous(mode Synchronous) Option {
+	return func(c *config) {
+		c.synchronous = mode
+	}
+}
+
+// WithPageSize sets the page size, in bytes, of a newly created database. It must be a power of two
+// from 512 to 65536. It has no effect on an existing database, whose page size can only be changed
+// by a VACUUM.
+func WithPageSize(bytes int) Option {
+	return func(c *config) {
+		c.pageSize = bytes
+	}
+}
+
+// WithCacheSize sets the page cache size on every connection. As with PRAGMA cache_size, a
+// positive value is a number of pages and a negative value is a size in KiB.
+func WithCacheSize(size int) Option {
+	return func(c *config) {
+		c.cacheSize = size
+	}
+}
+
+// WithMmapSize sets the maximum number of bytes of the database file SQLite maps into memory on
+// every connection, which can speed up read-heavy applications. SQLite may cap it at a limit set
+// when it was compiled, so the setting isn't verified.
+func WithMmapSize(bytes int64) Option {
+	return func(c *config) {
+		c.mmapSize = bytes
+	}
+}
+
+// WithTempStore sets where temporary tables and indices are kept on every connection. Keeping them
+// in memory avoids writes to slow or wear-sensitive storage.
+func WithTempStore(store TempStore) Option {
+	return func(c *config) {
+		c.tempStore = store
+	}
+}
+
+// WithAutoVacuum sets the auto-vacuum mode of a newly created database. The mode is fixed when the
+// schema is created and has no effect on an existing database. With Incremental, free pages are
+// kept until reclaimed with IncrementalVacuum.
+func WithAutoVacuum(mode AutoVacuum) Option {
+	return func(c *config) {
+		c.autoVacuum = mode
+	}
+}
+
+// IncrementalVacuum returns up to pages free pages to the filesystem, or all of them if pages is
+// zero or less. It only has an effect on databases created with WithAutoVacuum(Incremental).
+func (a *AppDB) IncrementalVacuum(pages int) error {
+	return a.IncrementalVacuumContext(context.Background(), pages)
+}
+
+// IncrementalVacuumContext is IncrementalVacuum with a context.
+func (a *AppDB) IncrementalVacuumContext(ctx context.Context, pages int) error {
+	start := time.Now()
+	if pages < 0 {
+		pages = 0
+	}
+	// Each step of the pragma frees one page, so it must be run to completion.
+	rows, err := a.QueryContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	a.logOp("incremental_vacuum", start, err)
+	return err
+}
+
+// WithSecureDelete turns on secure_delete on every connection, so deleted content is overwritten
+// with zeros rather than left in free pages. This suits applications handling personal data, at
+// the cost of extra writes.
+func WithSecureDelete() Option {
+	return func(c *config) {
+		c.secure = true
+	}
+}
+
+// verifyCreatePragmas checks that the settings made when creating a database have taken effect.
+func verifyCreatePragmas(ctx context.Context, db *sql.DB, c *config) error {
+	if c.pageSize > 0 {
+		if err := verifyPragma(ctx, db, "page_size", strconv.Itoa(c.pageSize)); err != nil {
+			return err
+		}
+	}
+	if c.autoVacuum != "" {
+		if err := verifyPragma(ctx, db, "auto_vacuum", c.autoVacuum.level()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyPragmas checks that the configured settings have taken effect.
+func verifyPragmas(ctx context.Context, db *sql.DB, c *config) error {
+	if c.journalMode != "" {
+		if err := verifyPragma(ctx, db, "journal_mode", string(c.journalMode)); err != nil {
+			return err
+		}
+	}
+	if c.synchronous != "" {
+		if err := verifyPragma(ctx, db, "synchronous", c.synchronous.level()); err != nil {
+			return err
+		}
+	}
+	foreignKeys := "0"
+	if c.foreignKeys {
+		foreignKeys = "1"
+	}
+	if err := verifyPragma(ctx, db, "foreign_keys", foreignKeys); err != nil {
+		return err
+	}
+	if c.cacheSize != 0 {
+		if err := verifyPragma(ctx, db, "cache_size", strconv.Itoa(c.cacheSize)); err != nil {
+			return err
+		}
+	}
+	if c.tempStore != "" {
+		if err := verifyPragma(ctx, db, "temp_store", c.tempStore.level()); err != nil {
+			return err
+		}
+	}
+	if c.secure {
+		if err := verifyPragma(ctx, db, "secure_delete", "1"); err != nil {
+			return err
+		}
+	}
+	if err := verifyPragma(ctx, db, "busy_timeout", strconv.FormatInt(c.busyTimeout.Milliseconds(), 10)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyPragma checks the value SQLite reports for a pragma, ignoring case.
+func verifyPragma(ctx context.Context, db querier, pragma string, expected string) error {
+	var value string
+	if err := db.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&value); err != nil {
+		return err
+	}
+	if !strings.EqualFold(value, expected) {
+		return &PragmaError{pragma, value, expected}
+	}
+	return nil
+}
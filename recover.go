@@ -0,0 +1,327 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recovery describes the outcome of RecoverAppDB.
+type Recovery struct {
+	// CorruptPath is where the damaged database file was moved to.
+	CorruptPath string
+	// Rows counts the rows copied into each table of the new database.
+	Rows map[string]int64
+	// Incomplete lists the tables whose rows could only be partly read.
+	Incomplete []string
+	// ForeignKeyViolations lists the recovered rows that refer to parent rows that weren't
+	// recovered, one per entry. Rows are copied with foreign key enforcement off, so they are kept.
+	ForeignKeyViolations []string
+}
+
+// RecoverAppDB rebuilds a damaged database. It creates a fresh database with the given schema,
+// copies across every row that can still be read from tables present in both, and then moves the
+// damaged file aside with a timestamped ".corrupt-" suffix before putting the new database in its
+// place. Columns missing from either side are skipped, so the schema may be newer than the damaged
+// database's. The new database is returned open, along with what was recovered.
+// dbPath -- the filesystem location of the damaged database file
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema in use (8-bit integer, used to validate database)
+// schema -- SQL statements to initialise database schema.
+// opts -- options configuring the database connection.
+func RecoverAppDB(dbPath string, appName string, schemaVersion uint8, schema []string, opts ...Option) (*AppDB, *Recovery, error) {
+	return RecoverAppDBContext(context.Background(), dbPath, appName, schemaVersion, schema, opts...)
+}
+
+// RecoverAppDBContext is RecoverAppDB with a context.
+func RecoverAppDBContext(ctx context.Context, dbPath string, appName string, schemaVersion uint8, schema []string, opts ...Option) (*AppDB, *Recovery, error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	if isMemoryPath(dbPath) {
+		return nil, nil, fmt.Errorf("cannot recover an in-memory database")
+	}
+	path := filePath(dbPath)
+	rec, err := rebuild(ctx, dbPath, path+".recovering", appName, schemaVersion, schema, cfg)
+	logEvent(cfg.logger, "recover", path, appName, schemaVersion, start, err, recoveryFields(rec)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := OpenContext(ctx, dbPath, appName, schemaVersion, opts...)
+	if err != nil {
+		return nil, rec, err
+	}
+	return db, rec, nil
+}
+
+// rebuild creates the new database at newPath, salvages what it can from dbPath into it, and
+// swaps the files.
+func rebuild(ctx context.Context, dbPath string, newPath string, appName string, schemaVersion uint8, schema []string, cfg *config) (*Recovery, error) {
+	path := filePath(dbPath)
+	for _, f := range []string{newPath, newPath + "-journal", newPath + "-wal", newPath + "-shm"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	newCfg := *cfg
+	newCfg.envOverride = false
+	newCfg.lockFile = false
+	fresh, err := openNewAppDB(ctx, newPath, appName, schemaVersion, schema, &newCfg)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recovery{Rows: map[string]int64{}}
+	err = salvage(ctx, dbPath, fresh, cfg, rec)
+	if cerr := fresh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return nil, err
+	}
+	rec.CorruptPath = corruptPath(path)
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err := os.Rename(path+suffix, rec.CorruptPath+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		os.Remove(newPath + suffix)
+	}
+	if err := os.Rename(newPath, path); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// corruptPath returns an unused path to move the damaged database at path to, suffixed with the
+// time so that repeated recoveries keep every damaged file.
+func corruptPath(path string) string {
+	base := path + ".corrupt-" + time.Now().Format("20060102T150405.000000000")
+	p := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// openNewAppDB creates and initialises a database file at path, which must not already exist.
+func openNewAppDB(ctx context.Context, path string, appName string, schemaVersion uint8, schema []string, cfg *config) (*sql.DB, error) {
+	if err := createDBFile(path, cfg); err != nil {
+		return nil, err
+	}
+	db, err := openAppDBNoValidate(ctx, path, cfg, true)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	err = initSchema(ctx, db, appName, schemaVersion, schema, cfg.applicationID)
+	if err == nil {
+		err = verifyCreatePragmas(ctx, db, cfg)
+	}
+	if err == nil && cfg.schemaChecksum {
+		err = storeSchemaChecksum(ctx, db)
+	}
+	if err != nil {
+		db.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return db, nil
+}
+
+// salvage copies the readable rows of every table in fresh from the damaged database at dbPath.
+// A damaged database that can't be opened at all contributes no rows.
+func salvage(ctx context.Context, dbPath string, fresh *sql.DB, cfg *config, rec *Recovery) error {
+	var statements []string
+	if cfg.encryptionKey != nil {
+		statements = append(statements, keyStatement(cfg.encryptionKey))
+	}
+	// Rows are only read from the damaged database, so it is opened without the application's
+	// functions, hooks or attachments.
+	old, err := openDriver(cfg.driver, dbPath, nil, statements, nil)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	old.SetMaxOpenConns(1)
+	tables, err := userTables(ctx, fresh)
+	if err != nil {
+		return err
+	}
+	// Tables are copied in name order, so children may come before their parents, and a damaged
+	// database may have lost parent rows; copy with enforcement off and report violations after.
+	conn, err := fresh.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	for _, table := range tables {
+		columns, err := sharedColumns(ctx, old, conn, table)
+		if err != nil || len(columns) == 0 {
+			// The table is unreadable or missing from the damaged database.
+			continue
+		}
+		n, complete, err := copyRows(ctx, old, conn, table, columns)
+		if err != nil {
+			return err
+		}
+		rec.Rows[table] = n
+		if !complete {
+			rec.Incomplete = append(rec.Incomplete, table)
+		}
+	}
+	err = checkForeignKeys(ctx, conn)
+	var fkErr *ForeignKeyError
+	if errors.As(err, &fkErr) {
+		rec.ForeignKeyViolations = fkErr.Violations
+		return nil
+	}
+	return err
+}
+
+// userTables lists the application's tables, leaving out SQLite's and appdb's own.
+func userTables(ctx context.Context, db querier) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE 'appdb\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// tableColumns lists the columns of a table in order.
+func tableColumns(ctx context.Context, db querier, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// sharedColumns lists the columns of table present in both databases, in the order of b.
+func sharedColumns(ctx context.Context, a querier, b querier, table string) ([]string, error) {
+	aColumns, err := tableColumns(ctx, a, table)
+	if err != nil {
+		return nil, err
+	}
+	bColumns, err := tableColumns(ctx, b, table)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(aColumns))
+	for _, c := range aColumns {
+		have[c] = true
+	}
+	var columns []string
+	for _, c := range bColumns {
+		if have[c] {
+			columns = append(columns, c)
+		}
+	}
+	return columns, nil
+}
+
+// copyRows copies columns of table from src to dst in one transaction, stopping quietly at the
+// first row that can't be read. complete reports whether every row was read.
+func copyRows(ctx context.Context, src *sql.DB, dst *sql.Conn, table string, columns []string) (n int64, complete bool, err error) {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+	}
+	list := strings.Join(quoted, ", ")
+	rows, err := src.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", list, quoteIdent(table)))
+	if err != nil {
+		return 0, false, nil
+	}
+	defer rows.Close()
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)", quoteIdent(table), list, placeholders))
+	if err != nil {
+		return 0, false, err
+	}
+	defer stmt.Close()
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	complete = true
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			complete = false
+			break
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return 0, false, err
+		}
+		n++
+	}
+	complete = complete && rows.Err() == nil
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return n, complete, nil
+}
+
+// quoteIdent quotes an SQL identifier such as a table or column name.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// recoveryFields returns the log attributes describing a recovery.
+func recoveryFields(rec *Recovery) []any {
+	if rec == nil {
+		return nil
+	}
+	var rows int64
+	for _, n := range rec.Rows {
+		rows += n
+	}
+	return []any{slog.String("corrupt_path", rec.CorruptPath), slog.Int64("rows", rows), slog.Int("incomplete", len(rec.Incomplete)),
+		slog.Int("foreign_key_violations", len(rec.ForeignKeyViolations))}
+}
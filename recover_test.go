@@ -0,0 +1,51 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverAppDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	schema := []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);"}
+	db, err := InitAppDB(path, "test", 1, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO items (id, name) VALUES (1, 'a'), (2, 'b')"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		db, rec, err := RecoverAppDB(path, "test", 1, schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if rec.Rows["items"] != 2 {
+			t.Errorf("recovered %d rows, want 2", rec.Rows["items"])
+		}
+		if seen[rec.CorruptPath] {
+			t.Errorf("recoveries share the path %s", rec.CorruptPath)
+		}
+		seen[rec.CorruptPath] = true
+	}
+	for p := range seen {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+}
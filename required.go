@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MissingTablesError lists the tables given to WithRequiredTables that the database lacks.
+type MissingTablesError struct {
+	Tables []string
+}
+
+func (e *MissingTablesError) Error() string {
+	return fmt.Sprintf("Database is missing required tables: %s", strings.Join(e.Tables, ", "))
+}
+
+// WithRequiredTables checks when the database is opened that it has each of the named tables,
+// returning a MissingTablesError listing any that are missing. This catches a database whose
+// schema version is right but whose schema was never fully created, such as one left by an
+// interrupted initialisation.
+// tables -- names of the tables the application needs
+func WithRequiredTables(tables ...string) Option {
+	return func(c *config) {
+		c.requiredTables = append(c.requiredTables, tables...)
+	}
+}
+
+// verifyRequiredTables returns a MissingTablesError if any of the tables don't exist.
+func verifyRequiredTables(ctx context.Context, db querier, tables []string) error {
+	var missing []string
+	for _, t := range tables {
+		exists, err := tableExists(ctx, db, t)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingTablesError{missing}
+	}
+	return nil
+}
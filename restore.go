@@ -0,0 +1,175 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RestoreAppDB replaces the database at dbPath with a backup. The backup is copied beside the
+// database and checked, for the app name, schema version and integrity, before being renamed over
+// the original, so a bad backup leaves the database untouched. The restored database is returned
+// open. The database must not be open; with WithLockFile an open database is detected and
+// reported with an AlreadyOpenError. To restore into a database that is open, use RestoreFrom.
+// backupPath -- the filesystem location of the backup file
+// dbPath -- the filesystem location of the database file
+// appName -- name of application (arbitrary string, used to validate database)
+// schemaVersion -- version of schema in use (8-bit integer, used to validate database)
+// opts -- options configuring the database connection.
+func RestoreAppDB(backupPath string, dbPath string, appName string, schemaVersion uint8, opts ...Option) (*AppDB, error) {
+	return RestoreAppDBContext(context.Background(), backupPath, dbPath, appName, schemaVersion, opts...)
+}
+
+// RestoreAppDBContext is RestoreAppDB with a context.
+func RestoreAppDBContext(ctx context.Context, backupPath string, dbPath string, appName string, schemaVersion uint8, opts ...Option) (*AppDB, error) {
+	start := time.Now()
+	cfg := newConfig(opts)
+	dbPath = cfg.resolvePath(appName, dbPath)
+	err := restoreFile(ctx, backupPath, dbPath, appName, schemaVersion, cfg)
+	logEvent(cfg.logger, "restore", dbPath, appName, schemaVersion, start, err, slog.String("backup", backupPath))
+	if err != nil {
+		return nil, err
+	}
+	return OpenContext(ctx, dbPath, appName, schemaVersion, opts...)
+}
+
+// restoreFile stages and checks the backup, then renames it over the closed database.
+func restoreFile(ctx context.Context, backupPath string, dbPath string, appName string, schemaVersion uint8, cfg *config) error {
+	if isMemoryPath(dbPath) {
+		return fmt.Errorf("cannot restore over an in-memory database, use RestoreFrom")
+	}
+	path := filePath(dbPath)
+	tmp := path + ".restore"
+	if err := stageBackup(ctx, backupPath, tmp, appName, schemaVersion, cfg); err != nil {
+		return err
+	}
+	lock, err := acquireLock(dbPath, cfg)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	// A journal or WAL left by the old database would be applied to the restored one.
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// RestoreFrom replaces the contents of the open database with a backup, using SQLite's backup
+// API so that other connections see the restored database once it is complete. The backup is
+// checked as for RestoreAppDB first. The backup's schema version must match the one the database
+// was opened with.
+// ctx -- context for the restore, checked between steps
+// backupPath -- the filesystem location of the backup file
+func (a *AppDB) RestoreFrom(ctx context.Context, backupPath string) error {
+	start := time.Now()
+	err := a.restoreFrom(ctx, backupPath)
+	a.logOp("restore", start, err, slog.String("backup", backupPath))
+	return err
+}
+
+func (a *AppDB) restoreFrom(ctx context.Context, backupPath string) error {
+	dir := ""
+	if !isMemoryPath(a.dsn) {
+		dir = filepath.Dir(a.path)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(backupPath)+".*.restore")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	if err := stageBackup(ctx, backupPath, tmp, a.appName, a.schemaVersion, a.cfg); err != nil {
+		return err
+	}
+	conn, err := a.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(dc any) error {
+		return restoreConn(ctx, dc, tmp, a.cfg)
+	})
+	if err == errBackupUnsupported {
+		return fmt.Errorf("restoring an open database: %w", err)
+	}
+	return err
+}
+
+// stageBackup copies the backup to tmp and checks the copy, so that the backup itself isn't
+// modified by opening it.
+func stageBackup(ctx context.Context, backupPath string, tmp string, appName string, schemaVersion uint8, cfg *config) error {
+	err := copyFile(backupPath, tmp, cfg.fileMode)
+	if err == nil {
+		err = checkBackup(ctx, tmp, appName, schemaVersion, cfg)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// checkBackup opens the database at path and checks its identity, schema checksum, required
+// tables and integrity.
+func checkBackup(ctx context.Context, path string, appName string, schemaVersion uint8, cfg *config) error {
+	c := *cfg
+	c.lockFile = false
+	db, err := openAppDBNoValidate(ctx, path, &c, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = validateDB(ctx, db, appName, schemaVersion, cfg.applicationID)
+	if err == nil && cfg.schemaChecksum {
+		err = verifySchemaChecksum(ctx, db)
+	}
+	if err == nil {
+		err = verifyRequiredTables(ctx, db, cfg.requiredTables)
+	}
+	if err == nil {
+		err = checkIntegrity(ctx, db, true)
+	}
+	return err
+}
+
+// copyFile copies src to dest, creating or truncating dest with mode, and syncs it to disk.
+func copyFile(src string, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
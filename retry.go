@@ -0,0 +1,123 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy says how operations are retried when the database is locked by another
+// connection or process. The zero value doesn't retry.
+type RetryPolicy struct {
+	// MaxAttempts is the most times an operation is tried, including the first.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for each retry after.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is a reasonable policy for desktop applications sharing a database
+// between processes.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+
+// WithRetry retries ExecStatement, BulkExec and WithTx when they fail because the database is
+// busy or locked, waiting a jittered, exponentially growing delay between attempts. This
+// complements WithBusyTimeout: SQLite can't wait out some lock conflicts, such as two
+// transactions that both read and then try to write, and reports them at once.
+// policy -- how many times to try and how long to wait
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = policy
+	}
+}
+
+// delay returns the jittered delay before retry number n, counting from 0.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do runs fn, trying again while it fails with a busy error and attempts remain.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isBusy(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.delay(attempt - 1)):
+		}
+	}
+}
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED, which may succeed if retried.
+func isBusy(err error) bool {
+	var coded interface{ Code() int }
+	if errors.As(err, &coded) {
+		return coded.Code()&0xff == 5 || coded.Code()&0xff == 6
+	}
+	// Not all drivers expose the result code, but all use SQLite's messages.
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// WithTx runs fn in a transaction, committing it if fn returns nil and rolling it back if fn
+// returns an error or panics. With WithRetry the whole transaction is retried if it fails because
+// the database is locked, so fn may be called more than once.
+// ctx -- context for the transaction
+// fn -- function making the changes
+func (a *AppDB) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, fn)
+	})
+	a.logOp("tx", start, err)
+	return err
+}
+
+// runTx runs fn in one transaction.
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
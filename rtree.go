@@ -0,0 +1,225 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpatialIndex is an R-Tree index of the bounding boxes of the rows of a content table, kept up to
+// date by triggers on that table. Coordinates are planar: distances are in the units of the
+// coordinates, so for longitude and latitude they are only a guide over short distances.
+type SpatialIndex struct {
+	db    *AppDB
+	table string
+	// Radius is the distance Nearest searches first, doubling it until it has found enough rows.
+	// It is best set to around the distance between neighbouring rows.
+	Radius float64
+}
+
+// Box is a bounding box.
+type Box struct {
+	MinX, MaxX, MinY, MaxY float64
+}
+
+// Neighbor is a row found by Nearest.
+type Neighbor struct {
+	// RowID is the rowid of the row of the content table.
+	RowID int64
+	// Distance is from the point searched to the nearest edge of the row's box, or zero if the
+	// point is inside it.
+	Distance float64
+}
+
+// CreateSpatialIndex creates the R-Tree table named table indexing the rows of the content table
+// by the coordinates in columns, with triggers keeping it in step as content rows are inserted,
+// updated and deleted, and indexes the existing rows. columns are either the x and y of a point or
+// the minimum x, maximum x, minimum y and maximum y of a box. Rows with a NULL coordinate are not
+// indexed. The content table must have a rowid, so it can't be WITHOUT ROWID. If the index already
+// exists it is left as it is.
+// ctx -- context for the statements
+// table -- name of the R-Tree table
+// content -- name of the table to index
+// columns -- coordinate columns of content
+func (a *AppDB) CreateSpatialIndex(ctx context.Context, table, content string, columns ...string) (*SpatialIndex, error) {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			if err := createSpatialIndex(ctx, tx, table, content, columns); err != nil {
+				return err
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("create_spatial_index", start, err, slog.String("table", table), slog.String("content", content))
+	if err != nil {
+		return nil, err
+	}
+	return a.SpatialIndex(table), nil
+}
+
+// SpatialIndex returns the R-Tree table created earlier by CreateSpatialIndex.
+// table -- name of the R-Tree table
+func (a *AppDB) SpatialIndex(table string) *SpatialIndex {
+	return &SpatialIndex{db: a, table: table, Radius: 1}
+}
+
+func createSpatialIndex(ctx context.Context, tx *sql.Tx, table, content string, columns []string) error {
+	switch len(columns) {
+	case 2:
+		columns = []string{columns[0], columns[0], columns[1], columns[1]}
+	case 4:
+	default:
+		return fmt.Errorf("spatial index %s needs 2 or 4 coordinate columns, not %d", table, len(columns))
+	}
+	exists, err := tableExists(ctx, tx, table)
+	if err != nil || exists {
+		return err
+	}
+	rt := quoteIdent(table)
+	// row returns the values to index for a row and the condition that it has a box.
+	row := func(prefix string) (string, string) {
+		values := []string{prefix + "rowid"}
+		var conds []string
+		for _, c := range columns {
+			values = append(values, prefix+quoteIdent(c))
+			conds = append(conds, prefix+quoteIdent(c)+" IS NOT NULL")
+		}
+		return strings.Join(values, ", "), strings.Join(conds, " AND ")
+	}
+	newValues, newCond := row("new.")
+	insert := fmt.Sprintf("INSERT INTO %s SELECT %s WHERE %s;", rt, newValues, newCond)
+	remove := fmt.Sprintf("DELETE FROM %s WHERE id = old.rowid;", rt)
+	values, cond := row("")
+	statements := []string{fmt.Sprintf("CREATE VIRTUAL TABLE %s USING rtree(id, min_x, max_x, min_y, max_y)", rt)}
+	statements = append(statements, syncTriggers(table, content, insert, remove)...)
+	statements = append(statements, fmt.Sprintf("INSERT INTO %s SELECT %s FROM %s WHERE %s", rt, values, quoteIdent(content), cond))
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Intersecting returns the rowids of the rows whose boxes overlap box, or for points, lie in it.
+// ctx -- context for the query
+// box -- box to search
+func (s *SpatialIndex) Intersecting(ctx context.Context, box Box) ([]int64, error) {
+	start := time.Now()
+	found, err := s.intersecting(ctx, box)
+	ids := make([]int64, len(found))
+	for i, f := range found {
+		ids[i] = f.id
+	}
+	s.db.logOp("spatial_search", start, err, slog.String("table", s.table), slog.Int("results", len(ids)))
+	return ids, err
+}
+
+// Nearest returns the n rows nearest to the point x, y, nearest first.
+// ctx -- context for the queries
+// x -- x coordinate of the point
+// y -- y coordinate of the point
+// n -- number of rows to return
+func (s *SpatialIndex) Nearest(ctx context.Context, x, y float64, n int) ([]Neighbor, error) {
+	start := time.Now()
+	neighbors, err := s.nearest(ctx, x, y, n)
+	s.db.logOp("spatial_nearest", start, err, slog.String("table", s.table), slog.Int("results", len(neighbors)))
+	return neighbors, err
+}
+
+func (s *SpatialIndex) nearest(ctx context.Context, x, y float64, n int) ([]Neighbor, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	radius := s.Radius
+	if radius <= 0 {
+		radius = 1
+	}
+	total := -1
+	for {
+		found, err := s.intersecting(ctx, Box{x - radius, x + radius, y - radius, y + radius})
+		if err != nil {
+			return nil, err
+		}
+		neighbors := make([]Neighbor, len(found))
+		for i, f := range found {
+			dx := math.Max(0, math.Max(f.box.MinX-x, x-f.box.MaxX))
+			dy := math.Max(0, math.Max(f.box.MinY-y, y-f.box.MaxY))
+			neighbors[i] = Neighbor{f.id, math.Hypot(dx, dy)}
+		}
+		sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].Distance < neighbors[j].Distance })
+		// Rows outside the square searched are further away than radius, so the nearest n found
+		// are the nearest of all once the nth is within radius.
+		if len(neighbors) >= n && neighbors[n-1].Distance <= radius {
+			return neighbors[:n], nil
+		}
+		if len(neighbors) < n {
+			if total < 0 {
+				err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteIdent(s.table)).Scan(&total)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if len(neighbors) == total {
+				return neighbors, nil
+			}
+		}
+		radius *= 2
+	}
+}
+
+// rtreeEntry is a row of an R-Tree table.
+type rtreeEntry struct {
+	id  int64
+	box Box
+}
+
+func (s *SpatialIndex) intersecting(ctx context.Context, box Box) ([]rtreeEntry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, min_x, max_x, min_y, max_y FROM "+quoteIdent(s.table)+
+		" WHERE min_x <= ? AND max_x >= ? AND min_y <= ? AND max_y >= ?", box.MaxX, box.MinX, box.MaxY, box.MinY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []rtreeEntry
+	for rows.Next() {
+		var e rtreeEntry
+		if err := rows.Scan(&e.id, &e.box.MinX, &e.box.MaxX, &e.box.MinY, &e.box.MaxY); err != nil {
+			return nil, err
+		}
+		found = append(found, e)
+	}
+	return found, rows.Err()
+}
+
+// Drop removes the R-Tree table and its triggers, leaving the content table as it is.
+// ctx -- context for the statements
+func (s *SpatialIndex) Drop(ctx context.Context) error {
+	start := time.Now()
+	err := s.db.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, s.db.DB, func(tx *sql.Tx) error {
+			if err := dropIndexTable(ctx, tx, s.table); err != nil {
+				return err
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	s.db.logOp("drop_spatial_index", start, err, slog.String("table", s.table))
+	return err
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+)
+
+// WithSavepoint runs fn inside a savepoint of the transaction tx. If fn returns an error, or
+// panics, its changes are rolled back to the savepoint and the outer transaction carries on, so
+// helpers can fail part of a larger transaction without abandoning it. Savepoints may be nested
+// by calling WithSavepoint from fn.
+// ctx -- context for the savepoint statements
+// tx -- the enclosing transaction
+// name -- name of the savepoint
+// fn -- function making the changes
+func WithSavepoint(ctx context.Context, tx *sql.Tx, name string, fn func(tx *sql.Tx) error) (err error) {
+	name = quoteIdent(name)
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.ExecContext(context.Background(), "ROLLBACK TO "+name)
+			tx.ExecContext(context.Background(), "RELEASE "+name)
+			panic(p)
+		}
+		if err != nil {
+			// Rolling back to a savepoint leaves it open, so it must still be released.
+			if _, rerr := tx.ExecContext(context.Background(), "ROLLBACK TO "+name); rerr != nil {
+				return
+			}
+		}
+		if _, rerr := tx.ExecContext(context.Background(), "RELEASE "+name); err == nil {
+			err = rerr
+		}
+	}()
+	return fn(tx)
+}
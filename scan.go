@@ -0,0 +1,202 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Select runs a query and appends each result row to the slice dest points to. Elements may be
+// structs, pointers to structs, or, for single-column results, any type rows.Scan accepts.
+// Columns are matched to struct fields by their `db:"name"` tag, or otherwise by the field name in
+// lower case; a field tagged `db:"-"` is never set, and the fields of embedded structs are
+// included. A column with no matching field is an error.
+// ctx -- context for the query
+// dest -- pointer to a slice to append rows to
+// query -- SQL query to run
+// args -- arguments for placeholders in query
+func (a *AppDB) Select(ctx context.Context, dest any, query string, args ...any) error {
+	start := time.Now()
+	err := selectRows(ctx, a, dest, query, args)
+	a.logOp("select", start, err)
+	return err
+}
+
+// Get runs a query and scans the first result row into dest, which points to a struct or, for
+// single-column results, any type rows.Scan accepts. Columns are matched to fields as for Select.
+// It returns sql.ErrNoRows if the query has no results.
+// ctx -- context for the query
+// dest -- pointer to the value to scan into
+// query -- SQL query to run
+// args -- arguments for placeholders in query
+func (a *AppDB) Get(ctx context.Context, dest any, query string, args ...any) error {
+	start := time.Now()
+	err := getRow(ctx, a, dest, query, args)
+	a.logOp("get", start, err)
+	return err
+}
+
+func selectRows(ctx context.Context, q Querier, dest any, query string, args []any) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Select destination must be a pointer to a slice, not %T", dest)
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		elem := reflect.New(elemType).Elem()
+		if err := scanRow(rows, columns, elem); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+	return rows.Err()
+}
+
+func getRow(ctx context.Context, q Querier, dest any, query string, args []any) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("Get destination must be a non-nil pointer, not %T", dest)
+	}
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := scanRow(rows, columns, v.Elem()); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// scannerType is the type of sql.Scanner, which structs may implement to be scanned whole.
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// scanRow scans the current row into v, a struct, pointer to a struct, or scannable value.
+func scanRow(rows *sql.Rows, columns []string, v reflect.Value) error {
+	ptrs, err := scanTargets(columns, v)
+	if err != nil {
+		return err
+	}
+	return rows.Scan(ptrs...)
+}
+
+// scanTargets returns the pointers to scan the columns into to fill v.
+func scanTargets(columns []string, v reflect.Value) ([]any, error) {
+	target := v
+	if target.Kind() == reflect.Pointer && target.Type().Elem().Kind() == reflect.Struct && !target.Type().Implements(scannerType) {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		target = target.Elem()
+	}
+	if target.Kind() != reflect.Struct || target.Addr().Type().Implements(scannerType) || target.Type() == reflect.TypeOf(time.Time{}) {
+		if len(columns) != 1 {
+			return nil, fmt.Errorf("cannot scan %d columns into %s", len(columns), v.Type())
+		}
+		return []any{v.Addr().Interface()}, nil
+	}
+	fields := structFields(target.Type())
+	ptrs := make([]any, len(columns))
+	for i, c := range columns {
+		index, ok := fields[strings.ToLower(c)]
+		if !ok {
+			return nil, fmt.Errorf("missing destination for column %s in %s", c, target.Type())
+		}
+		ptrs[i] = fieldByIndex(target, index).Addr().Interface()
+	}
+	return ptrs, nil
+}
+
+// fieldByIndex returns the nested field, allocating embedded struct pointers on the way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// fieldCache holds the column to field mapping of each struct type.
+var fieldCache sync.Map
+
+// structFields maps the lower-cased column names of a struct type to field index paths.
+func structFields(t reflect.Type) map[string][]int {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(map[string][]int)
+	}
+	fields := map[string][]int{}
+	addStructFields(t, nil, fields)
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func addStructFields(t reflect.Type, parent []int, fields map[string][]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		// Options after the name describe the column for SchemaFromStructs.
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		index := append(append([]int(nil), parent...), i)
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			addStructFields(ft, index, fields)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = strings.ToLower(name)
+		// A field of an outer struct hides one of the same name in an embedded struct.
+		if existing, ok := fields[name]; !ok || len(existing) > len(index) {
+			fields[name] = index
+		}
+	}
+}
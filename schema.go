@@ -0,0 +1,354 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SchemaInfo describes the tables, views and triggers of a database, leaving out those SQLite
+// and appdb create for their own use.
+type SchemaInfo struct {
+	Tables   []TableInfo
+	Views    []ViewInfo
+	Triggers []TriggerInfo
+}
+
+// TableInfo describes a table.
+type TableInfo struct {
+	Name string
+	// SQL is the CREATE statement of the table.
+	SQL string
+	// Virtual is true for virtual tables, such as FTS5 tables.
+	Virtual      bool
+	WithoutRowID bool
+	Strict       bool
+	Columns      []ColumnInfo
+	Indexes      []IndexInfo
+	ForeignKeys  []ForeignKeyInfo
+}
+
+// ColumnInfo describes a column of a table.
+type ColumnInfo struct {
+	Name string
+	// Type is the declared type, which may be empty.
+	Type    string
+	NotNull bool
+	// Default is the SQL text of the default value, or nil if the column has none.
+	Default *string
+	// PrimaryKey is the position of the column in the primary key counting from 1, or 0 if it
+	// isn't part of it.
+	PrimaryKey int
+	// Generated is true for generated columns.
+	Generated bool
+}
+
+// IndexInfo describes an index of a table.
+type IndexInfo struct {
+	Name string
+	// SQL is the CREATE INDEX statement, or empty for indexes SQLite creates for UNIQUE and
+	// PRIMARY KEY constraints.
+	SQL    string
+	Unique bool
+	// Origin is "c" for an index created with CREATE INDEX, "u" for a UNIQUE constraint and "pk"
+	// for a PRIMARY KEY.
+	Origin string
+	// Partial is true if the index has a WHERE clause.
+	Partial bool
+	// Columns are the indexed columns in order. An indexed expression is listed as an empty name.
+	Columns []string
+}
+
+// ForeignKeyInfo describes a foreign key constraint of a table.
+type ForeignKeyInfo struct {
+	Columns []string
+	// Table is the referenced table.
+	Table string
+	// References are the referenced columns, or empty names where they are the primary key.
+	References []string
+	OnUpdate   string
+	OnDelete   string
+}
+
+// ViewInfo describes a view.
+type ViewInfo struct {
+	Name string
+	SQL  string
+}
+
+// TriggerInfo describes a trigger.
+type TriggerInfo struct {
+	Name  string
+	Table string
+	SQL   string
+}
+
+// Table returns the description of the named table, or nil if there is none.
+func (s *SchemaInfo) Table(name string) *TableInfo {
+	for i := range s.Tables {
+		if s.Tables[i].Name == name {
+			return &s.Tables[i]
+		}
+	}
+	return nil
+}
+
+// Column returns the description of the named column, or nil if there is none.
+func (t *TableInfo) Column(name string) *ColumnInfo {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+// String describes the column as in a column definition, normalising the case of the type.
+func (c ColumnInfo) String() string {
+	s := strings.ToUpper(c.Type)
+	if c.NotNull {
+		s += " NOT NULL"
+	}
+	if c.Default != nil {
+		s += " DEFAULT " + *c.Default
+	}
+	if c.PrimaryKey > 0 {
+		s += fmt.Sprintf(" PRIMARY KEY(%d)", c.PrimaryKey)
+	}
+	if c.Generated {
+		s += " GENERATED"
+	}
+	return strings.TrimSpace(s)
+}
+
+// String describes the index by its kind and columns.
+func (ix IndexInfo) String() string {
+	s := "INDEX"
+	if ix.Unique {
+		s = "UNIQUE INDEX"
+	}
+	s += " (" + strings.Join(ix.Columns, ", ") + ")"
+	if ix.Partial {
+		s += " WHERE ..."
+	}
+	return s
+}
+
+// String describes the schema in a canonical text form, one line per table, column, index,
+// foreign key, view and trigger, suitable for comparing schemas as text. Tables, views, triggers
+// and indexes are in name order, so the text doesn't depend on the order objects were created in,
+// and whitespace in SQL is collapsed.
+func (s *SchemaInfo) String() string {
+	var b strings.Builder
+	tables := slices.Clone(s.Tables)
+	slices.SortFunc(tables, func(x, y TableInfo) int { return cmp.Compare(x.Name, y.Name) })
+	for _, t := range tables {
+		b.WriteString(strings.TrimSpace("table " + t.Name + " " + tableOptions(&t)))
+		b.WriteString("\n")
+		for _, c := range t.Columns {
+			b.WriteString(strings.TrimRight("  column "+c.Name+" "+c.String(), " ") + "\n")
+		}
+		indexes := slices.Clone(t.Indexes)
+		slices.SortFunc(indexes, func(x, y IndexInfo) int { return cmp.Compare(indexKey(x), indexKey(y)) })
+		for _, ix := range indexes {
+			if ix.Origin == "c" {
+				fmt.Fprintf(&b, "  index %s %s\n", ix.Name, normalSQL(ix.SQL))
+			} else {
+				fmt.Fprintf(&b, "  index %s %s\n", indexKey(ix), ix)
+			}
+		}
+		if fks := foreignKeys(t.ForeignKeys); fks != "" {
+			for _, fk := range strings.Split(fks, "; ") {
+				fmt.Fprintf(&b, "  foreign key %s\n", fk)
+			}
+		}
+	}
+	views := slices.Clone(s.Views)
+	slices.SortFunc(views, func(x, y ViewInfo) int { return cmp.Compare(x.Name, y.Name) })
+	for _, v := range views {
+		fmt.Fprintf(&b, "view %s %s\n", v.Name, normalSQL(v.SQL))
+	}
+	triggers := slices.Clone(s.Triggers)
+	slices.SortFunc(triggers, func(x, y TriggerInfo) int { return cmp.Compare(x.Name, y.Name) })
+	for _, t := range triggers {
+		fmt.Fprintf(&b, "trigger %s on %s %s\n", t.Name, t.Table, normalSQL(t.SQL))
+	}
+	return b.String()
+}
+
+// normalSQL collapses runs of whitespace in SQL to single spaces.
+func normalSQL(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Schema describes the database's schema from sqlite_master and the table_xinfo, index_list,
+// index_info and foreign_key_list pragmas. Objects are listed in the order they were created.
+func (a *AppDB) Schema() (*SchemaInfo, error) {
+	return a.SchemaContext(context.Background())
+}
+
+// SchemaContext is Schema with a context.
+func (a *AppDB) SchemaContext(ctx context.Context) (*SchemaInfo, error) {
+	start := time.Now()
+	s, err := inspectSchema(ctx, a.DB)
+	a.logOp("schema", start, err)
+	return s, err
+}
+
+// inspectSchema reads the schema of the main database of q.
+func inspectSchema(ctx context.Context, q querier) (*SchemaInfo, error) {
+	s := &SchemaInfo{}
+	rows, err := q.QueryContext(ctx, `SELECT m.type, m.name, m.tbl_name, coalesce(m.sql, ''),
+		coalesce(l.type, ''), coalesce(l.wr, 0), coalesce(l.strict, 0)
+		FROM sqlite_master m LEFT JOIN pragma_table_list l ON l.schema = 'main' AND l.name = m.name
+		WHERE m.type IN ('table', 'view', 'trigger') AND m.name NOT LIKE 'sqlite\_%' ESCAPE '\'
+		AND m.tbl_name NOT LIKE 'appdb\_%' ESCAPE '\' AND coalesce(l.type, '') != 'shadow'
+		ORDER BY m.rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, name, table, sql, listType string
+		var wr, strict bool
+		if err := rows.Scan(&kind, &name, &table, &sql, &listType, &wr, &strict); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "table":
+			s.Tables = append(s.Tables, TableInfo{Name: name, SQL: sql, Virtual: listType == "virtual", WithoutRowID: wr, Strict: strict})
+		case "view":
+			s.Views = append(s.Views, ViewInfo{name, sql})
+		case "trigger":
+			s.Triggers = append(s.Triggers, TriggerInfo{name, table, sql})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range s.Tables {
+		t := &s.Tables[i]
+		if t.Columns, err = inspectColumns(ctx, q, t.Name); err != nil {
+			return nil, err
+		}
+		if t.Indexes, err = inspectIndexes(ctx, q, t.Name); err != nil {
+			return nil, err
+		}
+		if t.ForeignKeys, err = inspectForeignKeys(ctx, q, t.Name); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func inspectColumns(ctx context.Context, q querier, table string) ([]ColumnInfo, error) {
+	// Hidden columns of virtual tables (hidden = 1) aren't part of the declared schema.
+	rows, err := q.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk, hidden FROM pragma_table_xinfo(?) WHERE hidden != 1 ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []ColumnInfo
+	for rows.Next() {
+		var c ColumnInfo
+		var dflt sql.NullString
+		var hidden int
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull, &dflt, &c.PrimaryKey, &hidden); err != nil {
+			return nil, err
+		}
+		if dflt.Valid {
+			c.Default = &dflt.String
+		}
+		c.Generated = hidden == 2 || hidden == 3
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+func inspectIndexes(ctx context.Context, q querier, table string) ([]IndexInfo, error) {
+	rows, err := q.QueryContext(ctx, `SELECT l.name, coalesce(m.sql, ''), l."unique", l.origin, l.partial
+		FROM pragma_index_list(?) l LEFT JOIN sqlite_master m ON m.type = 'index' AND m.name = l.name
+		ORDER BY l.seq DESC`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var indexes []IndexInfo
+	for rows.Next() {
+		var ix IndexInfo
+		if err := rows.Scan(&ix.Name, &ix.SQL, &ix.Unique, &ix.Origin, &ix.Partial); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, ix)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for i := range indexes {
+		if indexes[i].Columns, err = indexColumns(ctx, q, indexes[i].Name); err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+func indexColumns(ctx context.Context, q querier, index string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT coalesce(name, '') FROM pragma_index_info(?) ORDER BY seqno", index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+func inspectForeignKeys(ctx context.Context, q querier, table string) ([]ForeignKeyInfo, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id, seq, "table", "from", coalesce("to", ''), on_update, on_delete
+		FROM pragma_foreign_key_list(?) ORDER BY id DESC, seq`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []ForeignKeyInfo
+	last := -1
+	for rows.Next() {
+		var id, seq int
+		var parent, from, to, onUpdate, onDelete string
+		if err := rows.Scan(&id, &seq, &parent, &from, &to, &onUpdate, &onDelete); err != nil {
+			return nil, err
+		}
+		// Each constraint has a row for each of its columns.
+		if id != last {
+			keys = append(keys, ForeignKeyInfo{Table: parent, OnUpdate: onUpdate, OnDelete: onDelete})
+			last = id
+		}
+		k := &keys[len(keys)-1]
+		k.Columns = append(k.Columns, from)
+		k.References = append(k.References, to)
+	}
+	return keys, rows.Err()
+}
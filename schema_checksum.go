@@ -0,0 +1,137 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// metaTable holds appdb's own key/value settings inside the database.
+const metaTable = "appdb_meta"
+
+const schemaChecksumKey = "schema_checksum"
+
+type SchemaChecksumError struct {
+	Checksum         string
+	ExpectedChecksum string
+}
+
+func (e *SchemaChecksumError) Error() string {
+	return fmt.Sprintf("Database schema has changed: Got checksum %s - Expected %s", e.Checksum, e.ExpectedChecksum)
+}
+
+// WithSchemaChecksum verifies at open that the database schema is the one appdb recorded when it
+// created or last migrated the database, catching schemas modified outside the application even
+// though the schema version matches. A SchemaChecksumError is returned if they differ.
+// Databases with no recorded checksum have the current schema recorded on first open.
+func WithSchemaChecksum() Option {
+	return func(c *config) {
+		c.schemaChecksum = true
+	}
+}
+
+// SchemaChecksum returns a hash over the definitions of the tables, indexes, views and triggers in
+// the database. Objects whose names start with appdb_ belong to appdb and are not included.
+func (a *AppDB) SchemaChecksum(ctx context.Context) (string, error) {
+	return schemaChecksum(ctx, a.DB)
+}
+
+// schemaChecksum hashes the SQL definitions stored in sqlite_master.
+func schemaChecksum(ctx context.Context, db querier) (string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'appdb\_%' ESCAPE '\'
+		ORDER BY type, name`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	for rows.Next() {
+		var typ, name, tblName, sql string
+		if err := rows.Scan(&typ, &name, &tblName, &sql); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\n", typ, name, tblName, sql)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeSchemaChecksum records the current schema checksum in the database.
+func storeSchemaChecksum(ctx context.Context, db querier) error {
+	sum, err := schemaChecksum(ctx, db)
+	if err != nil {
+		return err
+	}
+	return setMeta(ctx, db, schemaChecksumKey, sum)
+}
+
+// updateSchemaChecksum records the current schema checksum if the database has one recorded, after
+// appdb changes the schema. Databases not using WithSchemaChecksum are left without one.
+func updateSchemaChecksum(ctx context.Context, db querier) error {
+	if _, ok, err := getMeta(ctx, db, schemaChecksumKey); err != nil || !ok {
+		return err
+	}
+	return storeSchemaChecksum(ctx, db)
+}
+
+// verifySchemaChecksum compares the current schema checksum with the recorded one, recording it
+// if there is none.
+func verifySchemaChecksum(ctx context.Context, db querier) error {
+	expected, ok, err := getMeta(ctx, db, schemaChecksumKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return storeSchemaChecksum(ctx, db)
+	}
+	sum, err := schemaChecksum(ctx, db)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return &SchemaChecksumError{sum, expected}
+	}
+	return nil
+}
+
+// getMeta reads a value from the appdb meta table.
+func getMeta(ctx context.Context, db querier, key string) (string, bool, error) {
+	exists, err := tableExists(ctx, db, metaTable)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	var value string
+	err = db.QueryRowContext(ctx, "SELECT value FROM "+metaTable+" WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// setMeta writes a value to the appdb meta table, creating the table if needed.
+func setMeta(ctx context.Context, db querier, key string, value string) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+metaTable+" (key TEXT PRIMARY KEY, value TEXT NOT NULL);")
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT OR REPLACE INTO "+metaTable+" (key, value) VALUES (?, ?)", key, value)
+	return err
+}
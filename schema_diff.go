@@ -0,0 +1,303 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rebuildPrefix names the temporary table a table is copied to when it is rebuilt.
+const rebuildPrefix = "appdb_new_"
+
+// SchemaDiff holds the statements that change one schema into another.
+type SchemaDiff struct {
+	// Statements are the SQL statements to run, in order, in one transaction.
+	Statements []string
+	// Rebuilt lists the tables that are rebuilt by copying their rows to a new table, because
+	// ALTER TABLE can't make the change.
+	Rebuilt []string
+	// Dropped lists the tables that are dropped, losing their rows, including tables that need
+	// rebuilding but whose CREATE TABLE statement can't be parsed, which are recreated empty.
+	Dropped []string
+}
+
+// ForeignKeysOff reports whether the statements rebuild or drop tables, and so must run with
+// foreign key enforcement off to keep ON DELETE actions from firing on the rows of other tables.
+func (d *SchemaDiff) ForeignKeysOff() bool {
+	return len(d.Rebuilt) > 0 || len(d.Dropped) > 0
+}
+
+// DiffSchemas returns the statements that change the schema from into the schema to. Columns are
+// added with ALTER TABLE ADD COLUMN where SQLite allows it; any other change to a table rebuilds
+// it following SQLite's twelve-step procedure, keeping the rows of the columns both versions
+// have. A renamed table or column is seen as one dropped and another added. Views and triggers
+// are dropped and recreated as needed.
+// The statements must run in a transaction and, if ForeignKeysOff reports so, with foreign key
+// enforcement off; a Migration with DisableForeignKeys set does both.
+// from -- current schema
+// to -- schema wanted
+func DiffSchemas(from *SchemaInfo, to *SchemaInfo) *SchemaDiff {
+	d := &SchemaDiff{}
+	var tables, indexes []string
+	var dropIndexes []string
+	for i := range to.Tables {
+		tt := &to.Tables[i]
+		ft := from.Table(tt.Name)
+		if ft == nil {
+			tables = append(tables, tt.SQL)
+			indexes = append(indexes, createIndexes(tt.Indexes)...)
+			continue
+		}
+		add, rebuild := alterTable(ft, tt)
+		if rebuild {
+			stmts, ok := rebuildTable(ft, tt)
+			if ok {
+				d.Rebuilt = append(d.Rebuilt, tt.Name)
+			} else {
+				d.Dropped = append(d.Dropped, tt.Name)
+			}
+			tables = append(tables, stmts...)
+			indexes = append(indexes, createIndexes(tt.Indexes)...)
+			continue
+		}
+		for _, def := range add {
+			tables = append(tables, "ALTER TABLE "+quoteIdent(tt.Name)+" ADD COLUMN "+def)
+		}
+		for _, fi := range ft.Indexes {
+			if fi.Origin == "c" && !slices.ContainsFunc(tt.Indexes, func(ti IndexInfo) bool { return sameIndex(fi, ti) }) {
+				dropIndexes = append(dropIndexes, "DROP INDEX "+quoteIdent(fi.Name))
+			}
+		}
+		for _, ti := range tt.Indexes {
+			if ti.Origin == "c" && !slices.ContainsFunc(ft.Indexes, func(fi IndexInfo) bool { return sameIndex(fi, ti) }) {
+				indexes = append(indexes, ti.SQL)
+			}
+		}
+	}
+	for _, ft := range from.Tables {
+		if to.Table(ft.Name) == nil {
+			d.Dropped = append(d.Dropped, ft.Name)
+			tables = append(tables, "DROP TABLE "+quoteIdent(ft.Name))
+		}
+	}
+
+	// Renaming a rebuilt table fails if a view or trigger refers to a table that doesn't exist, so
+	// when tables are rebuilt or dropped every view and trigger is recreated.
+	all := d.ForeignKeysOff()
+	var drops, creates []string
+	for i := len(from.Views) - 1; i >= 0; i-- {
+		v := from.Views[i]
+		if all || !slices.ContainsFunc(to.Views, func(t ViewInfo) bool { return t.Name == v.Name && sameSQL(t.SQL, v.SQL) }) {
+			drops = append(drops, "DROP VIEW "+quoteIdent(v.Name))
+		}
+	}
+	for _, t := range from.Triggers {
+		if all || !slices.ContainsFunc(to.Triggers, func(u TriggerInfo) bool { return u.Name == t.Name && sameSQL(u.SQL, t.SQL) }) {
+			drops = append(drops, "DROP TRIGGER IF EXISTS "+quoteIdent(t.Name))
+		}
+	}
+	for _, v := range to.Views {
+		if all || !slices.ContainsFunc(from.Views, func(f ViewInfo) bool { return f.Name == v.Name && sameSQL(f.SQL, v.SQL) }) {
+			creates = append(creates, v.SQL)
+		}
+	}
+	for _, t := range to.Triggers {
+		if all || !slices.ContainsFunc(from.Triggers, func(f TriggerInfo) bool { return f.Name == t.Name && sameSQL(f.SQL, t.SQL) }) {
+			creates = append(creates, t.SQL)
+		}
+	}
+
+	for _, group := range [][]string{drops, dropIndexes, tables, indexes, creates} {
+		for _, stmt := range group {
+			d.Statements = append(d.Statements, stmt+";")
+		}
+	}
+	return d
+}
+
+// DiffStatements is DiffSchemas for the schemas two lists of statements create.
+// ctx -- context for building the schemas in memory
+// from -- statements creating the current schema
+// to -- statements creating the schema wanted
+// opts -- options for the in-memory databases, such as the driver and collations the schemas use
+func DiffStatements(ctx context.Context, from []string, to []string, opts ...Option) (*SchemaDiff, error) {
+	cfg := newConfig(opts)
+	f, err := schemaOf(ctx, cfg, from)
+	if err != nil {
+		return nil, err
+	}
+	t, err := schemaOf(ctx, cfg, to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSchemas(f, t), nil
+}
+
+// DiffMigration returns a migration to the given version that changes the schema from into the
+// schema to, with Down statements reversing it.
+// ctx -- context for building the schemas in memory
+// version -- schema version the migration moves to
+// name -- name of the migration
+// from -- statements creating the previous version's schema
+// to -- statements creating this version's schema
+// opts -- options for the in-memory databases, as for DiffStatements
+func DiffMigration(ctx context.Context, version uint8, name string, from []string, to []string, opts ...Option) (Migration, error) {
+	up, err := DiffStatements(ctx, from, to, opts...)
+	if err != nil {
+		return Migration{}, err
+	}
+	down, err := DiffStatements(ctx, to, from, opts...)
+	if err != nil {
+		return Migration{}, err
+	}
+	return Migration{
+		Version:            version,
+		Name:               name,
+		Up:                 up.Statements,
+		Down:               down.Statements,
+		DisableForeignKeys: up.ForeignKeysOff() || down.ForeignKeysOff(),
+	}, nil
+}
+
+// DiffSchema returns the statements that change the database's schema into the one the target
+// statements create, as described for DiffSchemas.
+// ctx -- context for the queries
+// target -- statements creating the schema wanted
+func (a *AppDB) DiffSchema(ctx context.Context, target []string) (*SchemaDiff, error) {
+	start := time.Now()
+	var d *SchemaDiff
+	to, err := schemaOf(ctx, a.cfg, target)
+	if err == nil {
+		var from *SchemaInfo
+		from, err = inspectSchema(ctx, a.DB)
+		if err == nil {
+			d = DiffSchemas(from, to)
+		}
+	}
+	a.logOp("diff_schema", start, err)
+	return d, err
+}
+
+// alterTable works out how to change a table. It returns the definitions of columns to add, or
+// reports that the table must be rebuilt.
+func alterTable(from *TableInfo, to *TableInfo) (add []string, rebuild bool) {
+	if from.Virtual || to.Virtual {
+		return nil, !sameSQL(from.SQL, to.SQL)
+	}
+	fd, ok := parseTableDefinition(from.SQL)
+	td, ok2 := parseTableDefinition(to.SQL)
+	if !ok || !ok2 {
+		return nil, !sameSQL(from.SQL, to.SQL)
+	}
+	fcols, fcons := fd.columnItems()
+	tcols, tcons := td.columnItems()
+	if !sameSQL(fd.tail, td.tail) || !slices.EqualFunc(fcons, tcons, sameSQL) {
+		return nil, true
+	}
+	for _, diff := range compareTables(to, from) {
+		switch diff.Kind {
+		case MissingColumn:
+			// Handled below, as ALTER TABLE can add some columns.
+		case MissingIndex, ExtraIndex, ChangedIndex:
+			// Indexes created with CREATE INDEX are handled separately; others come from constraints.
+			if strings.ContainsAny(diff.Name, "()") {
+				return nil, true
+			}
+		default:
+			return nil, true
+		}
+	}
+	// Added columns go at the end, so the existing ones must come first and in the same order.
+	if len(from.Columns) > len(to.Columns) {
+		return nil, true
+	}
+	for i, fc := range from.Columns {
+		name := strings.ToLower(fc.Name)
+		if !strings.EqualFold(to.Columns[i].Name, fc.Name) || !sameSQL(fcols[name], tcols[name]) {
+			return nil, true
+		}
+	}
+	for _, tc := range to.Columns[len(from.Columns):] {
+		def := tcols[strings.ToLower(tc.Name)]
+		if !canAddColumn(tc, def) {
+			return nil, true
+		}
+		add = append(add, def)
+	}
+	return add, false
+}
+
+// canAddColumn reports whether ALTER TABLE ADD COLUMN accepts a column definition.
+func canAddColumn(c ColumnInfo, def string) bool {
+	upper := strings.ToUpper(strings.Join(strings.Fields(def), " "))
+	if def == "" || strings.Contains(upper, "PRIMARY KEY") || strings.Contains(upper, "UNIQUE") ||
+		(c.Generated && strings.Contains(upper, "STORED")) {
+		return false
+	}
+	dflt := "NULL"
+	if c.Default != nil {
+		dflt = strings.ToUpper(*c.Default)
+	}
+	switch {
+	case c.NotNull && dflt == "NULL" && !c.Generated:
+		return false
+	case strings.HasPrefix(dflt, "(") || strings.HasPrefix(dflt, "CURRENT_"):
+		return false
+	case strings.Contains(upper, "REFERENCES") && dflt != "NULL":
+		return false
+	}
+	return true
+}
+
+// rebuildTable returns the statements that create the new version of a table, copy the rows of
+// the old, and put the new in its place. Without a recognisable name in the new CREATE TABLE
+// statement the table can only be recreated empty, so the statements drop and create it and ok
+// is false.
+func rebuildTable(from *TableInfo, to *TableInfo) (stmts []string, ok bool) {
+	tmp := rebuildPrefix + to.Name
+	create, ok := renameCreateTable(to.SQL, tmp)
+	if !ok {
+		return []string{"DROP TABLE " + quoteIdent(from.Name), to.SQL}, false
+	}
+	stmts = []string{create}
+	var columns []string
+	for _, tc := range to.Columns {
+		if fc := from.Column(tc.Name); fc != nil && !tc.Generated {
+			columns = append(columns, quoteIdent(tc.Name))
+		}
+	}
+	if len(columns) > 0 {
+		list := strings.Join(columns, ", ")
+		stmts = append(stmts, "INSERT INTO "+quoteIdent(tmp)+" ("+list+") SELECT "+list+" FROM "+quoteIdent(from.Name))
+	}
+	return append(stmts,
+		"DROP TABLE "+quoteIdent(from.Name),
+		"ALTER TABLE "+quoteIdent(tmp)+" RENAME TO "+quoteIdent(to.Name)), true
+}
+
+// createIndexes returns the statements creating the indexes made with CREATE INDEX.
+func createIndexes(indexes []IndexInfo) []string {
+	var stmts []string
+	for _, ix := range indexes {
+		if ix.Origin == "c" {
+			stmts = append(stmts, ix.SQL)
+		}
+	}
+	return stmts
+}
+
+// sameIndex reports whether two indexes have the same name and definition.
+func sameIndex(a IndexInfo, b IndexInfo) bool {
+	return a.Name == b.Name && sameSQL(a.SQL, b.SQL)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffStatements(t *testing.T) {
+	ctx := context.Background()
+	from := []string{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);"}
+	d, err := DiffStatements(ctx, from, []string{
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, colour TEXT DEFAULT 'red');",
+		"CREATE INDEX items_name ON items (name);",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`ALTER TABLE "items" ADD COLUMN colour TEXT DEFAULT 'red';`,
+		"CREATE INDEX items_name ON items (name);",
+	}
+	if strings.Join(d.Statements, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements = %q, want %q", d.Statements, want)
+	}
+	if d.ForeignKeysOff() {
+		t.Error("adding a column needs foreign keys off")
+	}
+
+	d, err = DiffStatements(ctx, from, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Dropped) != 1 || d.Dropped[0] != "items" || !d.ForeignKeysOff() {
+		t.Errorf("dropping a table = %+v", d)
+	}
+}
+
+func TestDiffMigration(t *testing.T) {
+	ctx := context.Background()
+	v1 := []string{
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, size INTEGER);",
+		"CREATE VIEW names AS SELECT name FROM items;",
+	}
+	v2 := []string{
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL);",
+		"CREATE VIEW names AS SELECT name FROM items;",
+	}
+	m, err := DiffMigration(ctx, 2, "rebuild", v1, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.DisableForeignKeys {
+		t.Error("rebuilding migration doesn't disable foreign keys")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	migrations := []Migration{{Version: 1, Up: v1}, m}
+	migrateTo(t, path, 1, migrations)
+	db, err := Open(path, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO items (id, name, size) VALUES (1, 'a', 3)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	migrateTo(t, path, 2, migrations)
+	db, err = Open(path, "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if names := queryStrings(t, db, "SELECT name FROM names"); len(names) != 1 || names[0] != "a" {
+		t.Errorf("names after rebuild = %q, want [a]", names)
+	}
+	d, err := db.DiffSchema(ctx, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Statements) != 0 {
+		t.Errorf("migrated schema differs from target: %q", d.Statements)
+	}
+}
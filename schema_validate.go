@@ -0,0 +1,226 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DifferenceKind is the kind of a SchemaDifference.
+type DifferenceKind string
+
+const (
+	MissingTable      DifferenceKind = "missing table"
+	ExtraTable        DifferenceKind = "extra table"
+	ChangedTable      DifferenceKind = "changed table"
+	MissingColumn     DifferenceKind = "missing column"
+	ExtraColumn       DifferenceKind = "extra column"
+	ChangedColumn     DifferenceKind = "changed column"
+	MissingIndex      DifferenceKind = "missing index"
+	ExtraIndex        DifferenceKind = "extra index"
+	ChangedIndex      DifferenceKind = "changed index"
+	ChangedForeignKey DifferenceKind = "changed foreign keys"
+	MissingTrigger    DifferenceKind = "missing trigger"
+	ChangedTrigger    DifferenceKind = "changed trigger"
+)
+
+// SchemaDifference is one way a database's schema differs from the expected schema.
+type SchemaDifference struct {
+	Kind  DifferenceKind
+	Table string
+	// Name is the column, index or trigger that differs, or empty for a difference in the table
+	// itself.
+	Name string
+	// Expected and Actual describe the object in the expected schema and the database, and are
+	// empty where it is missing from one of them.
+	Expected string
+	Actual   string
+}
+
+func (d SchemaDifference) String() string {
+	name := d.Table
+	if d.Name != "" {
+		name += "." + d.Name
+	}
+	switch {
+	case d.Expected == "":
+		return fmt.Sprintf("%s %s: %s", d.Kind, name, d.Actual)
+	case d.Actual == "":
+		return fmt.Sprintf("%s %s: %s", d.Kind, name, d.Expected)
+	}
+	return fmt.Sprintf("%s %s: expected %s, got %s", d.Kind, name, d.Expected, d.Actual)
+}
+
+// SchemaMismatchError lists the differences found by ValidateSchema.
+type SchemaMismatchError struct {
+	Differences []SchemaDifference
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("Database schema differs from expected schema: %d differences found, first: %s", len(e.Differences), e.Differences[0])
+}
+
+// ValidateSchema checks that the database's tables, columns, indexes and foreign keys match those
+// the expected schema statements create, catching changes made outside the application. It
+// returns a SchemaMismatchError listing the differences, or nil if there are none. Views and
+// triggers aren't compared; ValidateTriggers checks declared triggers.
+// expected -- SQL statements creating the expected schema, as passed to InitAppDB
+func (a *AppDB) ValidateSchema(expected []string) error {
+	return a.ValidateSchemaContext(context.Background(), expected)
+}
+
+// ValidateSchemaContext is ValidateSchema with a context.
+func (a *AppDB) ValidateSchemaContext(ctx context.Context, expected []string) error {
+	start := time.Now()
+	err := a.validateSchema(ctx, expected)
+	a.logOp("validate_schema", start, err)
+	return err
+}
+
+func (a *AppDB) validateSchema(ctx context.Context, expected []string) error {
+	want, err := schemaOf(ctx, a.cfg, expected)
+	if err != nil {
+		return err
+	}
+	got, err := inspectSchema(ctx, a.DB)
+	if err != nil {
+		return err
+	}
+	if diffs := compareSchemas(want, got); len(diffs) > 0 {
+		return &SchemaMismatchError{diffs}
+	}
+	return nil
+}
+
+// schemaOf returns the schema the statements create, by running them on an empty in-memory
+// database.
+func schemaOf(ctx context.Context, cfg *config, statements []string) (*SchemaInfo, error) {
+	db, err := openDriver(cfg.driver, ":memory:", &cfg.extensions, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Each connection to ":memory:" is a separate database.
+	db.SetMaxOpenConns(1)
+	for _, s := range statements {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			return nil, &SchemaError{s, err}
+		}
+	}
+	return inspectSchema(ctx, db)
+}
+
+// compareSchemas lists the differences in the tables of got from those of want.
+func compareSchemas(want *SchemaInfo, got *SchemaInfo) []SchemaDifference {
+	var diffs []SchemaDifference
+	for _, wt := range want.Tables {
+		gt := got.Table(wt.Name)
+		if gt == nil {
+			diffs = append(diffs, SchemaDifference{Kind: MissingTable, Table: wt.Name, Expected: wt.SQL})
+			continue
+		}
+		diffs = append(diffs, compareTables(&wt, gt)...)
+	}
+	for _, gt := range got.Tables {
+		if want.Table(gt.Name) == nil && !isHistoryTable(&gt) {
+			diffs = append(diffs, SchemaDifference{Kind: ExtraTable, Table: gt.Name, Actual: gt.SQL})
+		}
+	}
+	return diffs
+}
+
+func compareTables(want *TableInfo, got *TableInfo) []SchemaDifference {
+	var diffs []SchemaDifference
+	if w, g := tableOptions(want), tableOptions(got); w != g {
+		diffs = append(diffs, SchemaDifference{Kind: ChangedTable, Table: want.Name, Expected: w, Actual: g})
+	}
+	for _, wc := range want.Columns {
+		gc := got.Column(wc.Name)
+		switch {
+		case gc == nil:
+			diffs = append(diffs, SchemaDifference{Kind: MissingColumn, Table: want.Name, Name: wc.Name, Expected: wc.String()})
+		case wc.String() != gc.String():
+			diffs = append(diffs, SchemaDifference{Kind: ChangedColumn, Table: want.Name, Name: wc.Name, Expected: wc.String(), Actual: gc.String()})
+		}
+	}
+	for _, gc := range got.Columns {
+		if want.Column(gc.Name) == nil {
+			diffs = append(diffs, SchemaDifference{Kind: ExtraColumn, Table: want.Name, Name: gc.Name, Actual: gc.String()})
+		}
+	}
+
+	wantIndexes, gotIndexes := indexesByKey(want.Indexes), indexesByKey(got.Indexes)
+	for _, wi := range want.Indexes {
+		key := indexKey(wi)
+		gi, ok := gotIndexes[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, SchemaDifference{Kind: MissingIndex, Table: want.Name, Name: key, Expected: wi.String()})
+		case wi.String() != gi.String():
+			diffs = append(diffs, SchemaDifference{Kind: ChangedIndex, Table: want.Name, Name: key, Expected: wi.String(), Actual: gi.String()})
+		}
+	}
+	for _, gi := range got.Indexes {
+		if _, ok := wantIndexes[indexKey(gi)]; !ok {
+			diffs = append(diffs, SchemaDifference{Kind: ExtraIndex, Table: want.Name, Name: indexKey(gi), Actual: gi.String()})
+		}
+	}
+
+	if w, g := foreignKeys(want.ForeignKeys), foreignKeys(got.ForeignKeys); w != g {
+		diffs = append(diffs, SchemaDifference{Kind: ChangedForeignKey, Table: want.Name, Expected: w, Actual: g})
+	}
+	return diffs
+}
+
+// indexKey identifies an index between schemas. Indexes SQLite creates for constraints are
+// named after their position in the table, so are identified by their columns instead.
+func indexKey(ix IndexInfo) string {
+	if ix.Origin == "c" {
+		return ix.Name
+	}
+	return ix.Origin + "(" + strings.Join(ix.Columns, ", ") + ")"
+}
+
+func indexesByKey(indexes []IndexInfo) map[string]IndexInfo {
+	m := make(map[string]IndexInfo, len(indexes))
+	for _, ix := range indexes {
+		m[indexKey(ix)] = ix
+	}
+	return m
+}
+
+func tableOptions(t *TableInfo) string {
+	var opts []string
+	if t.Virtual {
+		opts = append(opts, "VIRTUAL")
+	}
+	if t.WithoutRowID {
+		opts = append(opts, "WITHOUT ROWID")
+	}
+	if t.Strict {
+		opts = append(opts, "STRICT")
+	}
+	return strings.Join(opts, ", ")
+}
+
+// foreignKeys describes a table's foreign keys in a canonical order.
+func foreignKeys(keys []ForeignKeyInfo) string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = fmt.Sprintf("(%s) REFERENCES %s(%s) ON UPDATE %s ON DELETE %s", strings.Join(k.Columns, ", "), k.Table, strings.Join(k.References, ", "), k.OnUpdate, k.OnDelete)
+	}
+	slices.Sort(s)
+	return strings.Join(s, "; ")
+}
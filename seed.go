@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// SeedFunc adds initial rows to a newly created database, inside the seeding transaction.
+type SeedFunc func(ctx context.Context, tx *sql.Tx) error
+
+// SeedError reports a failure seeding a new database. Statement is empty if the failure was in a
+// SeedFunc.
+type SeedError struct {
+	Statement string
+	Err       error
+}
+
+func (e *SeedError) Error() string {
+	if e.Statement == "" {
+		return fmt.Sprintf("Error %s seeding database", e.Err)
+	}
+	return fmt.Sprintf("Error %s seeding database on statement %s", e.Err, e.Statement)
+}
+
+func (e *SeedError) Unwrap() error {
+	return e.Err
+}
+
+// WithSeed runs statements adding initial rows, such as default settings or lookup tables, when
+// InitAppDB creates the database. They run after the schema is created, in one transaction with
+// any WithSeedFunc functions, and never when InitAppDB opens an existing database, so the rows
+// are added exactly once. Migrate seeds a database it creates after applying the migrations. If
+// seeding fails InitAppDB or Migrate returns a SeedError and removes the new database, so that
+// the next attempt starts afresh.
+// statements -- SQL statements inserting the initial rows
+func WithSeed(statements ...string) Option {
+	return func(c *config) {
+		c.seed = append(c.seed, statements...)
+	}
+}
+
+// WithSeedFunc is WithSeed for rows built in Go, such as an administrator account with a hashed
+// password. Functions run after any WithSeed statements, in the order given.
+// fn -- function adding the initial rows
+func WithSeedFunc(fn SeedFunc) Option {
+	return func(c *config) {
+		c.seedFuncs = append(c.seedFuncs, fn)
+	}
+}
+
+// seedDB runs the seed statements and functions in one transaction.
+func seedDB(ctx context.Context, db *sql.DB, cfg *config) error {
+	if len(cfg.seed) == 0 && len(cfg.seedFuncs) == 0 {
+		return nil
+	}
+	return runTx(ctx, db, func(tx *sql.Tx) error {
+		for _, stmt := range cfg.seed {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return &SeedError{stmt, err}
+			}
+		}
+		for _, fn := range cfg.seedFuncs {
+			if err := fn(ctx, tx); err != nil {
+				return &SeedError{Err: err}
+			}
+		}
+		return nil
+	})
+}
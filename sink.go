@@ -0,0 +1,175 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupSink stores backups written by BackupToSink and WithAutoBackupSink, for example in a
+// local directory, an object store or over HTTP.
+type BackupSink interface {
+	// WriteBackup stores a backup under name. The backup's content is written by calling
+	// backup.WriteTo, which may only be called once.
+	WriteBackup(ctx context.Context, name string, backup io.WriterTo) error
+	// Prune removes all but the newest keep backups named prefix followed by the time of the
+	// backup, in the form 20060102T150405, and then ext. Backup names sort in order of age.
+	Prune(ctx context.Context, prefix string, ext string, keep int) error
+}
+
+// DirSink stores backups as files in a directory, which is created if needed. Each backup is
+// written beside its final name and renamed into place once complete.
+type DirSink struct {
+	Dir string
+	// DirMode is the permission of a created directory, 0700 if zero.
+	DirMode os.FileMode
+	// FileMode is the permission of backup files, 0600 if zero.
+	FileMode os.FileMode
+}
+
+func (s *DirSink) WriteBackup(ctx context.Context, name string, backup io.WriterTo) error {
+	dirMode, fileMode := s.DirMode, s.FileMode
+	if dirMode == 0 {
+		dirMode = 0700
+	}
+	if fileMode == 0 {
+		fileMode = 0600
+	}
+	if err := os.MkdirAll(s.Dir, dirMode); err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, name)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = backup.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *DirSink) Prune(ctx context.Context, prefix string, ext string, keep int) error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && isBackupName(e.Name(), prefix, ext) {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(s.Dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// isBackupName reports whether name is that of an automatic backup, prefix followed by the time
+// of the backup and ext, so that backups of databases whose names begin alike aren't confused.
+func isBackupName(name, prefix, ext string) bool {
+	stamp, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	stamp, ok = strings.CutSuffix(stamp, ext)
+	if !ok {
+		return false
+	}
+	_, err := time.Parse(backupTimeFormat, stamp)
+	return err == nil
+}
+
+// WriterSink adapts a function opening a destination for each backup into a BackupSink, for
+// streaming backups to anything that can be written to. The writer is closed after the backup
+// is written, and a Close error fails the backup. WriterSink doesn't prune old backups.
+type WriterSink func(ctx context.Context, name string) (io.WriteCloser, error)
+
+func (s WriterSink) WriteBackup(ctx context.Context, name string, backup io.WriterTo) error {
+	w, err := s(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = backup.WriteTo(w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s WriterSink) Prune(ctx context.Context, prefix string, ext string, keep int) error {
+	return nil
+}
+
+// BackupToSink takes a snapshot of the database, as Snapshot does, and stores it in sink under
+// name. The snapshot is staged in a temporary file beside the database.
+// ctx -- context for the backup
+// sink -- where to store the backup
+// name -- name to store the backup under
+func (a *AppDB) BackupToSink(ctx context.Context, sink BackupSink, name string) error {
+	start := time.Now()
+	err := a.backupToSink(ctx, sink, name)
+	a.logOp("backup_sink", start, err, slog.String("name", name))
+	return err
+}
+
+func (a *AppDB) backupToSink(ctx context.Context, sink BackupSink, name string) error {
+	dir := ""
+	if !isMemoryPath(a.dsn) {
+		dir = filepath.Dir(a.path)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	if err := vacuumInto(ctx, a.DB, tmp); err != nil {
+		return err
+	}
+	return sink.WriteBackup(ctx, name, fileWriterTo(tmp))
+}
+
+// fileWriterTo writes the content of the named file.
+type fileWriterTo string
+
+func (f fileWriterTo) WriteTo(w io.Writer) (int64, error) {
+	in, err := os.Open(string(f))
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	return io.Copy(w, in)
+}
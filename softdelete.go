@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SoftDeleteColumn is the column recording when a row of a table with soft delete was deleted.
+const SoftDeleteColumn = "deleted_at"
+
+// softDeleteTime is the format of SoftDeleteColumn, which sorts by time.
+const softDeleteTime = "2006-01-02T15:04:05.000Z"
+
+// EnableSoftDelete makes deleting rows from tables mark them deleted instead, by setting
+// SoftDeleteColumn, added to each table if needed, to the time of deletion. A trigger turns each
+// DELETE into an UPDATE, so it works for all statements, but rows marked deleted don't count as
+// affected and ON DELETE foreign key actions don't happen. Queries run with a SelectBuilder leave
+// out deleted rows unless asked for them, and PurgeDeleted removes them for good. The tables
+// must have a rowid, so can't be WITHOUT ROWID. The stored schema checksum is updated to include
+// the column and trigger.
+// ctx -- context for the statements
+// tables -- names of the tables
+func (a *AppDB) EnableSoftDelete(ctx context.Context, tables ...string) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			for _, table := range tables {
+				if err := enableSoftDelete(ctx, tx, table); err != nil {
+					return err
+				}
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("enable_soft_delete", start, err, slog.String("tables", strings.Join(tables, ",")))
+	return err
+}
+
+func enableSoftDelete(ctx context.Context, tx *sql.Tx, table string) error {
+	columns, err := tableColumns(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("no such table: %s", table)
+	}
+	if !slices.Contains(columns, SoftDeleteColumn) {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT", quoteIdent(table), SoftDeleteColumn))
+		if err != nil {
+			return err
+		}
+	}
+	// RAISE(IGNORE) skips deleting the row just marked, so there is no conflict between the two.
+	t := softDeleteTrigger(table)
+	t.Body = []string{
+		fmt.Sprintf("UPDATE %s SET %s = strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', 'now') WHERE rowid = old.rowid",
+			quoteIdent(table), SoftDeleteColumn),
+		"SELECT RAISE(IGNORE)",
+	}
+	for _, stmt := range replaceTriggers([]Trigger{t}) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// softDeleteTrigger returns the trigger marking rows of table deleted, without its body.
+func softDeleteTrigger(table string) Trigger {
+	return Trigger{
+		Name:   table + "_soft_delete",
+		Table:  table,
+		Timing: TriggerBefore,
+		Event:  TriggerDelete,
+		When:   "old." + SoftDeleteColumn + " IS NULL",
+	}
+}
+
+// DisableSoftDelete makes deleting rows from tables delete them again. Rows already marked
+// deleted, and SoftDeleteColumn, are kept.
+// ctx -- context for the statements
+// tables -- names of the tables
+func (a *AppDB) DisableSoftDelete(ctx context.Context, tables ...string) error {
+	start := time.Now()
+	err := a.cfg.retry.do(ctx, func() error {
+		return runTx(ctx, a.DB, func(tx *sql.Tx) error {
+			for _, table := range tables {
+				if _, err := tx.ExecContext(ctx, softDeleteTrigger(table).DropSQL()); err != nil {
+					return err
+				}
+			}
+			return updateSchemaChecksum(ctx, tx)
+		})
+	})
+	a.logOp("disable_soft_delete", start, err, slog.String("tables", strings.Join(tables, ",")))
+	return err
+}
+
+// PurgeDeleted removes the rows of table marked deleted before the given time, or all of them if
+// before is zero, returning the number removed.
+// ctx -- context for the statement
+// table -- name of the table
+// before -- time rows must have been deleted before
+func (a *AppDB) PurgeDeleted(ctx context.Context, table string, before time.Time) (int64, error) {
+	start := time.Now()
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s IS NOT NULL", quoteIdent(table), SoftDeleteColumn)
+	var args []any
+	if !before.IsZero() {
+		query += fmt.Sprintf(" AND %s < ?", SoftDeleteColumn)
+		args = append(args, before.UTC().Format(softDeleteTime))
+	}
+	n, err := a.execAffected(ctx, query, args)
+	a.logOp("purge_deleted", start, err, slog.String("table", table), slog.Int64("rows", n))
+	return n, err
+}
+
+// RestoreDeleted clears the deleted mark from the rows of table matching where, returning the
+// number restored.
+// ctx -- context for the statement
+// table -- name of the table
+// where -- condition selecting the rows, such as "id = ?"
+// args -- arguments for placeholders in where
+func (a *AppDB) RestoreDeleted(ctx context.Context, table string, where string, args ...any) (int64, error) {
+	start := time.Now()
+	query := fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s IS NOT NULL AND (%s)",
+		quoteIdent(table), SoftDeleteColumn, SoftDeleteColumn, where)
+	n, err := a.execAffected(ctx, query, args)
+	a.logOp("restore_deleted", start, err, slog.String("table", table), slog.Int64("rows", n))
+	return n, err
+}
+
+// execAffected runs a statement, retrying as configured, and returns the number of rows it changed.
+func (a *AppDB) execAffected(ctx context.Context, query string, args []any) (int64, error) {
+	var n int64
+	err := a.cfg.retry.do(ctx, func() error {
+		res, err := a.DB.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+// hasSoftDelete reports whether table has soft delete enabled.
+func hasSoftDelete(ctx context.Context, db Querier, table string) (bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = ?", softDeleteTrigger(table).Name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	found := rows.Next()
+	return found, rows.Err()
+}
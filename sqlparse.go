@@ -0,0 +1,169 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"strings"
+)
+
+// tableDefinition is a CREATE TABLE statement split into its parts.
+type tableDefinition struct {
+	// head is the text before the opening parenthesis.
+	head string
+	// items are the column definitions and table constraints, or the arguments of a virtual table.
+	items []string
+	// tail is the text after the closing parenthesis, such as WITHOUT ROWID.
+	tail string
+}
+
+// parseTableDefinition splits a CREATE TABLE statement at the top-level commas of its
+// parenthesised body, skipping quoted text and comments.
+func parseTableDefinition(stmt string) (tableDefinition, bool) {
+	var d tableDefinition
+	depth, open, itemStart := 0, 0, 0
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			i = skipQuoted(stmt, i)
+		case c == '-' && strings.HasPrefix(stmt[i:], "--"):
+			for i < len(stmt) && stmt[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(stmt[i:], "/*"):
+			end := strings.Index(stmt[i+2:], "*/")
+			if end < 0 {
+				return d, false
+			}
+			i += end + 3
+		case c == '(':
+			depth++
+			if depth == 1 {
+				open, itemStart = i, i+1
+			}
+		case c == ')':
+			depth--
+			if depth == 0 {
+				d.items = append(d.items, strings.TrimSpace(stmt[itemStart:i]))
+				d.head = strings.TrimSpace(stmt[:open])
+				d.tail = strings.TrimSpace(stmt[i+1:])
+				return d, true
+			}
+		case c == ',' && depth == 1:
+			d.items = append(d.items, strings.TrimSpace(stmt[itemStart:i]))
+			itemStart = i + 1
+		}
+	}
+	return d, false
+}
+
+// skipQuoted returns the index of the character closing the quoted text starting at i. A doubled
+// quote character inside the text is an escaped quote.
+func skipQuoted(s string, i int) int {
+	closing := s[i]
+	if closing == '[' {
+		closing = ']'
+	}
+	for j := i + 1; j < len(s); j++ {
+		if s[j] == closing {
+			if closing != ']' && j+1 < len(s) && s[j+1] == closing {
+				j++
+				continue
+			}
+			return j
+		}
+	}
+	return len(s) - 1
+}
+
+// leadingName returns the identifier at the start of s, unquoted, and the length of its text.
+func leadingName(s string) (string, int) {
+	if s == "" {
+		return "", 0
+	}
+	switch c := s[0]; c {
+	case '"', '`', '[':
+		end := skipQuoted(s, 0)
+		name := s[1:end]
+		if c != '[' {
+			name = strings.ReplaceAll(name, string(c)+string(c), string(c))
+		}
+		return name, end + 1
+	}
+	n := 0
+	for _, r := range s {
+		if !isIdentRune(r) {
+			break
+		}
+		n += len(string(r))
+	}
+	return s[:n], n
+}
+
+// columnItems returns the column definitions of a table definition keyed by column name, and its
+// table constraints in order.
+func (d tableDefinition) columnItems() (map[string]string, []string) {
+	columns := map[string]string{}
+	var constraints []string
+	for _, item := range d.items {
+		name, n := leadingName(item)
+		if n > 0 && item[0] != '"' && item[0] != '`' && item[0] != '[' {
+			switch strings.ToUpper(name) {
+			case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+				constraints = append(constraints, item)
+				continue
+			}
+		}
+		columns[strings.ToLower(name)] = item
+	}
+	return columns, constraints
+}
+
+// renameCreateTable returns a CREATE TABLE statement with the table's name replaced by name.
+func renameCreateTable(stmt string, name string) (string, bool) {
+	i := 0
+	skip := func() {
+		for i < len(stmt) && (stmt[i] == ' ' || stmt[i] == '\t' || stmt[i] == '\n' || stmt[i] == '\r') {
+			i++
+		}
+	}
+	for {
+		skip()
+		word, n := leadingName(stmt[i:])
+		if n == 0 {
+			return "", false
+		}
+		quoted := stmt[i] == '"' || stmt[i] == '`' || stmt[i] == '['
+		switch strings.ToUpper(word) {
+		case "CREATE", "TEMP", "TEMPORARY", "VIRTUAL", "TABLE", "IF", "NOT", "EXISTS":
+			if !quoted {
+				i += n
+				continue
+			}
+		}
+		start := i
+		i += n
+		// A schema-qualified name continues after the dot.
+		skip()
+		if i < len(stmt) && stmt[i] == '.' {
+			i++
+			skip()
+			_, n = leadingName(stmt[i:])
+			i += n
+		}
+		return stmt[:start] + quoteIdent(name) + stmt[i:], true
+	}
+}
+
+// sameSQL reports whether two pieces of SQL are the same apart from whitespace and case.
+func sameSQL(a string, b string) bool {
+	return strings.EqualFold(normalSQL(a), normalSQL(b))
+}
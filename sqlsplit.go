@@ -0,0 +1,114 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SplitStatements splits a SQL script into individual statements. Semicolons inside string
+// literals, quoted identifiers, comments and trigger bodies do not end a statement.
+// Statements are returned with surrounding whitespace removed and their terminating semicolon
+// kept; statements consisting only of comments are dropped.
+func SplitStatements(script string) []string {
+	var statements []string
+	var words []string // upper-cased keywords seen in the current statement
+	depth := 0         // BEGIN/CASE nesting inside a trigger body
+	hasToken := false
+	start := 0
+	r := []rune(script)
+
+	endStatement := func(end int) {
+		if hasToken {
+			statements = append(statements, strings.TrimSpace(string(r[start:end])))
+		}
+		start = end
+		words = words[:0]
+		depth = 0
+		hasToken = false
+	}
+
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == '-' && i+1 < len(r) && r[i+1] == '-':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(r) && r[i+1] == '*':
+			i += 2
+			for i < len(r) && !(r[i] == '*' && i+1 < len(r) && r[i+1] == '/') {
+				i++
+			}
+			i++
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			hasToken = true
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			for i++; i < len(r); i++ {
+				if r[i] == closing {
+					// A doubled quote character is an escaped quote, not the end of the literal.
+					if closing != ']' && i+1 < len(r) && r[i+1] == closing {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		case c == ';':
+			if depth == 0 {
+				endStatement(i + 1)
+			}
+		case isIdentRune(c):
+			hasToken = true
+			j := i
+			for j < len(r) && isIdentRune(r[j]) {
+				j++
+			}
+			word := strings.ToUpper(string(r[i:j]))
+			words = append(words, word)
+			if isTrigger(words) {
+				switch word {
+				case "BEGIN", "CASE":
+					depth++
+				case "END":
+					if depth > 0 {
+						depth--
+					}
+				}
+			}
+			i = j - 1
+		case !unicode.IsSpace(c):
+			hasToken = true
+		}
+	}
+	endStatement(len(r))
+	return statements
+}
+
+// isIdentRune reports whether c can be part of an unquoted SQL identifier or keyword.
+func isIdentRune(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// isTrigger reports whether the keywords seen so far begin a CREATE TRIGGER statement.
+func isTrigger(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	if words[1] == "TEMP" || words[1] == "TEMPORARY" {
+		return len(words) > 2 && words[2] == "TRIGGER"
+	}
+	return words[1] == "TRIGGER"
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"cmp"
+	"database/sql"
+	"expvar"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of recent latencies kept for each statement to estimate percentiles.
+const latencySamples = 256
+
+// maxTrackedStatements limits the distinct statements tracked, so that SQL built with literal
+// values can't grow the statistics without bound. Further statements are counted together.
+const maxTrackedStatements = 1000
+
+// WithQueryStats keeps execution counts and latencies for each distinct statement run through the
+// AppDB's methods, for QueryStats and PublishExpvar. Statements in transactions are not counted.
+func WithQueryStats() Option {
+	return func(c *config) {
+		c.queryStats = true
+	}
+}
+
+// StatementStats summarises the executions of one statement. Latency percentiles are estimated
+// from the most recent executions.
+type StatementStats struct {
+	// Query is the SQL of the statement, or empty for statements beyond the tracking limit.
+	Query      string
+	Executions uint64
+	Errors     uint64
+	// Busy counts the errors that were because the database was locked.
+	Busy uint64
+	// Rows is the total number of rows affected, which is zero for queries.
+	Rows  int64
+	Total time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// QueryStats returns the statistics of each statement run since the database was opened, busiest
+// first by total time. It returns nil unless the database was opened with WithQueryStats.
+func (a *AppDB) QueryStats() []StatementStats {
+	if a.stats == nil {
+		return nil
+	}
+	return a.stats.snapshot()
+}
+
+// PublishExpvar publishes QueryStats and StmtCacheStats as an expvar variable, served as JSON by
+// the expvar handler. Like expvar.Publish it panics if name is already in use, so publish each
+// database once under its own name.
+// name -- expvar variable name
+func (a *AppDB) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return struct {
+			Statements []StatementStats
+			StmtCache  StmtCacheStats
+			DB         sql.DBStats
+		}{a.QueryStats(), a.StmtCacheStats(), a.DB.Stats()}
+	}))
+}
+
+// queryStats holds the statistics of each statement.
+type queryStats struct {
+	mu         sync.Mutex
+	statements map[string]*statementStats
+}
+
+type statementStats struct {
+	executions uint64
+	errors     uint64
+	busy       uint64
+	rows       int64
+	total      time.Duration
+	samples    []time.Duration // ring of recent latencies
+	next       int
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{statements: map[string]*statementStats{}}
+}
+
+// record counts one execution of query.
+func (q *queryStats) record(query string, d time.Duration, res sql.Result, err error) {
+	var rows int64
+	if res != nil {
+		rows, _ = res.RowsAffected()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.statements[query]
+	if !ok {
+		if len(q.statements) >= maxTrackedStatements {
+			query = ""
+			s = q.statements[query]
+		}
+		if s == nil {
+			s = &statementStats{}
+			q.statements[query] = s
+		}
+	}
+	s.executions++
+	if err != nil {
+		s.errors++
+		if isBusy(err) {
+			s.busy++
+		}
+	}
+	s.rows += rows
+	s.total += d
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+// snapshot returns the statistics ordered by total time, busiest first.
+func (q *queryStats) snapshot() []StatementStats {
+	q.mu.Lock()
+	stats := make([]StatementStats, 0, len(q.statements))
+	var sorted []time.Duration
+	for query, s := range q.statements {
+		sorted = append(sorted[:0], s.samples...)
+		slices.Sort(sorted)
+		stats = append(stats, StatementStats{
+			Query:      query,
+			Executions: s.executions,
+			Errors:     s.errors,
+			Busy:       s.busy,
+			Rows:       s.rows,
+			Total:      s.total,
+			P50:        percentile(sorted, 50),
+			P95:        percentile(sorted, 95),
+			P99:        percentile(sorted, 99),
+		})
+	}
+	q.mu.Unlock()
+	slices.SortFunc(stats, func(a, b StatementStats) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+	return stats
+}
+
+// percentile returns the pth percentile of sorted latencies by the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)*p+99)/100-1]
+}
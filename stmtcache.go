@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// DefaultStmtCacheSize is the number of prepared statements an AppDB keeps by default.
+const DefaultStmtCacheSize = 64
+
+// WithStmtCache sets how many prepared statements ExecStatement, BulkExec and BulkExecArgs keep
+// for reuse, so statements run often are prepared once rather than on every call. The least
+// recently used statement is closed when the cache is full. A size of zero or less disables the
+// cache. The default is DefaultStmtCacheSize.
+// size -- number of statements to keep
+func WithStmtCache(size int) Option {
+	return func(c *config) {
+		c.stmtCacheSize = size
+	}
+}
+
+// StmtCacheStats reports how well the prepared statement cache is working.
+type StmtCacheStats struct {
+	// Size is the number of statements cached.
+	Size int
+	// Hits counts statements found in the cache.
+	Hits uint64
+	// Misses counts statements prepared because they weren't in the cache.
+	Misses uint64
+	// Evictions counts statements closed to make room for others.
+	Evictions uint64
+}
+
+// HitRate returns the fraction of statements found in the cache, or zero before any are used.
+func (s StmtCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// StmtCacheStats returns the prepared statement cache statistics, which are zero if the cache is
+// disabled.
+func (a *AppDB) StmtCacheStats() StmtCacheStats {
+	if a.stmts == nil {
+		return StmtCacheStats{}
+	}
+	return a.stmts.stats()
+}
+
+// stmtCache is a least recently used cache of statements prepared on a pool. database/sql
+// prepares each statement again on each connection it runs on, and keeps those for reuse too.
+type stmtCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     list.List // of *cachedStmt, most recently used first
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+	evicted uint64
+}
+
+// cachedStmt is a cached statement, which is closed once evicted and no longer in use.
+type cachedStmt struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{size: size, entries: map[string]*list.Element{}}
+}
+
+// prepare returns a statement for query prepared on db, and a function to call when done with it. A nil
+// cache prepares a new statement each time.
+func (c *stmtCache) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, func(), error) {
+	if c == nil {
+		stmt, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stmt, func() { stmt.Close() }, nil
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[query]; ok {
+		c.hits++
+		c.lru.MoveToFront(e)
+		cs := e.Value.(*cachedStmt)
+		cs.refs++
+		c.mu.Unlock()
+		return cs.stmt, func() { c.release(cs) }, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// Prepare without holding the lock, so a slow prepare doesn't hold up other statements.
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[query]; ok {
+		// Another caller prepared the same statement meanwhile.
+		stmt.Close()
+		cs := e.Value.(*cachedStmt)
+		cs.refs++
+		return cs.stmt, func() { c.release(cs) }, nil
+	}
+	cs := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	c.entries[query] = c.lru.PushFront(cs)
+	for c.lru.Len() > c.size {
+		c.evict(c.lru.Back())
+		c.evicted++
+	}
+	return stmt, func() { c.release(cs) }, nil
+}
+
+// release marks one use of a statement finished, closing it if it has been evicted.
+func (c *stmtCache) release(cs *cachedStmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs.refs--
+	if cs.evicted && cs.refs == 0 {
+		cs.stmt.Close()
+	}
+}
+
+// evict removes an entry from the cache, closing its statement unless it is in use. It must be
+// called with the lock held.
+func (c *stmtCache) evict(e *list.Element) {
+	cs := c.lru.Remove(e).(*cachedStmt)
+	delete(c.entries, cs.query)
+	cs.evicted = true
+	if cs.refs == 0 {
+		cs.stmt.Close()
+	}
+}
+
+func (c *stmtCache) stats() StmtCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return StmtCacheStats{Size: c.lru.Len(), Hits: c.hits, Misses: c.misses, Evictions: c.evicted}
+}
+
+// close closes every cached statement not in use; those in use are closed when released.
+func (c *stmtCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
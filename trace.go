@@ -0,0 +1,60 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import "context"
+
+// Operation describes an operation on a database for a Tracer.
+type Operation struct {
+	// Name is the operation, such as "open", "migrate", "exec" or "bulkexec".
+	Name string
+	// Path is the location of the database.
+	Path string
+	// AppName is the application name the database is opened with.
+	AppName string
+	// SQL is the statement run, or empty if the operation isn't a single statement.
+	SQL string
+}
+
+// Tracer is told when operations on a database start and end, for distributed tracing. The
+// tracing subpackage implements it with OpenTelemetry.
+type Tracer interface {
+	// Start is called when op begins. It returns the context to run the operation in, which may
+	// carry a span, and a function called with the result when the operation ends.
+	Start(ctx context.Context, op Operation) (context.Context, func(err error))
+}
+
+// WithTracer traces opening and migrating the database, and the statements run through the
+// AppDB's exec, query and bulk methods. The caller's context is passed to the tracer, so
+// operations appear within the caller's trace.
+// t -- tracer to report operations to
+func WithTracer(t Tracer) Option {
+	return func(c *config) {
+		if t == nil {
+			t = nopTracer{}
+		}
+		c.tracer = t
+	}
+}
+
+// nopTracer traces nothing. It is the default.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ Operation) (context.Context, func(error)) {
+	return ctx, nopEnd
+}
+
+func nopEnd(error) {}
+
+// trace starts tracing an operation on the open database.
+func (a *AppDB) trace(ctx context.Context, op string, query string) (context.Context, func(error)) {
+	return a.cfg.tracer.Start(ctx, Operation{op, a.path, a.appName, query})
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+
+// Package tracing reports appdb operations as OpenTelemetry spans.
+package tracing
+
+import (
+	"context"
+
+	"github.com/AndrewMobbs/appdb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies appdb as the source of its spans.
+const instrumentationName = "github.com/AndrewMobbs/appdb"
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// WithRedactSQL passes each statement through redact before it is recorded as the db.statement
+// attribute, for example to remove literal values. The attribute is left out if redact returns
+// an empty string.
+// redact -- function returning the text to record
+func WithRedactSQL(redact func(sql string) string) Option {
+	return func(t *Tracer) {
+		t.redact = redact
+	}
+}
+
+// Tracer is an appdb.Tracer creating an OpenTelemetry span for each operation.
+type Tracer struct {
+	tracer trace.Tracer
+	redact func(string) string
+}
+
+// New returns a Tracer creating spans with tp. Pass it to appdb.WithTracer:
+//
+//	db, err := appdb.Open(path, "myapp", 1, appdb.WithTracer(tracing.New(otel.GetTracerProvider())))
+//
+// tp -- provider of the tracer to use
+// opts -- options configuring the spans
+func New(tp trace.TracerProvider, opts ...Option) *Tracer {
+	t := &Tracer{tracer: tp.Tracer(instrumentationName)}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Start starts a span for op as a child of any span in ctx.
+func (t *Tracer) Start(ctx context.Context, op appdb.Operation) (context.Context, func(error)) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "sqlite"),
+		attribute.String("db.name", op.Path),
+		attribute.String("db.operation", op.Name),
+		attribute.String("appdb.app", op.AppName),
+	}
+	statement := op.SQL
+	if t.redact != nil && statement != "" {
+		statement = t.redact(statement)
+	}
+	if statement != "" {
+		attrs = append(attrs, attribute.String("db.statement", statement))
+	}
+	ctx, span := t.tracer.Start(ctx, "appdb."+op.Name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
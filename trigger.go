@@ -0,0 +1,159 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TriggerTiming is when a trigger runs relative to the change that fires it.
+type TriggerTiming string
+
+const (
+	TriggerBefore    TriggerTiming = "BEFORE"
+	TriggerAfter     TriggerTiming = "AFTER"
+	TriggerInsteadOf TriggerTiming = "INSTEAD OF"
+)
+
+// TriggerEvent is the kind of change that fires a trigger.
+type TriggerEvent string
+
+const (
+	TriggerInsert TriggerEvent = "INSERT"
+	TriggerUpdate TriggerEvent = "UPDATE"
+	TriggerDelete TriggerEvent = "DELETE"
+)
+
+// Trigger declares a trigger, for Migration.Triggers and ValidateTriggers.
+type Trigger struct {
+	Name string
+	// Table is the table, or for INSTEAD OF triggers the view, whose changes fire the trigger.
+	Table  string
+	Timing TriggerTiming
+	Event  TriggerEvent
+	// Columns limits an UPDATE trigger to updates of these columns.
+	Columns []string
+	// When is an SQL expression, which may refer to NEW and OLD, limiting the trigger to the rows
+	// for which it is true. It is empty for a trigger on every row.
+	When string
+	// Body holds the statements the trigger runs.
+	Body []string
+}
+
+// SQL returns the CREATE TRIGGER statement creating the trigger.
+func (t Trigger) SQL() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "CREATE TRIGGER %s", quoteIdent(t.Name))
+	if t.Timing != "" {
+		fmt.Fprintf(&s, " %s", t.Timing)
+	}
+	fmt.Fprintf(&s, " %s", t.Event)
+	if len(t.Columns) > 0 {
+		fmt.Fprintf(&s, " OF %s", strings.Join(quoteIdents(t.Columns), ", "))
+	}
+	fmt.Fprintf(&s, " ON %s", quoteIdent(t.Table))
+	if t.When != "" {
+		fmt.Fprintf(&s, " WHEN %s", t.When)
+	}
+	s.WriteString(" BEGIN")
+	for _, stmt := range t.Body {
+		fmt.Fprintf(&s, " %s;", strings.TrimRight(strings.TrimSpace(stmt), ";"))
+	}
+	s.WriteString(" END")
+	return s.String()
+}
+
+// DropSQL returns the statement dropping the trigger if it exists.
+func (t Trigger) DropSQL() string {
+	return "DROP TRIGGER IF EXISTS " + quoteIdent(t.Name)
+}
+
+// replaceTriggers returns the statements replacing any existing triggers of the same names with
+// triggers.
+func replaceTriggers(triggers []Trigger) []string {
+	var statements []string
+	for _, t := range triggers {
+		statements = append(statements, t.DropSQL(), t.SQL())
+	}
+	return statements
+}
+
+// ValidateTriggers checks that the database has triggers as declared, returning a
+// SchemaMismatchError listing those missing or different, or nil if they all match. Other
+// triggers in the database are ignored.
+// ctx -- context for the queries
+// triggers -- the expected triggers
+func (a *AppDB) ValidateTriggers(ctx context.Context, triggers ...Trigger) error {
+	start := time.Now()
+	err := a.validateTriggers(ctx, triggers)
+	a.logOp("validate_triggers", start, err)
+	return err
+}
+
+func (a *AppDB) validateTriggers(ctx context.Context, triggers []Trigger) error {
+	got, err := inspectSchema(ctx, a.DB)
+	if err != nil {
+		return err
+	}
+	var diffs []SchemaDifference
+	for _, t := range triggers {
+		want := t.SQL()
+		i := indexTrigger(got.Triggers, t.Name)
+		switch {
+		case i < 0:
+			diffs = append(diffs, SchemaDifference{Kind: MissingTrigger, Table: t.Table, Name: t.Name, Expected: want})
+		case !sameSQL(want, got.Triggers[i].SQL):
+			diffs = append(diffs, SchemaDifference{Kind: ChangedTrigger, Table: t.Table, Name: t.Name, Expected: want, Actual: got.Triggers[i].SQL})
+		}
+	}
+	if len(diffs) > 0 {
+		return &SchemaMismatchError{diffs}
+	}
+	return nil
+}
+
+// indexTrigger returns the index of the named trigger, or -1 if there is none.
+func indexTrigger(triggers []TriggerInfo, name string) int {
+	for i, t := range triggers {
+		if strings.EqualFold(t.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// previousTriggers returns the declarations of m's triggers by the latest earlier migration that
+// declares each, which reverting m restores.
+func previousTriggers(migrations []Migration, m *Migration) []Trigger {
+	var previous []Trigger
+	for _, t := range m.Triggers {
+		var found *Trigger
+		var version uint8
+		for i := range migrations {
+			o := &migrations[i]
+			if o.Version >= m.Version || (found != nil && o.Version <= version) {
+				continue
+			}
+			for j := range o.Triggers {
+				if strings.EqualFold(o.Triggers[j].Name, t.Name) {
+					found, version = &o.Triggers[j], o.Version
+				}
+			}
+		}
+		if found != nil {
+			previous = append(previous, *found)
+		}
+	}
+	return previous
+}
@@ -0,0 +1,52 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Upsert inserts a row into table, or, if it conflicts with an existing row on conflictCols,
+// updates the existing row's other columns to the given values, using SQLite's
+// ON CONFLICT ... DO UPDATE. The conflict columns must have a unique index or be the primary key.
+// ctx -- context for the statement
+// table -- name of the table
+// conflictCols -- columns identifying an existing row
+// values -- value of each column of the row, including the conflict columns
+func (a *AppDB) Upsert(ctx context.Context, table string, conflictCols []string, values map[string]any) (sql.Result, error) {
+	start := time.Now()
+	columns := make([]string, 0, len(values))
+	for c := range values {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	args := make([]any, len(columns))
+	var update []string
+	for i, c := range columns {
+		args[i] = values[c]
+		if !slices.Contains(conflictCols, c) {
+			update = append(update, c)
+		}
+	}
+	var res sql.Result
+	err := a.cfg.retry.do(ctx, func() error {
+		var err error
+		res, err = Insert(table).Columns(columns...).Values(args...).OnConflictUpdate(conflictCols, update).Exec(ctx, a)
+		return err
+	})
+	a.logOp("upsert", start, err, slog.String("table", table))
+	return res, err
+}
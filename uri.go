@@ -0,0 +1,57 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"net/url"
+	"strings"
+)
+
+// isURI reports whether dbPath is a SQLite URI filename such as "file:app.db?cache=shared".
+// URI filenames are passed to the driver unchanged, so any query parameters it understands can
+// be used.
+func isURI(dbPath string) bool {
+	return strings.HasPrefix(dbPath, "file:")
+}
+
+// filePath returns the filesystem location named by dbPath, which may be a plain path or a
+// SQLite URI filename.
+func filePath(dbPath string) string {
+	if !isURI(dbPath) {
+		return dbPath
+	}
+	p := strings.TrimPrefix(dbPath, "file:")
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	// file://localhost/path and file:///path both name /path
+	if strings.HasPrefix(p, "//") {
+		p = strings.TrimPrefix(p[2:], "localhost")
+	}
+	if u, err := url.PathUnescape(p); err == nil {
+		p = u
+	}
+	return p
+}
+
+// uriQuery returns the query parameters of a SQLite URI filename.
+func uriQuery(dbPath string) url.Values {
+	if !isURI(dbPath) {
+		return url.Values{}
+	}
+	_, query, _ := strings.Cut(dbPath, "?")
+	query, _, _ = strings.Cut(query, "#")
+	v, err := url.ParseQuery(query)
+	if err != nil {
+		return url.Values{}
+	}
+	return v
+}
@@ -0,0 +1,46 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Vacuum rebuilds the database file, returning its free pages to the filesystem and
+// defragmenting it. It needs temporary space of up to twice the database's size and blocks
+// writers while it runs, so suits an explicit "compact database" action; FreeSpace shows when
+// it is worthwhile.
+// ctx -- context for the statement
+func (a *AppDB) Vacuum(ctx context.Context) error {
+	start := time.Now()
+	before, _ := freeSpace(ctx, a.DB)
+	_, err := a.DB.ExecContext(ctx, "VACUUM")
+	a.logOp("vacuum", start, err, slog.Int64("free", before))
+	return err
+}
+
+// FreeSpace returns the bytes of unused pages in the database, which Vacuum would reclaim.
+func (a *AppDB) FreeSpace() (int64, error) {
+	return a.FreeSpaceContext(context.Background())
+}
+
+// FreeSpaceContext is FreeSpace with a context.
+func (a *AppDB) FreeSpaceContext(ctx context.Context) (int64, error) {
+	return freeSpace(ctx, a.DB)
+}
+
+func freeSpace(ctx context.Context, q querier) (int64, error) {
+	var free int64
+	err := q.QueryRowContext(ctx, "SELECT freelist_count * page_size FROM pragma_freelist_count(), pragma_page_size()").Scan(&free)
+	return free, err
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2021 Andrew Mobbs <andrew.mobbs@gmail.com>
+
+Permission is hereby granted, free of charge, any person obtaining a copy of this software and associated documentation files (the "Software"), deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+*/
+package appdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// WALFrame is one page written to the write-ahead log by a committed transaction.
+type WALFrame struct {
+	// Page is the number of the page, counting from 1.
+	Page uint32
+	// Commit is non-zero for the last frame of a transaction, and is the size of the database in
+	// pages after the transaction.
+	Commit uint32
+	// Data is the new content of the page.
+	Data []byte
+}
+
+// WALHook receives the frames of transactions committed to the database, in order. Frames are
+// whole page images, so a replica can apply them by writing each page at offset
+// (Page-1)*pageSize and, at a commit frame, truncating to Commit pages. Applying a frame twice is
+// harmless. If the hook returns an error the same frames, and any committed since, are offered
+// again at the next interval.
+type WALHook func(ctx context.Context, pageSize int, frames []WALFrame) error
+
+// WithWALHook puts the database in WAL mode and calls hook every interval with the frames
+// committed since the last call, for continuous replication in the style of Litestream. A
+// replica starts from a copy taken with BackupTo and applies the frames that follow.
+//
+// To be sure no frames are missed appdb takes over checkpointing: automatic checkpoints are
+// turned off and the log is checkpointed once its frames have been read. Other processes
+// writing to the database must not checkpoint it. Frames not yet accepted by the hook are held
+// in memory.
+// interval -- time between calls to the hook
+// hook -- function receiving committed frames
+func WithWALHook(interval time.Duration, hook WALHook) Option {
+	return func(c *config) {
+		c.journalMode = WAL
+		c.walHook = hook
+		c.walHookInterval = interval
+	}
+}
+
+// replicateWAL passes committed frames to the hook every interval until ctx is cancelled, and
+// once more before returning.
+func (a *AppDB) replicateWAL(ctx context.Context) {
+	// A separate pool so that checkpoints can't be starved by the application's use of its pool.
+	db, err := openDriver(a.cfg.driver, a.dsn, &a.cfg.extensions, a.cfg.connStatements(false), nil)
+	if err != nil {
+		a.logOp("wal_hook", time.Now(), err)
+		return
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+	r := &walReader{path: a.path + "-wal"}
+	var pending []WALFrame
+	ticker := time.NewTicker(a.cfg.walHookInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.shipWAL(context.Background(), db, r, &pending)
+			return
+		case <-ticker.C:
+			a.shipWAL(ctx, db, r, &pending)
+		}
+	}
+}
+
+// shipWAL collects newly committed frames and passes any not yet accepted to the hook.
+func (a *AppDB) shipWAL(ctx context.Context, db *sql.DB, r *walReader, pending *[]WALFrame) {
+	start := time.Now()
+	frames, err := collectWAL(ctx, db, r)
+	*pending = append(*pending, frames...)
+	if err == nil && len(*pending) > 0 {
+		err = a.cfg.walHook(ctx, r.pageSize, *pending)
+		if err == nil {
+			*pending = nil
+		}
+	}
+	if err != nil || len(frames) > 0 {
+		a.logOp("wal_hook", start, err, slog.Int("frames", len(frames)), slog.Int("pending", len(*pending)))
+	}
+}
+
+// collectWAL reads the frames committed since the last call and checkpoints them. Holding the
+// write lock while doing so stops new frames being added, and so checkpointed, unread.
+func collectWAL(ctx context.Context, db *sql.DB, r *walReader) ([]WALFrame, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+	frames, err := r.read()
+	if err != nil || len(frames) == 0 {
+		return frames, err
+	}
+	// A passive checkpoint needs no write lock, so can run on another connection.
+	_, err = checkpoint(ctx, db, CheckpointPassive)
+	return frames, err
+}
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagicLE         = 0x377f0682
+	walMagicBE         = 0x377f0683
+)
+
+// walReader reads the committed frames appended to a WAL file since the last read, following the
+// file through resets.
+type walReader struct {
+	path     string
+	pageSize int
+	salt     [2]uint32
+	next     int64     // index of the next frame to read
+	checksum [2]uint32 // running checksum up to the next frame
+	order    binary.ByteOrder
+}
+
+// read returns the frames of transactions committed since the last read.
+func (r *walReader) read() ([]WALFrame, error) {
+	f, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		// An empty or partly written header has no frames yet.
+		return nil, nil
+	}
+	if err := r.sync(header); err != nil {
+		return nil, err
+	}
+	var frames, tx []WALFrame
+	next, checksum := r.next, r.checksum
+	buf := make([]byte, walFrameHeaderSize+r.pageSize)
+	for {
+		off := walHeaderSize + next*int64(len(buf))
+		if _, err := f.ReadAt(buf, off); err != nil {
+			break
+		}
+		if binary.BigEndian.Uint32(buf[8:]) != r.salt[0] || binary.BigEndian.Uint32(buf[12:]) != r.salt[1] {
+			break
+		}
+		checksum = walChecksum(r.order, buf[:8], checksum)
+		checksum = walChecksum(r.order, buf[walFrameHeaderSize:], checksum)
+		if checksum[0] != binary.BigEndian.Uint32(buf[16:]) || checksum[1] != binary.BigEndian.Uint32(buf[20:]) {
+			break
+		}
+		next++
+		frame := WALFrame{
+			Page:   binary.BigEndian.Uint32(buf[0:]),
+			Commit: binary.BigEndian.Uint32(buf[4:]),
+			Data:   append([]byte(nil), buf[walFrameHeaderSize:]...),
+		}
+		tx = append(tx, frame)
+		if frame.Commit != 0 {
+			frames = append(frames, tx...)
+			tx = nil
+			r.next, r.checksum = next, checksum
+		}
+	}
+	return frames, nil
+}
+
+// sync checks the WAL header, and starts again from the first frame if the log has been reset
+// since the last read.
+func (r *walReader) sync(header []byte) error {
+	var order binary.ByteOrder
+	switch binary.BigEndian.Uint32(header[0:]) {
+	case walMagicLE:
+		order = binary.LittleEndian
+	case walMagicBE:
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("%s is not a WAL file", r.path)
+	}
+	pageSize := int(binary.BigEndian.Uint32(header[8:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	salt := [2]uint32{binary.BigEndian.Uint32(header[16:]), binary.BigEndian.Uint32(header[20:])}
+	if r.order != nil && salt == r.salt && pageSize == r.pageSize {
+		return nil
+	}
+	checksum := walChecksum(order, header[:24], [2]uint32{})
+	if checksum[0] != binary.BigEndian.Uint32(header[24:]) || checksum[1] != binary.BigEndian.Uint32(header[28:]) {
+		return fmt.Errorf("%s has a bad header checksum", r.path)
+	}
+	r.order, r.pageSize, r.salt = order, pageSize, salt
+	r.next, r.checksum = 0, checksum
+	return nil
+}
+
+// walChecksum continues the WAL checksum over b, whose length is a multiple of 8.
+func walChecksum(order binary.ByteOrder, b []byte, s [2]uint32) [2]uint32 {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s[0] += order.Uint32(b[i:]) + s[1]
+		s[1] += order.Uint32(b[i+4:]) + s[0]
+	}
+	return s
+}